@@ -7,7 +7,15 @@
 // ACL policies are provided by tailscale peer capabilities.
 package acl
 
-import "github.com/creachadair/mds/mstr"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/creachadair/mds/mstr"
+)
 
 // Action is an action on secrets that is subject to access control.
 type Action string
@@ -39,8 +47,45 @@ const (
 	// ActionDelete ("delete" in the API) denotes permission to delete secret
 	// versions, either individually or entirely.
 	ActionDelete = Action("delete")
+
+	// ActionApprove ("approve" in the API) denotes permission to approve or
+	// reject pending requests made by other principals for operations on a
+	// secret that require two-person approval.
+	ActionApprove = Action("approve")
+
+	// ActionAudit ("audit" in the API) denotes permission to read the audit
+	// log entries for a secret. Entries that do not name a secret, such as
+	// those for list operations, are matched against the empty name.
+	ActionAudit = Action("audit")
 )
 
+// actions is the set of all actions known to the service.
+var actions = []Action{
+	ActionGet, ActionInfo, ActionPut, ActionCreateVersion, ActionActivate, ActionDelete,
+	ActionApprove, ActionAudit,
+}
+
+// breakGlassPrefix is the prefix of the names of break-glass actions.
+const breakGlassPrefix = "break-glass:"
+
+// Valid reports whether a is an action known to the service, or the
+// break-glass form of one.
+func (a Action) Valid() bool {
+	base, _ := strings.CutPrefix(string(a), breakGlassPrefix)
+	return slices.Contains(actions, Action(base))
+}
+
+// BreakGlass returns the break-glass form of a, for example
+// "break-glass:get" for ActionGet. A rule naming the break-glass form of an
+// action is an emergency access rule: it grants the action only for requests
+// that carry a justification for the access (see Rules.AllowBreakGlass), and
+// such accesses are recorded as high-severity audit events.
+//
+// Because the break-glass form is a distinct action, an evaluator that does
+// not know about break-glass access treats it as an unknown action, and
+// grants nothing.
+func (a Action) BreakGlass() Action { return breakGlassPrefix + a }
+
 // Secret is a secret name pattern that can optionally contain '*' wildcard
 // characters. The wildcard means "zero or more of any character here."
 type Secret string
@@ -48,6 +93,19 @@ type Secret string
 // Match reports whether the Secret name pattern matches val.
 func (pat Secret) Match(val string) bool { return mstr.Match(val, string(pat)) }
 
+// Validate reports an error if pat is not a well-formed pattern.
+func (pat Secret) Validate() error {
+	switch {
+	case pat == "":
+		return errors.New("empty secret pattern")
+	case strings.TrimSpace(string(pat)) != string(pat):
+		return fmt.Errorf("secret pattern %q has surrounding whitespace", pat)
+	case strings.ContainsFunc(string(pat), func(r rune) bool { return !unicode.IsPrint(r) }):
+		return fmt.Errorf("secret pattern %q contains non-printing characters", pat)
+	}
+	return nil
+}
+
 // Rules is a set of ACLs for access to a secret.
 type Rules []Rule
 
@@ -61,6 +119,25 @@ func (rr Rules) Allow(action Action, secret string) bool {
 	return false
 }
 
+// AllowBreakGlass reports whether the ACLs allow action on secret for a
+// request that carries a break-glass justification. This is true if any rule
+// allows either action or its break-glass form.
+func (rr Rules) AllowBreakGlass(action Action, secret string) bool {
+	return rr.Allow(action, secret) || rr.Allow(action.BreakGlass(), secret)
+}
+
+// Validate reports an error describing each malformed rule in rr, or nil if
+// all the rules are well-formed.
+func (rr Rules) Validate() error {
+	var errs []error
+	for i, r := range rr {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Rule is an access control rule that permits some actions on some
 // secrets. Secrets can contain '*' wildcards, which match zero or
 // more characters.
@@ -89,3 +166,86 @@ func (r *Rule) Allow(action Action, secret string) bool {
 	}
 	return actionMatches(r.Action) && secretMatches(r.Secret)
 }
+
+// Validate reports an error if r is malformed: if it lists no actions or no
+// secrets, names an unknown action, or contains an invalid secret pattern.
+// A malformed rule does not grant access beyond what its well-formed parts
+// permit, but usually indicates a mistake in the policy.
+func (r *Rule) Validate() error {
+	var probs []string
+	if len(r.Action) == 0 {
+		probs = append(probs, "no actions")
+	}
+	for _, a := range r.Action {
+		if !a.Valid() {
+			probs = append(probs, fmt.Sprintf("unknown action %q", a))
+		}
+	}
+	if len(r.Secret) == 0 {
+		probs = append(probs, "no secrets")
+	}
+	for _, s := range r.Secret {
+		if err := s.Validate(); err != nil {
+			probs = append(probs, err.Error())
+		}
+	}
+	if len(probs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(probs, "; "))
+}
+
+// Decision is the outcome of checking an action on a secret against a set of
+// rules, with an explanation suitable for presenting to a human.
+type Decision struct {
+	// Allowed reports whether the action is permitted.
+	Allowed bool
+
+	// Rule is the index of the first rule that permits the action, or -1 if
+	// the action is denied. If the action is permitted only by a break-glass
+	// rule, Allowed is false and Rule is the index of that rule.
+	Rule int
+
+	// BreakGlass reports whether the action is permitted only by a
+	// break-glass rule, for requests that carry a justification.
+	BreakGlass bool
+
+	// Reason is a human-readable explanation of the decision.
+	Reason string
+}
+
+// Check reports whether the ACLs allow action on secret, and explains which
+// rule (if any) was responsible for the decision.
+func (rr Rules) Check(action Action, secret string) Decision {
+	var partial []int // rules matching secret but not action
+	glass := -1       // first break-glass rule granting action on secret
+	for i, r := range rr {
+		if r.Allow(action, secret) {
+			return Decision{
+				Allowed: true,
+				Rule:    i,
+				Reason:  fmt.Sprintf("rule %d grants %q on %q", i, action, secret),
+			}
+		} else if glass < 0 && r.Allow(action.BreakGlass(), secret) {
+			glass = i
+			continue
+		}
+		if slices.ContainsFunc(r.Secret, func(s Secret) bool { return s.Match(secret) }) {
+			partial = append(partial, i)
+		}
+	}
+	d := Decision{Rule: -1}
+	switch {
+	case glass >= 0:
+		d.Rule = glass
+		d.BreakGlass = true
+		d.Reason = fmt.Sprintf("break-glass rule %d grants %q on %q only with a justification", glass, action, secret)
+	case len(rr) == 0:
+		d.Reason = "caller has no rules"
+	case len(partial) == 0:
+		d.Reason = fmt.Sprintf("no rule matches secret %q", secret)
+	default:
+		d.Reason = fmt.Sprintf("rules %v match secret %q but do not grant %q", partial, secret, action)
+	}
+	return d
+}
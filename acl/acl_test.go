@@ -81,3 +81,119 @@ func TestACL(t *testing.T) {
 		}
 	}
 }
+
+func TestCheck(t *testing.T) {
+	rules := acl.Rules{
+		acl.Rule{
+			Action: []acl.Action{acl.ActionInfo},
+			Secret: []acl.Secret{"prod/*"},
+		},
+		acl.Rule{
+			Action: []acl.Action{acl.ActionGet, acl.ActionInfo},
+			Secret: []acl.Secret{"dev/*"},
+		},
+	}
+
+	tests := []struct {
+		action acl.Action
+		secret string
+		rule   int
+	}{
+		{acl.ActionInfo, "prod/foo", 0},
+		{acl.ActionGet, "dev/foo", 1},
+		{acl.ActionInfo, "dev/foo", 1},
+		{acl.ActionGet, "prod/foo", -1},
+		{acl.ActionGet, "other", -1},
+	}
+	for _, test := range tests {
+		d := rules.Check(test.action, test.secret)
+		if d.Rule != test.rule || d.Allowed != (test.rule >= 0) {
+			t.Errorf("Check(%q, %q): got %+v, want rule %d", test.action, test.secret, d, test.rule)
+		}
+		if d.Allowed != rules.Allow(test.action, test.secret) {
+			t.Errorf("Check(%q, %q): allowed=%v disagrees with Allow", test.action, test.secret, d.Allowed)
+		}
+		if d.Reason == "" {
+			t.Errorf("Check(%q, %q): empty reason", test.action, test.secret)
+		}
+	}
+
+	if d := acl.Rules(nil).Check(acl.ActionGet, "x"); d.Allowed || d.Rule != -1 {
+		t.Errorf("Check with no rules: got %+v, want denied", d)
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	rules := acl.Rules{
+		acl.Rule{
+			Action: []acl.Action{acl.ActionInfo},
+			Secret: []acl.Secret{"prod/*"},
+		},
+		acl.Rule{
+			Action: []acl.Action{acl.ActionGet.BreakGlass(), acl.ActionInfo.BreakGlass()},
+			Secret: []acl.Secret{"prod/*"},
+		},
+	}
+
+	tests := []struct {
+		action     acl.Action
+		secret     string
+		allow      bool
+		breakGlass bool
+	}{
+		{acl.ActionInfo, "prod/foo", true, true},
+		{acl.ActionGet, "prod/foo", false, true},
+		{acl.ActionPut, "prod/foo", false, false},
+		{acl.ActionGet, "dev/foo", false, false},
+	}
+	for _, test := range tests {
+		if got := rules.Allow(test.action, test.secret); got != test.allow {
+			t.Errorf("Allow(%q, %q): got %v, want %v", test.action, test.secret, got, test.allow)
+		}
+		if got := rules.AllowBreakGlass(test.action, test.secret); got != test.breakGlass {
+			t.Errorf("AllowBreakGlass(%q, %q): got %v, want %v", test.action, test.secret, got, test.breakGlass)
+		}
+	}
+
+	if d := rules.Check(acl.ActionGet, "prod/foo"); d.Allowed || !d.BreakGlass || d.Rule != 1 {
+		t.Errorf("Check(get, prod/foo): got %+v, want break-glass rule 1", d)
+	}
+	if d := rules.Check(acl.ActionInfo, "prod/foo"); !d.Allowed || d.BreakGlass || d.Rule != 0 {
+		t.Errorf("Check(info, prod/foo): got %+v, want rule 0", d)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule acl.Rule
+		ok   bool
+	}{
+		{"Valid", acl.Rule{Action: []acl.Action{"get", "info"}, Secret: []acl.Secret{"prod/*"}}, true},
+		{"AllActions", acl.Rule{
+			Action: []acl.Action{"get", "info", "put", "create-version", "activate", "delete"},
+			Secret: []acl.Secret{"*"},
+		}, true},
+		{"UnknownAction", acl.Rule{Action: []acl.Action{"activte"}, Secret: []acl.Secret{"*"}}, false},
+		{"BreakGlass", acl.Rule{Action: []acl.Action{"break-glass:get"}, Secret: []acl.Secret{"*"}}, true},
+		{"UnknownBreakGlass", acl.Rule{Action: []acl.Action{"break-glass:activte"}, Secret: []acl.Secret{"*"}}, false},
+		{"NoActions", acl.Rule{Secret: []acl.Secret{"*"}}, false},
+		{"NoSecrets", acl.Rule{Action: []acl.Action{"get"}}, false},
+		{"EmptyPattern", acl.Rule{Action: []acl.Action{"get"}, Secret: []acl.Secret{""}}, false},
+		{"SpacePattern", acl.Rule{Action: []acl.Action{"get"}, Secret: []acl.Secret{" prod/*"}}, false},
+		{"ControlPattern", acl.Rule{Action: []acl.Action{"get"}, Secret: []acl.Secret{"prod/\x00"}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.Validate()
+			if tc.ok && err != nil {
+				t.Errorf("Validate: unexpected error: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Error("Validate: got nil, want error")
+			}
+			if rerr := (acl.Rules{tc.rule}).Validate(); (rerr == nil) != (err == nil) {
+				t.Errorf("Rules.Validate: got %v, want %v", rerr, err)
+			}
+		})
+	}
+}
@@ -5,12 +5,14 @@
 package audit
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"io"
 	"math/rand"
 	"net/netip"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/tailscale/setec/acl"
@@ -39,6 +41,15 @@ type Principal struct {
 type Entry struct {
 	// ID is the entry's ID.
 	ID uint64 `json:"id"`
+	// Seq is the entry's sequence number in the log. Sequence numbers
+	// start at 1 and increase by one with each entry, including
+	// checkpoints.
+	Seq uint64 `json:"seq,omitempty"`
+	// Prev is the hex-encoded SHA-256 hash of the encoded form of the
+	// preceding entry in the log, or empty for the first entry. This
+	// chains each entry to its predecessors, so that any edit, deletion
+	// or reordering of entries is detectable (see Verify).
+	Prev string `json:"prev,omitempty"`
 	// Time is the entry's timestamp.
 	Time time.Time `json:"time"`
 	// Principal is the client who is doing something.
@@ -57,36 +68,175 @@ type Entry struct {
 	// a list operation.
 	Secret string `json:"secret,omitempty"`
 	// SecretVersion is the version of the secret being acted
-	// upon. Set for acl.ActionGet, acl.ActionPut,
-	// acl.ActionSetActive.
+	// upon. For operations that create a version, such as
+	// acl.ActionPut, it is the version that was created.
 	SecretVersion api.SecretVersion `json:"secretVersion,omitempty"`
+	// Approval describes the approval request this entry pertains to, for
+	// operations that require two-person approval.
+	Approval *Approval `json:"approval,omitempty"`
+	// Justification is the reason the principal gave for the access, if
+	// any. A justification is required for break-glass access.
+	Justification string `json:"justification,omitempty"`
+	// BreakGlass is whether the action was authorized only by a
+	// break-glass rule.
+	BreakGlass bool `json:"breakGlass,omitempty"`
+	// Severity is the severity of the event, or empty for routine
+	// events. Break-glass accesses are recorded with SeverityHigh.
+	Severity string `json:"severity,omitempty"`
+	// Outcome is the result of an authorized operation, one of the Outcome
+	// constants. It is empty for denied operations, and for operations
+	// awaiting approval.
+	Outcome string `json:"outcome,omitempty"`
+	// Generated describes the spec of a value generated by the server, for
+	// operations that write one (see api.GenerateSpec).
+	Generated string `json:"generated,omitempty"`
+	// Request describes the API request that caused this entry, if any.
+	Request *Request `json:"request,omitempty"`
+	// Checkpoint, if set, marks this entry as a signed checkpoint of the
+	// log rather than a record of an action. Checkpoints have no
+	// Principal or Action.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Outcomes of an operation recorded in Entry.Outcome.
+const (
+	OutcomeOK          = "ok"           // the operation succeeded
+	OutcomeNotFound    = "not-found"    // the secret or version does not exist
+	OutcomeNotModified = "not-modified" // a conditional get found no change
+	OutcomeError       = "error"        // the operation failed
+)
+
+// Request describes the API request that caused an audit log entry.
+type Request struct {
+	// ID is a unique identifier for the request, assigned by the server.
+	// The server reports it to the client in the response.
+	ID string `json:"id,omitempty"`
+	// Path is the path of the API method called.
+	Path string `json:"path,omitempty"`
+	// UserAgent is the User-Agent reported by the client.
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// SeverityHigh is the Entry.Severity of events that warrant review, such as
+// break-glass accesses.
+const SeverityHigh = "high"
+
+// Approval describes an event in the lifecycle of a request for an
+// operation that requires two-person approval.
+type Approval struct {
+	// ID is the unique identifier of the approval request.
+	ID string `json:"id"`
+	// Action is the action for which approval was requested.
+	Action acl.Action `json:"action"`
+	// State is the state of the request after this event, one of
+	// "pending", "approved", or "rejected".
+	State string `json:"state"`
 }
 
 // Writer is an audit log writer.
 type Writer struct {
-	w   io.Writer
-	enc *json.Encoder
+	w io.Writer
+
+	mu    sync.Mutex
+	seq   uint64 // sequence number of the last entry written
+	prev  string // hash of the last entry written
+	key   ed25519.PrivateKey
+	every int // entries between checkpoints
+	since int // entries written since the last checkpoint
+
+	sinks   fanout      // additional destinations for entries
+	sinkErr func(error) // handler for sink errors, or nil to log
+
+	countSkipped expvar.Int // malformed lines skipped by searches
 }
 
 // New returns a Writer that outputs audit log entries to w as JSON
 // objects. If w also implements io.Closer, Writer.Close closes w. If
 // w also implements a Sync method with the same signature as os.File,
 // Writer.Sync calls w.Sync.
+//
+// The entries written to w form a new hash chain starting at sequence
+// number 1.
 func New(w io.Writer) *Writer {
-	return &Writer{
-		w:   w,
-		enc: json.NewEncoder(w),
-	}
+	return &Writer{w: w}
 }
 
 // NewFile returns a Writer that outputs audit log entries to a file
-// at path, creating it if necessary.
+// at path, creating it if necessary. If the file already contains
+// entries, new entries continue the hash chain from the last of them.
+// The file is not rotated; see NewRotatingFile.
 func NewFile(path string) (*Writer, error) {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return NewRotatingFile(path, RotateOptions{})
+}
+
+// SignCheckpoints configures l to append a checkpoint signed by key after
+// every n entries (if n <= 0, DefaultCheckpointInterval is used), and when
+// l is closed. A nil key disables checkpoints, which is the default.
+func (l *Writer) SignCheckpoints(key ed25519.PrivateKey, n int) {
+	if n <= 0 {
+		n = DefaultCheckpointInterval
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.key, l.every, l.since = key, n, 0
+}
+
+// Checkpoint appends a signed checkpoint covering all the entries written
+// so far. It does nothing successfully if checkpoints are not enabled, or
+// no entries have been written since the last checkpoint.
+func (l *Writer) Checkpoint() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkpointLocked(); err != nil {
+		return err
+	}
+	return l.Sync()
+}
+
+func (l *Writer) checkpointLocked() error {
+	if l.key == nil || l.since == 0 {
+		return nil
+	}
+	seq := l.seq + 1
+	return l.writeLocked(&Entry{
+		Time:       time.Now().UTC(),
+		Checkpoint: &Checkpoint{Signature: ed25519.Sign(l.key, checkpointMessage(seq, l.prev))},
+	})
+}
+
+// rotateLocked rotates the log file if it is due, ending the current
+// segment with a checkpoint if they are enabled.
+func (l *Writer) rotateLocked() error {
+	rf, ok := l.w.(*rotatingFile)
+	if !ok || !rf.due() {
+		return nil
+	}
+	if err := l.checkpointLocked(); err != nil {
+		return err
+	}
+	return rf.rotate()
+}
+
+// writeLocked assigns e the next sequence number in the chain, and writes
+// it to the log.
+func (l *Writer) writeLocked(e *Entry) error {
+	e.Seq = l.seq + 1
+	e.Prev = l.prev
+	bs, err := json.Marshal(e)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err := l.w.Write(append(bs, '\n')); err != nil {
+		return err
 	}
-	return New(f), nil
+	l.seq, l.prev = e.Seq, hashLine(bs)
+	if e.Checkpoint != nil {
+		l.since = 0
+	} else {
+		l.since++
+	}
+	l.sendLocked(e, bs)
+	return nil
 }
 
 // Sync commits the current contents of the file to stable storage if
@@ -100,31 +250,51 @@ func (l *Writer) Sync() error {
 }
 
 // Close closes the Writer if the writer was created with a sink that
-// implements io.Closer, or else does nothing successfully.
+// implements io.Closer, or else does nothing successfully. If checkpoints
+// are enabled, Close first writes a final checkpoint. Close also closes the
+// sinks of l, waiting for buffered entries to be delivered.
 func (l *Writer) Close() error {
+	l.mu.Lock()
+	perr := l.checkpointLocked()
+	sinks := l.sinks
+	l.sinks = nil // entries written from now on are not delivered to sinks
+	l.mu.Unlock()
+
+	// Draining the sinks may take a while, so do not hold the lock.
+	kerr := sinks.Close()
 	serr := l.Sync()
 	var cerr error
 	if c, ok := l.w.(io.Closer); ok {
 		cerr = c.Close()
 	}
-	return errors.Join(serr, cerr)
+	return errors.Join(perr, kerr, serr, cerr)
 }
 
 type syncer interface {
 	Sync() error
 }
 
-// WriteEntries writes entries to the audit log. Each entry's ID and
-// Time fields are set prior to writing, any existing value is
+// WriteEntries writes entries to the audit log. Each entry's ID, Time,
+// Seq and Prev fields are set prior to writing, any existing value is
 // overwritten.
 func (l *Writer) WriteEntries(entries ...*Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	for _, e := range entries {
 		e.ID = rand.Uint64()
 		e.Time = time.Now().UTC()
 
-		if err := l.enc.Encode(e); err != nil {
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+		if err := l.writeLocked(e); err != nil {
 			return err
 		}
+		if l.key != nil && l.since >= l.every {
+			if err := l.checkpointLocked(); err != nil {
+				return err
+			}
+		}
 	}
 	return l.Sync()
 }
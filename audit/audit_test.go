@@ -5,12 +5,26 @@ package audit_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 )
 
@@ -91,3 +105,583 @@ func (t *testWriter) Sync() error  { t.synced = true; return t.syncErr }
 func (t *testWriter) Close() error { t.closed = true; return nil }
 
 func addrEqual(x, y netip.Addr) bool { return x == y }
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	// Write entries to a file in two sessions, to check that the chain
+	// continues across reopening.
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for range 2 {
+		w, err := audit.NewFile(path)
+		if err != nil {
+			t.Fatalf("NewFile: %v", err)
+		}
+		w.SignCheckpoints(priv, 3)
+		for i := range 4 {
+			if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: fmt.Sprint("secret", i)}); err != nil {
+				t.Fatalf("WriteEntries: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading log: %v", err)
+	}
+
+	rep, err := audit.Verify(bytes.NewReader(data), pub)
+	if err != nil {
+		t.Fatalf("Verify: unexpected error: %v", err)
+	}
+	// Each session writes 4 entries, a checkpoint after the third, and a
+	// final checkpoint on close.
+	want := &audit.Report{Entries: 8, Checkpoints: 4, First: 1, Last: 12, Verified: 12}
+	if diff := cmp.Diff(rep, want); diff != "" {
+		t.Errorf("Verify report (-got+want):\n%s", diff)
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1] // drop empty string after the final newline
+	tests := []struct {
+		name  string
+		lines []string
+		key   ed25519.PublicKey
+		want  string
+	}{
+		{"Modified", append(slices.Clone(lines[:1]), append([]string{strings.Replace(lines[1], "secret1", "secretX", 1)}, lines[2:]...)...),
+			pub, "line 3: entry 3 does not match"},
+		{"Removed", append(slices.Clone(lines[:1]), lines[2:]...), pub, "line 2: entry 3 follows entry 1"},
+		{"Reordered", append([]string{lines[1], lines[0]}, lines[2:]...), pub, "line 2: entry 1 follows entry 2"},
+		{"Inserted", append([]string{lines[0], `{"id":1,"action":"get"}` + "\n"}, lines[1:]...), pub, "line 2: unchained entry"},
+		{"WrongKey", lines, otherPub, "line 4: checkpoint 4 has an invalid signature"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := audit.Verify(strings.NewReader(strings.Join(tc.lines, "")), tc.key)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Verify: got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+
+	// A log that starts partway through the chain is accepted.
+	rep, err = audit.Verify(strings.NewReader(strings.Join(lines[4:], "")), pub)
+	if err != nil {
+		t.Fatalf("Verify suffix: unexpected error: %v", err)
+	} else if rep.First != 5 {
+		t.Errorf("Verify suffix: got first entry %d, want 5", rep.First)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	// Plant an old segment that should be removed by retention.
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format("20060102T150405.000000000Z") + ".gz"
+	var empty bytes.Buffer
+	gzip.NewWriter(&empty).Close()
+	if err := os.WriteFile(old, empty.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := audit.RotateOptions{MaxSize: 1, Retention: 24 * time.Hour}
+	for range 2 {
+		w, err := audit.NewRotatingFile(path, opts)
+		if err != nil {
+			t.Fatalf("NewRotatingFile: %v", err)
+		}
+		w.SignCheckpoints(priv, 0)
+		for i := range 3 {
+			if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: fmt.Sprint("secret", i)}); err != nil {
+				t.Fatalf("WriteEntries: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	segs, err := audit.Segments(path)
+	if err != nil {
+		t.Fatalf("Segments: %v", err)
+	}
+	if slices.Contains(segs, old) {
+		t.Errorf("Segments: expired segment %q was not removed", old)
+	}
+	// With MaxSize 1, each entry but the first goes to a new segment, and the
+	// closed segments are compressed.
+	if len(segs) != 5 {
+		t.Errorf("Segments: got %d segments, want 5: %q", len(segs), segs)
+	}
+
+	// The segments and the current file form a single chain, in which each
+	// segment ends with a checkpoint.
+	var readers []io.Reader
+	for _, seg := range append(segs, path) {
+		if !strings.HasSuffix(seg, ".gz") && seg != path {
+			t.Errorf("Segment %q is not compressed", seg)
+		}
+		rc, err := audit.OpenSegment(seg)
+		if err != nil {
+			t.Fatalf("OpenSegment: %v", err)
+		}
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+	rep, err := audit.Verify(io.MultiReader(readers...), pub)
+	if err != nil {
+		t.Fatalf("Verify: unexpected error: %v", err)
+	}
+	if rep.Entries != 6 || rep.First != 1 || rep.Verified != rep.Last {
+		t.Errorf("Verify: got %+v, want 6 entries from 1, all signed", rep)
+	}
+}
+
+func TestRotationErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Plant an expired segment that cannot be removed.
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format("20060102T150405.000000000Z")
+	if err := os.MkdirAll(filepath.Join(old, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The chain continues from the most recent segment, which must be readable.
+	recent := path + "." + time.Now().Add(-time.Hour).UTC().Format("20060102T150405.000000000Z")
+	if err := os.WriteFile(recent, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	w, err := audit.NewRotatingFile(path, audit.RotateOptions{
+		MaxSize:   1,
+		Retention: 24 * time.Hour,
+		OnError:   func(err error) { errc <- err },
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	for range 2 {
+		if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "x"}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+
+	// The error is reported when it occurs, not when the log is closed.
+	select {
+	case err := <-errc:
+		if !strings.Contains(err.Error(), old) {
+			t.Errorf("OnError: got %v, want an error removing %s", err, old)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnError was not called")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := audit.NewRotatingFile(path, audit.RotateOptions{MaxSize: 1})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	defer w.Close()
+
+	alice := audit.Principal{Hostname: "laptop", User: "alice"}
+	bot := audit.Principal{Hostname: "ci", Tags: []string{"tag:ci"}}
+	add := func(p audit.Principal, act acl.Action, secret string, ok bool) {
+		t.Helper()
+		if err := w.WriteEntries(&audit.Entry{Principal: p, Action: act, Secret: secret, Authorized: ok}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+	add(alice, acl.ActionGet, "prod/a", true)
+	add(bot, acl.ActionGet, "prod/a", true)
+	add(bot, acl.ActionPut, "dev/b", false)
+	start := time.Now()
+	add(alice, acl.ActionInfo, "dev/b", true)
+	add(alice, acl.ActionGet, "prod/c", false)
+
+	no := false
+	tests := []struct {
+		name string
+		q    audit.Query
+		want []string // action + secret of each expected entry
+	}{
+		{"All", audit.Query{}, []string{"get prod/a", "get prod/a", "put dev/b", "info dev/b", "get prod/c"}},
+		{"Principal", audit.Query{Principal: "alice"}, []string{"get prod/a", "info dev/b", "get prod/c"}},
+		{"Hostname", audit.Query{Principal: "ci"}, []string{"get prod/a", "put dev/b"}},
+		{"Tag", audit.Query{Tag: "tag:ci"}, []string{"get prod/a", "put dev/b"}},
+		{"Secret", audit.Query{Secret: "prod/*"}, []string{"get prod/a", "get prod/a", "get prod/c"}},
+		{"Action", audit.Query{Action: acl.ActionGet, Secret: "prod/a"}, []string{"get prod/a", "get prod/a"}},
+		{"Denied", audit.Query{Authorized: &no}, []string{"put dev/b", "get prod/c"}},
+		{"Since", audit.Query{Since: start}, []string{"info dev/b", "get prod/c"}},
+		{"Until", audit.Query{Until: start}, []string{"get prod/a", "get prod/a", "put dev/b"}},
+		{"Limit", audit.Query{Limit: 2}, []string{"info dev/b", "get prod/c"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := w.Search(tc.q, nil)
+			if err != nil {
+				t.Fatalf("Search: unexpected error: %v", err)
+			}
+			var gotStr []string
+			for _, e := range got {
+				gotStr = append(gotStr, string(e.Action)+" "+e.Secret)
+			}
+			if diff := cmp.Diff(gotStr, tc.want); diff != "" {
+				t.Errorf("Search (-got+want):\n%s", diff)
+			}
+		})
+	}
+
+	// The keep function filters entries before the limit is applied.
+	got, err := w.Search(audit.Query{Limit: 1}, func(e *audit.Entry) bool { return e.Secret == "prod/a" })
+	if err != nil {
+		t.Fatalf("Search: unexpected error: %v", err)
+	} else if len(got) != 1 || got[0].Principal.Hostname != "ci" {
+		t.Errorf("Search with keep: got %+v, want one entry from ci", got)
+	}
+
+	if _, err := audit.New(io.Discard).Search(audit.Query{}, nil); !errors.Is(err, audit.ErrNotSearchable) {
+		t.Errorf("Search without a file: got %v, want %v", err, audit.ErrNotSearchable)
+	}
+}
+
+func TestSearchMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := audit.NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer w.Close()
+	add := func(secret string) {
+		t.Helper()
+		if err := w.WriteEntries(&audit.Entry{Action: acl.ActionGet, Secret: secret, Authorized: true}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+	add("a")
+
+	// Corrupt the log between two valid entries.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("Open log: %v", err)
+	}
+	if _, err := f.WriteString("{\"seq\":2,\"act\n"); err != nil {
+		t.Fatalf("Corrupt log: %v", err)
+	}
+	f.Close()
+	add("b")
+
+	got, err := w.Search(audit.Query{}, nil)
+	if err != nil {
+		t.Fatalf("Search: unexpected error: %v", err)
+	}
+	var secrets []string
+	for _, e := range got {
+		secrets = append(secrets, e.Secret)
+	}
+	if diff := cmp.Diff(secrets, []string{"a", "b"}); diff != "" {
+		t.Errorf("Search (-got+want):\n%s", diff)
+	}
+	if n := w.SkippedLines().Value(); n != 1 {
+		t.Errorf("SkippedLines: got %d, want 1", n)
+	}
+}
+
+type recordSink struct {
+	err  error
+	data []string
+}
+
+func (r *recordSink) Send(e *audit.Entry, data []byte) error {
+	r.data = append(r.data, string(data))
+	return r.err
+}
+func (r *recordSink) Close() error { return nil }
+
+// slowSink is a sink whose Close blocks until release is closed.
+type slowSink struct {
+	recordSink
+	closing, release chan struct{}
+}
+
+func (s *slowSink) Close() error {
+	close(s.closing)
+	<-s.release
+	return nil
+}
+
+func TestCloseSlowSink(t *testing.T) {
+	var buf bytes.Buffer
+	w := audit.New(&buf)
+	sink := &slowSink{closing: make(chan struct{}), release: make(chan struct{})}
+	w.AddSink(sink)
+
+	done := make(chan error, 1)
+	go func() { done <- w.Close() }()
+	<-sink.closing
+
+	// Entries can still be written while the sink drains, but they are not
+	// delivered to it.
+	wrote := make(chan error, 1)
+	go func() { wrote <- w.WriteEntries(&audit.Entry{Action: "get", Secret: "x"}) }()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Errorf("WriteEntries: unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WriteEntries blocked while a sink was closing")
+	}
+	if len(sink.data) != 0 {
+		t.Errorf("Sink data: got %q, want none", sink.data)
+	}
+
+	close(sink.release)
+	if err := <-done; err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var buf bytes.Buffer
+	w := audit.New(&buf)
+	good, bad := new(recordSink), &recordSink{err: errors.New("sink failed")}
+	w.AddSink(audit.Fanout(good, bad))
+	var errs []error
+	w.OnSinkError(func(err error) { errs = append(errs, err) })
+
+	// A failing sink does not prevent the entry from being logged.
+	if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "x"}); err != nil {
+		t.Fatalf("WriteEntries: unexpected error: %v", err)
+	}
+	if got := strings.TrimSpace(buf.String()); len(good.data) != 1 || good.data[0] != got {
+		t.Errorf("Sink data: got %q, want %q", good.data, got)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], bad.err) {
+		t.Errorf("Sink errors: got %v, want %v", errs, bad.err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var got []*audit.Entry
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer xyzzy" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var batch []*audit.Entry
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("Decode webhook body: %v", err)
+		}
+		got = append(got, batch...)
+	}))
+	defer hs.Close()
+
+	var errs []error
+	w := audit.New(io.Discard)
+	w.AddSink(audit.NewWebhookSink(hs.URL, audit.WebhookOptions{
+		Header: http.Header{"Authorization": {"Bearer xyzzy"}},
+		Buffer: audit.BufferOptions{
+			RetryDelay: time.Millisecond,
+			OnError:    func(err error) { errs = append(errs, err) },
+		},
+	}))
+	for i := range 3 {
+		if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: fmt.Sprint("secret", i)}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Close waits for delivery, including the retry of the failed request.
+	if len(got) != 3 || got[2].Secret != "secret2" {
+		t.Errorf("Webhook entries: got %d, want 3", len(got))
+	}
+	if len(errs) != 0 {
+		t.Errorf("Webhook errors: got %v, want none", errs)
+	}
+}
+
+func TestSinkCloseTimeout(t *testing.T) {
+	// The webhook never responds, so delivery can only end by abandoning it.
+	release := make(chan struct{})
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hs.Close()
+	defer close(release)
+
+	var mu sync.Mutex
+	var errs []error
+	w := audit.New(io.Discard)
+	w.AddSink(audit.NewWebhookSink(hs.URL, audit.WebhookOptions{
+		BatchSize: 1,
+		Buffer: audit.BufferOptions{
+			RetryDelay:   time.Hour,
+			CloseTimeout: 50 * time.Millisecond,
+			OnError: func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			},
+		},
+	}))
+	for i := range 3 {
+		if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: fmt.Sprint("secret", i)}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close took %v, want it bounded by the close timeout", d)
+	}
+
+	// All the entries are reported as discarded, whether their delivery was
+	// in progress or they were still buffered.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "discarding 3 entries") {
+		t.Errorf("Sink errors: got %v, want 3 entries discarded", errs)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer conn.Close()
+
+	s, err := audit.NewSyslogSink(audit.SyslogOptions{Addr: addr, AppName: "test"})
+	if err != nil {
+		t.Fatalf("NewSyslogSink: %v", err)
+	}
+	w := audit.New(io.Discard)
+	w.AddSink(s)
+	if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "prod/x", Authorized: true, Severity: audit.SeverityHigh}); err != nil {
+		t.Fatalf("WriteEntries: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	msg := make([]byte, 4096)
+	n, err := conn.Read(msg)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	// Facility authpriv (10), severity warning (4).
+	got := string(msg[:n])
+	if !strings.HasPrefix(got, "<84>1 ") || !strings.Contains(got, " test ") || !strings.Contains(got, `"secret":"prod/x"`) {
+		t.Errorf("Syslog message: got %q", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	entries := []*audit.Entry{
+		{Time: time.Now().UTC(), Principal: audit.Principal{User: "a"}, Action: acl.ActionGet, Secret: "x", Authorized: true, Seq: 1},
+		{Time: time.Now().UTC(), Principal: audit.Principal{User: "b"}, Action: acl.ActionPut, Secret: "y", Authorized: true, Seq: 3},
+	}
+	x, err := audit.NewExport(entries, priv)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+
+	// Round trip through an indented encoding, as the CLI writes it.
+	check := func(t *testing.T, x *audit.Export, key ed25519.PublicKey) ([]*audit.Entry, error) {
+		t.Helper()
+		bs, err := json.MarshalIndent(x, "", "  ")
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		var y audit.Export
+		if err := json.Unmarshal(bs, &y); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return y.Verify(key)
+	}
+
+	got, err := check(t, x, pub)
+	if err != nil {
+		t.Fatalf("Verify: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, entries, cmp.Comparer(addrEqual)); diff != "" {
+		t.Errorf("Verify entries (-got, +want):\n%s", diff)
+	}
+	// The key embedded in the export is not trusted.
+	if _, err := check(t, x, nil); err == nil {
+		t.Error("Verify without a key: got nil, want error")
+	}
+	_, forger, _ := ed25519.GenerateKey(nil)
+	forged, err := audit.NewExport(entries, forger)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	if _, err := check(t, forged, pub); !errors.Is(err, audit.ErrBadSignature) {
+		t.Errorf("Verify forged export: got %v, want %v", err, audit.ErrBadSignature)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := check(t, x, other); !errors.Is(err, audit.ErrBadSignature) {
+		t.Errorf("Verify with wrong key: got %v, want %v", err, audit.ErrBadSignature)
+	}
+
+	// Removing, modifying or backdating entries invalidates the signature.
+	for name, tamper := range map[string]func(*audit.Export){
+		"remove": func(x *audit.Export) { x.Entries = x.Entries[1:] },
+		"modify": func(x *audit.Export) {
+			x.Entries[0] = json.RawMessage(strings.Replace(string(x.Entries[0]), `"a"`, `"c"`, 1))
+		},
+		"time": func(x *audit.Export) { x.Time = x.Time.Add(-time.Hour) },
+	} {
+		y := *x
+		y.Entries = slices.Clone(x.Entries)
+		tamper(&y)
+		if _, err := check(t, &y, pub); !errors.Is(err, audit.ErrBadSignature) {
+			t.Errorf("Verify after %s: got %v, want %v", name, err, audit.ErrBadSignature)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultCheckpointInterval is the number of entries between signed
+// checkpoints if SignCheckpoints is not given an interval.
+const DefaultCheckpointInterval = 100
+
+// maxLineSize is the longest audit log line a reader accepts.
+const maxLineSize = 1 << 20
+
+// Checkpoint is a signature over the hash chain of an audit log up to a
+// checkpoint entry. A valid checkpoint attests that the entries preceding it
+// were written by the holder of the signing key, and have not been changed
+// since.
+type Checkpoint struct {
+	// Signature is the ed25519 signature of the checkpoint entry's Seq and
+	// Prev fields (see checkpointMessage).
+	Signature []byte `json:"signature"`
+}
+
+// checkpointMessage returns the message signed by a checkpoint at sequence
+// number seq, whose preceding entry has hash prev.
+func checkpointMessage(seq uint64, prev string) []byte {
+	return []byte("setec-audit-checkpoint:" + strconv.FormatUint(seq, 10) + ":" + prev)
+}
+
+// hashLine returns the hex-encoded SHA-256 hash of an encoded entry,
+// excluding its trailing newline.
+func hashLine(line []byte) string {
+	h := sha256.Sum256(line)
+	return hex.EncodeToString(h[:])
+}
+
+// newScanner returns a line scanner for audit log entries in r.
+func newScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxLineSize)
+	return sc
+}
+
+// lastEntry reports the sequence number and hash of the last entry in r, or
+// zero and "" if r is empty. An entry written before hash chaining was
+// introduced has sequence number zero.
+func lastEntry(r io.Reader) (seq uint64, hash string, _ error) {
+	var last []byte
+	sc := newScanner(r)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) != 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, "", err
+	} else if last == nil {
+		return 0, "", nil
+	}
+	var e Entry
+	if err := json.Unmarshal(last, &e); err != nil {
+		return 0, "", fmt.Errorf("last entry: %w", err)
+	}
+	return e.Seq, hashLine(last), nil
+}
+
+// A Report summarizes the contents of an audit log checked by Verify.
+type Report struct {
+	Entries     int    // number of entries, excluding checkpoints
+	Checkpoints int    // number of checkpoints
+	Unchained   int    // number of entries written before hash chaining
+	First, Last uint64 // sequence numbers of the first and last chained entries
+
+	// Verified is the sequence number of the last checkpoint whose signature
+	// was verified, or 0 if none was. Entries after Verified are intact with
+	// respect to the hash chain, but could have been truncated undetectably.
+	Verified uint64
+}
+
+// Verify reads audit log entries from r and checks that they form an
+// unbroken hash chain, reporting an error that describes the first problem
+// found: a missing, inserted, modified or reordered entry. If key != nil,
+// Verify also checks the signature of each checkpoint.
+//
+// The log may begin partway through a chain, as when older entries have
+// been rotated into a separate file; the sequence number of the first entry
+// is given in the report.
+func Verify(r io.Reader, key ed25519.PublicKey) (*Report, error) {
+	var rep Report
+	var prev string // hash of the preceding line, if any
+	sc := newScanner(r)
+	for lnum := 1; sc.Scan(); lnum++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return &rep, fmt.Errorf("line %d: invalid entry: %w", lnum, err)
+		}
+
+		switch {
+		case e.Seq == 0 && rep.Last != 0:
+			return &rep, fmt.Errorf("line %d: unchained entry after entry %d (inserted?)", lnum, rep.Last)
+		case e.Seq == 0:
+			rep.Unchained++
+		case rep.Last != 0 && e.Seq != rep.Last+1:
+			return &rep, fmt.Errorf("line %d: entry %d follows entry %d (entries missing or reordered)", lnum, e.Seq, rep.Last)
+		case e.Prev != prev && (prev != "" || e.Seq == 1):
+			return &rep, fmt.Errorf("line %d: entry %d does not match the hash of its predecessor (entries modified or removed)", lnum, e.Seq)
+		}
+		prev = hashLine(line)
+		if e.Seq == 0 {
+			continue
+		}
+		if rep.First == 0 {
+			rep.First = e.Seq
+		}
+		rep.Last = e.Seq
+
+		if e.Checkpoint == nil {
+			rep.Entries++
+			continue
+		}
+		rep.Checkpoints++
+		if key != nil {
+			if !ed25519.Verify(key, checkpointMessage(e.Seq, e.Prev), e.Checkpoint.Signature) {
+				return &rep, fmt.Errorf("line %d: checkpoint %d has an invalid signature", lnum, e.Seq)
+			}
+			rep.Verified = e.Seq
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return &rep, err
+	}
+	return &rep, nil
+}
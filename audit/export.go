@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An Export is a signed extract of an audit log, which a recipient holding
+// the public key of the signer can check has not been modified.
+//
+// The signature covers the time of the export and the encoded entries as
+// they appear in Entries, ignoring insignificant whitespace. Entries need not
+// be contiguous in the log; a recipient can use their sequence numbers to
+// tell where entries were omitted.
+type Export struct {
+	// Time is when the export was created.
+	Time time.Time `json:"time"`
+
+	// Entries are the JSON encodings of the exported entries, in
+	// chronological order.
+	Entries []json.RawMessage `json:"entries"`
+
+	// PublicKey is the ed25519 public key corresponding to the key that
+	// signed the export. It is informational only: A recipient must check
+	// the signature against a key obtained by other means.
+	PublicKey []byte `json:"publicKey"`
+
+	// Signature is the ed25519 signature of the export.
+	Signature []byte `json:"signature"`
+}
+
+// NewExport returns an Export of entries, signed with key.
+func NewExport(entries []*Entry, key ed25519.PrivateKey) (*Export, error) {
+	x := &Export{
+		Time:      time.Now().UTC(),
+		Entries:   make([]json.RawMessage, len(entries)),
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+	for i, e := range entries {
+		bs, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		x.Entries[i] = bs
+	}
+	x.Signature = ed25519.Sign(key, x.message())
+	return x, nil
+}
+
+// ErrBadSignature is reported by Export.Verify if the signature of the
+// export is not valid.
+var ErrBadSignature = errors.New("invalid export signature")
+
+// Verify checks that x was signed by the holder of key and has not been
+// modified, and if so returns its decoded entries. The key must be obtained
+// from the server by a trusted channel; x.PublicKey cannot show where x came
+// from.
+func (x *Export) Verify(key ed25519.PublicKey) ([]*Entry, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	if !ed25519.Verify(key, x.message(), x.Signature) {
+		return nil, ErrBadSignature
+	}
+	out := make([]*Entry, len(x.Entries))
+	for i, raw := range x.Entries {
+		var e Entry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		out[i] = &e
+	}
+	return out, nil
+}
+
+// message returns the message signed for x, which commits to the time of the
+// export, the number of entries, and the SHA-256 hash of the entries joined
+// by newlines. Entries are hashed in compact form, so that the signature
+// survives reformatting of the export.
+func (x *Export) message() []byte {
+	h := sha256.New()
+	var buf bytes.Buffer
+	for _, e := range x.Entries {
+		buf.Reset()
+		if err := json.Compact(&buf, e); err != nil {
+			buf.Reset()
+			buf.Write(e) // hash invalid JSON as-is
+		}
+		buf.WriteByte('\n')
+		h.Write(buf.Bytes())
+	}
+	return fmt.Appendf(nil, "setec-audit-export:%s:%d:%s",
+		x.Time.UTC().Format(time.RFC3339Nano), len(x.Entries), hex.EncodeToString(h.Sum(nil)))
+}
@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+)
+
+// ErrNotSearchable is the error reported by Writer.Search if the Writer does
+// not write to a file.
+var ErrNotSearchable = errors.New("audit log is not searchable")
+
+// Query selects audit log entries. Each non-zero field of a Query must match
+// for an entry to be selected; the zero Query matches every entry except
+// checkpoints.
+type Query struct {
+	// Principal, if set, matches entries whose principal has this user
+	// (login name) or hostname.
+	Principal string
+
+	// Tag, if set, matches entries whose principal has this tag.
+	Tag string
+
+	// Secret, if set, is a pattern matching the names of secrets.
+	Secret acl.Secret
+
+	// Action, if set, matches entries for this action.
+	Action acl.Action
+
+	// Authorized, if non-nil, matches entries whose authorization result
+	// equals *Authorized.
+	Authorized *bool
+
+	// Since and Until, if non-zero, match entries whose times fall in the
+	// half-open interval [Since, Until).
+	Since, Until time.Time
+
+	// Limit, if positive, is the maximum number of entries to report. If
+	// more entries match, the most recent ones are reported.
+	Limit int
+}
+
+// Match reports whether e satisfies q.
+func (q *Query) Match(e *Entry) bool {
+	switch {
+	case e.Checkpoint != nil:
+		return false
+	case q.Principal != "" && e.Principal.User != q.Principal && e.Principal.Hostname != q.Principal:
+		return false
+	case q.Tag != "" && !slices.Contains(e.Principal.Tags, q.Tag):
+		return false
+	case q.Secret != "" && !q.Secret.Match(e.Secret):
+		return false
+	case q.Action != "" && e.Action != q.Action:
+		return false
+	case q.Authorized != nil && e.Authorized != *q.Authorized:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// Search reads the entries of r and calls keep for each entry that satisfies
+// q, in the order they appear. If keep reports false, the entry is not
+// counted against q.Limit. Search returns the selected entries.
+//
+// A final line not terminated by a newline is ignored, since it may be an
+// entry that is still being written. Lines that are not valid entries, and
+// a truncated compressed stream, are skipped with a warning in the log.
+func Search(r io.Reader, q Query, keep func(*Entry) bool) ([]*Entry, error) {
+	var out []*Entry
+	skipped, err := search(r, &q, keep, &out)
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		log.Printf("audit: search skipped %d malformed lines", skipped)
+	}
+	return out, nil
+}
+
+// search appends the entries of r selected by q and keep to *out, and
+// reports the number of malformed lines skipped.
+func search(r io.Reader, q *Query, keep func(*Entry) bool, out *[]*Entry) (skipped int, _ error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return skipped, nil // discard an incomplete final line
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			return skipped + 1, nil // a truncated compressed segment
+		} else if err != nil {
+			return skipped, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			skipped++
+			continue
+		}
+		if !q.Match(&e) || (keep != nil && !keep(&e)) {
+			continue
+		}
+		*out = append(*out, &e)
+		if q.Limit > 0 && len(*out) > q.Limit {
+			*out = slices.Delete(*out, 0, 1)
+		}
+	}
+}
+
+// Search reports the entries of the audit log written by l that satisfy q,
+// and for which keep (if non-nil) reports true, in chronological order.
+// Closed segments of a rotated log are included. It reports ErrNotSearchable
+// if l does not write to a file.
+//
+// Malformed lines are skipped rather than failing the search. Each file with
+// skipped lines is reported in the log, and the lines are counted by the
+// counter returned by SkippedLines.
+func (l *Writer) Search(q Query, keep func(*Entry) bool) ([]*Entry, error) {
+	rf, ok := l.w.(*rotatingFile)
+	if !ok {
+		return nil, ErrNotSearchable
+	}
+
+	// Hold the lock only long enough to find the segments and open the current
+	// file, so that a concurrent rotation does not cause entries to be missed
+	// or read twice.
+	l.mu.Lock()
+	segs, err := Segments(rf.path)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	cur, err := os.Open(rf.path)
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	var out []*Entry
+	for _, seg := range segs {
+		// A segment is named for the time it was closed, so it cannot contain
+		// entries later than that.
+		if !q.Since.IsZero() {
+			ts := strings.TrimSuffix(strings.TrimPrefix(seg, rf.path+"."), ".gz")
+			if end, err := time.Parse(segmentTimeFormat, ts); err == nil && end.Before(q.Since) {
+				continue
+			}
+		}
+		rc, err := OpenSegment(seg)
+		if errors.Is(err, fs.ErrNotExist) && !strings.HasSuffix(seg, ".gz") {
+			rc, err = OpenSegment(seg + ".gz") // compressed since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		skipped, err := search(rc, &q, keep, &out)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		l.reportSkipped(seg, skipped)
+	}
+	skipped, err := search(cur, &q, keep, &out)
+	if err != nil {
+		return nil, err
+	}
+	l.reportSkipped(rf.path, skipped)
+	return out, nil
+}
+
+// SkippedLines returns a counter of the malformed lines skipped by searches
+// of the audit log written by l.
+func (l *Writer) SkippedLines() *expvar.Int { return &l.countSkipped }
+
+// reportSkipped records that a search skipped n malformed lines of the file
+// at path.
+func (l *Writer) reportSkipped(path string, n int) {
+	if n > 0 {
+		log.Printf("audit: search skipped %d malformed lines in %s", n, path)
+		l.countSkipped.Add(int64(n))
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions control the rotation of an audit log file. The zero value
+// disables rotation.
+//
+// When an audit log is rotated, the current file is renamed with a suffix
+// giving the time of rotation, and a new file is started in its place. The
+// closed segment is then compressed with gzip in the background. Entries are
+// never split across segments, and the hash chain continues from one segment
+// to the next (see Verify).
+type RotateOptions struct {
+	// MaxSize, if positive, is the size in bytes beyond which the log is
+	// rotated. A segment may exceed MaxSize by one entry and a checkpoint.
+	MaxSize int64
+
+	// MaxAge, if positive, is the length of time after which the log is
+	// rotated, measured from when it was opened or last rotated.
+	MaxAge time.Duration
+
+	// Retention, if positive, is how long closed segments are kept. Older
+	// segments are deleted when the log is rotated.
+	Retention time.Duration
+
+	// OnError, if non-nil, is called with each error that occurs while
+	// rotating the log, such as a failure to compress or remove a closed
+	// segment, when it occurs. These errors do not cause writes to fail. If
+	// nil, they are written to the standard logger.
+	OnError func(error)
+}
+
+// segmentTimeFormat is the format of the timestamp suffix on closed segments.
+// It sorts lexically in chronological order.
+const segmentTimeFormat = "20060102T150405.000000000Z"
+
+// NewRotatingFile returns a Writer that outputs audit log entries to a file
+// at path, creating it if necessary, and rotates the file according to opts.
+// If the file or its most recent closed segment already contains entries,
+// new entries continue the hash chain from the last of them.
+//
+// If checkpoints are enabled, each segment ends with a signed checkpoint.
+func NewRotatingFile(path string, opts RotateOptions) (*Writer, error) {
+	rf := &rotatingFile{path: path, opts: opts}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	seq, prev, err := lastEntry(rf.f)
+	if err == nil && seq == 0 && prev == "" {
+		seq, prev, err = lastSegmentEntry(path)
+	}
+	if err != nil {
+		rf.f.Close()
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	return &Writer{w: rf, seq: seq, prev: prev}, nil
+}
+
+// Segments returns the paths of the closed segments of the audit log at
+// path, in chronological order.
+func Segments(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segs []string
+	for _, m := range matches {
+		ts := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if _, err := time.Parse(segmentTimeFormat, ts); err != nil {
+			continue
+		} else if !strings.HasSuffix(m, ".gz") && slices.Contains(matches, m+".gz") {
+			continue // compressed, but the original is not yet removed
+		}
+		segs = append(segs, m)
+	}
+	slices.SortFunc(segs, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz"))
+	})
+	return segs, nil
+}
+
+// OpenSegment opens the audit log file or closed segment at path for
+// reading, decompressing it if it is compressed.
+func OpenSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// lastSegmentEntry reports the sequence number and hash of the last entry in
+// the most recent closed segment of the audit log at path, if any.
+func lastSegmentEntry(path string) (uint64, string, error) {
+	segs, err := Segments(path)
+	if err != nil || len(segs) == 0 {
+		return 0, "", err
+	}
+	rc, err := OpenSegment(segs[len(segs)-1])
+	if err != nil {
+		return 0, "", err
+	}
+	defer rc.Close()
+	return lastEntry(rc)
+}
+
+// rotatingFile is an audit log file that can be rotated between entries.
+// It is not safe for concurrent use; the Writer serializes access to it.
+type rotatingFile struct {
+	path   string
+	opts   RotateOptions
+	f      *os.File
+	size   int64     // current size of f
+	opened time.Time // when f was opened
+
+	wg sync.WaitGroup // background compression
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// due reports whether the file should be rotated before writing another
+// entry.
+func (r *rotatingFile) due() bool {
+	if r.size == 0 {
+		return false // never rotate an empty file
+	}
+	if r.opts.MaxSize > 0 && r.size >= r.opts.MaxSize {
+		return true
+	}
+	return r.opts.MaxAge > 0 && time.Since(r.opened) >= r.opts.MaxAge
+}
+
+// rotate closes the current file, renames it to a closed segment, and opens
+// a new empty file in its place. The closed segment is compressed, and
+// segments older than the retention period removed, in the background.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	seg := r.path + "." + time.Now().UTC().Format(segmentTimeFormat)
+	if err := os.Rename(r.path, seg); err != nil {
+		// Keep writing to the existing file rather than losing entries.
+		r.reportError(err)
+		return r.open()
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := compressSegment(seg); err != nil {
+			r.reportError(err)
+		}
+		if err := r.expire(); err != nil {
+			r.reportError(err)
+		}
+	}()
+	return nil
+}
+
+// reportError reports an error that occurred while rotating the log.
+func (r *rotatingFile) reportError(err error) {
+	if r.opts.OnError != nil {
+		r.opts.OnError(err)
+	} else {
+		log.Printf("audit: rotating %s: %v", r.path, err)
+	}
+}
+
+// compressSegment replaces the file at path with a gzip-compressed copy at
+// path + ".gz". If compression fails, the uncompressed file is retained.
+func compressSegment(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	err = errors.Join(err, zw.Close(), out.Sync(), out.Close())
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compressing %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// expire removes closed segments older than the retention period.
+func (r *rotatingFile) expire() error {
+	if r.opts.Retention <= 0 {
+		return nil
+	}
+	segs, err := Segments(r.path)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-r.opts.Retention)
+	var errs []error
+	for _, seg := range segs {
+		ts := strings.TrimSuffix(strings.TrimPrefix(seg, r.path+"."), ".gz")
+		t, _ := time.Parse(segmentTimeFormat, ts) // validated by Segments
+		if t.Before(cutoff) {
+			if err := os.Remove(seg); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *rotatingFile) Write(data []byte) (int, error) {
+	n, err := r.f.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Sync() error { return r.f.Sync() }
+
+// Close closes the current file, and waits for any background compression
+// to finish. Errors from compression are reported as they occur, not by
+// Close.
+func (r *rotatingFile) Close() error {
+	err := r.f.Close()
+	r.wg.Wait()
+	return err
+}
@@ -0,0 +1,284 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A Sink is a destination for audit log entries in addition to the log
+// written by a Writer. A Writer delivers each entry to its sinks after the
+// entry has been written to its log, so a failing sink cannot cause an entry
+// to be lost from the log.
+type Sink interface {
+	// Send delivers e, whose encoded form is data (a JSON object without a
+	// trailing newline). Send is called for each entry in log order,
+	// including checkpoints. It must not retain data after it returns, and
+	// should not block for long: A sink that delivers entries remotely should
+	// buffer them for delivery in the background.
+	Send(e *Entry, data []byte) error
+
+	// Close delivers any buffered entries and releases the resources of the
+	// sink.
+	Close() error
+}
+
+// Fanout returns a Sink that sends each entry to all the given sinks. Its
+// Send and Close methods report the errors of all the sinks that fail.
+func Fanout(sinks ...Sink) Sink { return fanout(sinks) }
+
+type fanout []Sink
+
+func (f fanout) Send(e *Entry, data []byte) error {
+	var errs []error
+	for _, s := range f {
+		if err := s.Send(e, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) Close() error {
+	var errs []error
+	for _, s := range f {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddSink adds s to the sinks to which l delivers entries. Errors reported by
+// s.Send do not cause WriteEntries to fail, since the entry has already been
+// written to the log; they are passed to the handler set by OnSinkError.
+// When l is closed, it closes s.
+func (l *Writer) AddSink(s Sink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, s)
+}
+
+// OnSinkError sets the function to which l reports errors from its sinks.
+// By default, errors are written to the standard logger.
+func (l *Writer) OnSinkError(fn func(error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinkErr = fn
+}
+
+// sendLocked delivers e to the sinks of l.
+func (l *Writer) sendLocked(e *Entry, data []byte) {
+	if len(l.sinks) == 0 {
+		return
+	}
+	if err := l.sinks.Send(e, data); err != nil {
+		reportSinkError(l.sinkErr, err)
+	}
+}
+
+func reportSinkError(fn func(error), err error) {
+	if fn == nil {
+		log.Printf("audit: %v", err)
+	} else {
+		fn(err)
+	}
+}
+
+// ErrBufferFull is reported by the Send method of a buffered sink when its
+// buffer is full, and the entry was not accepted for delivery.
+var ErrBufferFull = errors.New("audit sink buffer is full")
+
+// BufferOptions control the buffering and retry of a sink that delivers
+// entries in the background. A zero value is ready for use with defaults as
+// described.
+type BufferOptions struct {
+	// Size is the maximum number of entries buffered for delivery. When the
+	// buffer is full, Send reports ErrBufferFull. If zero, 1000 is used.
+	Size int
+
+	// MaxRetries is the maximum number of times delivery of an entry is
+	// retried before the entry is discarded and the failure reported. If
+	// zero, 5 is used; if negative, delivery is not retried.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry of a delivery, which
+	// doubles after each failed attempt. If zero, 1s is used.
+	RetryDelay time.Duration
+
+	// CloseTimeout is the maximum time Close waits for buffered entries to
+	// be delivered. When it expires, delivery in progress is abandoned, and
+	// the remaining entries are discarded and reported to OnError. If zero,
+	// 10s is used.
+	CloseTimeout time.Duration
+
+	// OnError, if non-nil, is called with errors that occur during delivery
+	// in the background. By default, they are written to the standard logger.
+	OnError func(error)
+}
+
+func (o BufferOptions) size() int {
+	if o.Size <= 0 {
+		return 1000
+	}
+	return o.Size
+}
+
+func (o BufferOptions) maxRetries() int {
+	if o.MaxRetries == 0 {
+		return 5
+	}
+	return max(o.MaxRetries, 0)
+}
+
+func (o BufferOptions) retryDelay() time.Duration {
+	if o.RetryDelay <= 0 {
+		return time.Second
+	}
+	return o.RetryDelay
+}
+
+func (o BufferOptions) closeTimeout() time.Duration {
+	if o.CloseTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return o.CloseTimeout
+}
+
+// A queue buffers encoded messages for delivery in the background, in
+// batches of up to a given size, retrying failed deliveries.
+type queue struct {
+	opts    BufferOptions
+	batch   int
+	deliver func(context.Context, [][]byte) error
+
+	// ctx is canceled when close gives up waiting for delivery, to abort
+	// delivery and retries in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex // protects ch and closed
+	ch     chan []byte
+	closed bool
+	done   chan struct{} // closed when the delivery goroutine exits
+}
+
+func newQueue(opts BufferOptions, batch int, deliver func(context.Context, [][]byte) error) *queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &queue{
+		ctx:     ctx,
+		cancel:  cancel,
+		opts:    opts,
+		batch:   batch,
+		deliver: deliver,
+		ch:      make(chan []byte, opts.size()),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// errSinkClosed is reported by the Send method of a sink that is closed.
+var errSinkClosed = errors.New("audit sink is closed")
+
+// add enqueues a copy of msg for delivery, or reports ErrBufferFull.
+func (q *queue) add(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errSinkClosed
+	}
+	select {
+	case q.ch <- append([]byte(nil), msg...):
+		return nil
+	default:
+		return ErrBufferFull
+	}
+}
+
+// close stops accepting messages, and waits for buffered messages to be
+// delivered or discarded. If they are not delivered within the close
+// timeout, delivery is aborted and the remaining messages are discarded.
+func (q *queue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+
+	t := time.NewTimer(q.opts.closeTimeout())
+	defer t.Stop()
+	select {
+	case <-q.done:
+	case <-t.C:
+		q.cancel()
+		<-q.done
+	}
+}
+
+func (q *queue) run() {
+	defer close(q.done)
+	defer q.cancel()
+
+	var dropped int // messages discarded because delivery was aborted
+	for msg := range q.ch {
+		if q.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		batch := [][]byte{msg}
+	fill:
+		for len(batch) < q.batch {
+			select {
+			case m, ok := <-q.ch:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			default:
+				break fill
+			}
+		}
+		if !q.send(batch) {
+			dropped += len(batch)
+		}
+	}
+	if dropped > 0 {
+		reportSinkError(q.opts.OnError, fmt.Errorf("discarding %d entries undelivered at close: %w", dropped, q.ctx.Err()))
+	}
+}
+
+// send delivers batch, retrying with exponential backoff, and reports an
+// error if delivery fails after all retries. It reports false without
+// reporting an error if delivery is aborted by close.
+func (q *queue) send(batch [][]byte) bool {
+	delay := q.opts.retryDelay()
+	for i := 0; ; i++ {
+		err := q.deliver(q.ctx, batch)
+		if err == nil {
+			return true
+		}
+		if q.ctx.Err() != nil {
+			return false
+		}
+		if i >= q.opts.maxRetries() {
+			reportSinkError(q.opts.OnError, fmt.Errorf("discarding %d undeliverable entries: %w", len(batch), err))
+			return true
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-q.ctx.Done():
+			t.Stop()
+			return false
+		}
+		delay *= 2
+	}
+}
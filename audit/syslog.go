@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// syslogSockets are the usual paths of the local syslog socket.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Syslog facility and severity codes (RFC 5424 section 6.2.1).
+const (
+	facilityAuthPriv = 10
+
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// SyslogOptions are options for a syslog sink. A zero value is ready for use
+// with defaults as described.
+type SyslogOptions struct {
+	// Addr is the path of the local syslog socket. If empty, the usual
+	// locations are tried in turn.
+	Addr string
+
+	// AppName is the application name reported in each message. If empty,
+	// "setec" is used.
+	AppName string
+
+	// Buffer controls buffering and retry of messages.
+	Buffer BufferOptions
+}
+
+// NewSyslogSink returns a Sink that delivers entries to the local syslog
+// daemon as RFC 5424 messages, in the authpriv facility, whose content is
+// the JSON encoding of the entry. Authorized entries are logged with severity
+// "info", denied entries with "notice", and high-severity entries (such as
+// break-glass accesses) with "warning".
+func NewSyslogSink(opts SyslogOptions) (Sink, error) {
+	s := &syslogSink{
+		addr:    opts.Addr,
+		appName: opts.AppName,
+		pid:     os.Getpid(),
+	}
+	if s.appName == "" {
+		s.appName = "setec"
+	}
+	if s.hostname, _ = os.Hostname(); s.hostname == "" {
+		s.hostname = "-"
+	}
+	if err := s.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	s.q = newQueue(opts.Buffer, 1, s.deliver)
+	return s, nil
+}
+
+type syslogSink struct {
+	addr     string
+	appName  string
+	hostname string
+	pid      int
+	q        *queue
+
+	// Accessed only by the delivery goroutine, after construction.
+	conn   net.Conn
+	stream bool // conn is a stream socket, which requires framing
+}
+
+// connect dials the syslog socket, preferring a datagram connection.
+func (s *syslogSink) connect(ctx context.Context) error {
+	addrs := syslogSockets
+	if s.addr != "" {
+		addrs = []string{s.addr}
+	}
+	var d net.Dialer
+	var errs []error
+	for _, addr := range addrs {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := d.DialContext(ctx, network, addr)
+			if err == nil {
+				s.conn, s.stream = conn, network == "unix"
+				return nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	return fmt.Errorf("connecting to syslog: %w", errors.Join(errs...))
+}
+
+func (s *syslogSink) Send(e *Entry, data []byte) error {
+	sev := severityInfo
+	if e.Severity == SeverityHigh {
+		sev = severityWarning
+	} else if !e.Authorized && e.Checkpoint == nil {
+		sev = severityNotice
+	}
+	msgID := "audit"
+	if e.Checkpoint != nil {
+		msgID = "checkpoint"
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	msg := fmt.Appendf(nil, "<%d>1 %s %s %s %d %s - ",
+		facilityAuthPriv*8+sev,
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, s.pid, msgID)
+	return s.q.add(append(msg, data...))
+}
+
+func (s *syslogSink) deliver(ctx context.Context, msgs [][]byte) error {
+	for _, msg := range msgs {
+		if s.conn == nil {
+			if err := s.connect(ctx); err != nil {
+				return err
+			}
+		}
+		if s.stream {
+			msg = append(msg, '\n')
+		}
+		// Unblock the write if delivery is aborted.
+		conn := s.conn
+		stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+		_, err := conn.Write(msg)
+		stop()
+		if err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("writing to syslog: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.q.close()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookOptions are options for a webhook sink. A zero value is ready for
+// use with defaults as described.
+type WebhookOptions struct {
+	// Header, if non-nil, holds headers added to each request, for example
+	// to authorize the request.
+	Header http.Header
+
+	// Client is the HTTP client used to make requests. If nil, a client with
+	// a 30-second timeout is used.
+	Client *http.Client
+
+	// BatchSize is the maximum number of entries sent in each request. If
+	// zero, 100 is used.
+	BatchSize int
+
+	// Buffer controls buffering and retry of entries.
+	Buffer BufferOptions
+}
+
+// NewWebhookSink returns a Sink that delivers entries to url by HTTP POST
+// requests, whose body is a JSON array of one or more entries. A request is
+// considered delivered if the server responds with a 2xx status, and is
+// retried otherwise.
+func NewWebhookSink(url string, opts WebhookOptions) Sink {
+	s := &webhookSink{url: url, header: opts.Header, client: opts.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 30 * time.Second}
+	}
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	s.q = newQueue(opts.Buffer, batch, s.deliver)
+	return s
+}
+
+type webhookSink struct {
+	url    string
+	header http.Header
+	client *http.Client
+	q      *queue
+}
+
+func (s *webhookSink) Send(e *Entry, data []byte) error { return s.q.add(data) }
+
+func (s *webhookSink) deliver(ctx context.Context, msgs [][]byte) error {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	body.Write(bytes.Join(msgs, []byte(",")))
+	body.WriteByte(']')
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, &body)
+	if err != nil {
+		return err
+	}
+	for k, vs := range s.header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending to webhook: %w", err)
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("sending to webhook: %s", rsp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.q.close()
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tailscale/setec/types/api"
+	"github.com/tailscale/setec/types/apiv2"
+)
+
+// Versions reports the versions of the API and the optional capabilities
+// supported by the server.
+func (c Client) Versions(ctx context.Context) (*api.VersionsResponse, error) {
+	return do[*api.VersionsResponse](ctx, c, "/api/versions", api.VersionsRequest{})
+}
+
+// Negotiate returns a copy of c whose APIVersion is the highest version of
+// the API supported by both the client and the server. Servers that do not
+// report their versions support only version 1.
+func (c Client) Negotiate(ctx context.Context) (Client, error) {
+	rsp, err := c.Versions(ctx)
+	if isUnsupported(err) {
+		c.APIVersion = 1
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+	c.APIVersion = 1
+	for _, sv := range rsp.Versions {
+		if sv <= apiv2.Version && sv > c.APIVersion {
+			c.APIVersion = sv
+		}
+	}
+	return c, nil
+}
+
+// useV2 reports whether c should call version 2 of the API. A call to
+// version 2 that reports an error for which isUnsupported is true should be
+// retried with version 1, since the server may no longer support version 2.
+func (c Client) useV2() bool { return c.APIVersion >= apiv2.Version }
+
+func secretInfoFromV2(info *apiv2.SecretInfo) *api.SecretInfo {
+	return &api.SecretInfo{Name: info.Name, Versions: info.Versions, ActiveVersion: info.ActiveVersion}
+}
+
+func (c Client) listV2(ctx context.Context, req api.ListRequest) ([]*api.SecretInfo, error) {
+	var all []*api.SecretInfo
+	v2req := apiv2.ListRequest{Prefix: req.Prefix, Glob: req.Glob, PageSize: req.Limit}
+	for {
+		rsp, err := do[*apiv2.ListResponse](ctx, c, apiv2.PathPrefix+"list", v2req)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range rsp.Secrets {
+			all = append(all, secretInfoFromV2(info))
+		}
+		if rsp.NextPageToken == "" {
+			return all, nil
+		}
+		v2req.PageToken = rsp.NextPageToken
+	}
+}
+
+func (c Client) getV2(ctx context.Context, req api.GetRequest) (*api.SecretValue, error) {
+	rsp, err := do[*apiv2.GetResponse](ctx, c, apiv2.PathPrefix+"get", apiv2.GetRequest{
+		Name:      req.Name,
+		Version:   req.Version,
+		IfChanged: req.UpdateIfChanged,
+	})
+	if err != nil {
+		return nil, err
+	} else if rsp.NotChanged {
+		return nil, api.ErrValueNotChanged
+	} else if rsp.Value == nil {
+		return nil, errors.New("no value reported")
+	}
+	return &api.SecretValue{Value: rsp.Value.Value, Version: rsp.Value.Version}, nil
+}
+
+func (c Client) infoV2(ctx context.Context, name string) (*api.SecretInfo, error) {
+	rsp, err := do[*apiv2.InfoResponse](ctx, c, apiv2.PathPrefix+"info", apiv2.InfoRequest{Name: name})
+	if err != nil {
+		return nil, err
+	} else if rsp.Secret == nil {
+		return nil, errors.New("no secret reported")
+	}
+	return secretInfoFromV2(rsp.Secret), nil
+}
+
+func (c Client) putV2(ctx context.Context, name string, value []byte) (api.SecretVersion, error) {
+	rsp, err := do[*apiv2.PutResponse](ctx, c, apiv2.PathPrefix+"put", apiv2.PutRequest{Name: name, Value: value})
+	if err != nil {
+		return 0, err
+	}
+	return rsp.Version, nil
+}
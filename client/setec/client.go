@@ -33,7 +33,8 @@
 //
 // The Store periodically polls for new secret values in the background, so the
 // caller does not need to worry about whether the server is available at the
-// time when it needs a secret.
+// time when it needs a secret. With the Watch option, the Store also waits for
+// changes using long polls, so that new values are seen promptly.
 //
 // Where possible, it is best to declare all desired secrets in the config, and
 // by default only declared secrets can be accessed.  If a caller does not know
@@ -92,17 +93,28 @@ package setec
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/types/api"
+	"github.com/tailscale/setec/types/apiv2"
 )
 
-// Assert that Client implements [VersioningStoreClient].
-var _ VersioningStoreClient = &Client{}
+// Assert that Client implements the optional store client interfaces.
+var (
+	_ VersioningStoreClient = &Client{}
+	_ WatchingStoreClient   = &Client{}
+	_ BatchStoreClient      = &Client{}
+)
 
 // Client is a raw client to the secret management server.
 // If you're just consuming secrets, you probably want to use a Store
@@ -113,6 +125,43 @@ type Client struct {
 	// DoHTTP is the function to use to make HTTP requests. If nil,
 	// http.DefaultClient.Do is used.
 	DoHTTP func(*http.Request) (*http.Response, error)
+	// Justification, if non-empty, is sent with each request as the
+	// caller's reason for it. The server records it in the audit log, and
+	// requires it for access granted by break-glass rules.
+	Justification string
+	// Token, if non-empty, is sent with each request as a bearer token, to
+	// identify callers that are not on the server's tailnet. The server must
+	// be configured to accept it.
+	Token string
+	// MaxRetries is the number of times to retry a request that the server
+	// rejects because the caller exceeded its rate limit. If zero, 3 is
+	// used; if negative, requests are not retried.
+	MaxRetries int
+	// APIVersion is the version of the API to use. If zero, version 1 is
+	// used, which all servers support. Use Negotiate to choose the highest
+	// version supported by both the client and the server. If the server
+	// reports that it does not implement a method in the chosen version, the
+	// client calls version 1 of the method instead.
+	APIVersion int
+}
+
+// maxRetryWait is the longest the client waits before retrying a request.
+const maxRetryWait = time.Minute
+
+func (c Client) maxRetries() int {
+	if c.MaxRetries == 0 {
+		return 3
+	}
+	return max(c.MaxRetries, 0)
+}
+
+// retryWait returns how long to wait before the given retry attempt (from 0)
+// of a request, whose rejection gave the specified Retry-After header.
+func retryWait(retryAfter string, attempt int) time.Duration {
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+		return min(time.Duration(secs)*time.Second, maxRetryWait)
+	}
+	return min(time.Second<<attempt, maxRetryWait)
 }
 
 func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RESP, error) {
@@ -125,21 +174,41 @@ func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RES
 
 	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(c.Server, "/"), strings.TrimPrefix(path, "/"))
 
-	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
-	if err != nil {
-		return resp, fmt.Errorf("constructing HTTP request: %w", err)
-	}
-	r.Header.Set("Content-Type", "application/json")
-	// See the comment in server/server.go for what this does.
-	r.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
-
 	do := c.DoHTTP
 	if do == nil {
 		do = http.DefaultClient.Do
 	}
-	httpResp, err := do(r)
-	if err != nil {
-		return resp, fmt.Errorf("making HTTP request: %w", err)
+	var httpResp *http.Response
+	for attempt := 0; ; attempt++ {
+		r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
+		if err != nil {
+			return resp, fmt.Errorf("constructing HTTP request: %w", err)
+		}
+		r.Header.Set("Content-Type", "application/json")
+		// See the comment in server/server.go for what this does.
+		r.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
+		if c.Justification != "" {
+			r.Header.Set(api.JustificationHeader, c.Justification)
+		}
+		if c.Token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		httpResp, err = do(r)
+		if err != nil {
+			return resp, fmt.Errorf("making HTTP request: %w", err)
+		}
+		if httpResp.StatusCode != http.StatusTooManyRequests || attempt >= c.maxRetries() {
+			break
+		}
+
+		// The server rejected the request because of its rate limit. Wait as
+		// it directs, or if it does not, with exponential backoff.
+		httpResp.Body.Close()
+		sleepFor(ctx, retryWait(httpResp.Header.Get("Retry-After"), attempt))
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
 	}
 	defer httpResp.Body.Close()
 
@@ -149,16 +218,16 @@ func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RES
 			return resp, fmt.Errorf("reading error response body (HTTP status %d): %w", code, err)
 		}
 		switch code {
-		case http.StatusNotFound:
-			return resp, api.ErrNotFound
-		case http.StatusForbidden:
-			return resp, api.ErrAccessDenied
+		case http.StatusAccepted:
+			var req api.PendingRequest
+			if err := json.Unmarshal(errBs, &req); err != nil {
+				return resp, fmt.Errorf("unmarshaling pending request: %w", err)
+			}
+			return resp, &api.ApprovalRequiredError{Request: &req}
 		case http.StatusNotModified:
 			return resp, api.ErrValueNotChanged
-		case http.StatusPreconditionFailed:
-			return resp, api.ErrVersionClaimed
 		}
-		return resp, fmt.Errorf("request returned status %d: %q", code, string(bytes.TrimSpace(errBs)))
+		return resp, responseError(code, errBs)
 	}
 
 	bs, err = io.ReadAll(httpResp.Body)
@@ -178,14 +247,153 @@ func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RES
 // secret values themselves. If the caller does not have "info" access to any
 // secrets, List reports zero values without error.
 func (c Client) List(ctx context.Context) ([]*api.SecretInfo, error) {
+	if c.useV2() {
+		if infos, err := c.listV2(ctx, api.ListRequest{}); !isUnsupported(err) {
+			return infos, err
+		}
+	}
 	return do[[]*api.SecretInfo](ctx, c, "/api/list", api.ListRequest{})
 }
 
+// ListMatching is as List, but reports only the secrets selected by req.
+// If req.Limit is positive, ListMatching fetches the secrets in pages of at
+// most that many, starting after req.After, until all have been fetched.
+func (c Client) ListMatching(ctx context.Context, req api.ListRequest) ([]*api.SecretInfo, error) {
+	if req.After == "" && c.useV2() {
+		if infos, err := c.listV2(ctx, req); !isUnsupported(err) {
+			return infos, err
+		}
+	}
+	var all []*api.SecretInfo
+	for {
+		page, err := do[[]*api.SecretInfo](ctx, c, "/api/list", req)
+		if err != nil {
+			return nil, err
+		}
+
+		// A server that does not support selection reports all the secrets
+		// visible to the caller, every time.
+		if len(page) != 0 && req.After != "" && page[0].Name <= req.After {
+			return all, nil
+		}
+		for _, info := range page {
+			if strings.HasPrefix(info.Name, req.Prefix) && (req.Glob == "" || acl.Secret(req.Glob).Match(info.Name)) {
+				all = append(all, info)
+			}
+		}
+
+		// A page shorter than the limit is the last.
+		if req.Limit <= 0 || len(page) != req.Limit {
+			return all, nil
+		}
+		req.After = page[len(page)-1].Name
+	}
+}
+
+// responseError returns the error reported by a response with the given HTTP
+// status and body. Servers that predate structured errors report only a
+// plain-text message, whose code is inferred from the status; the error is
+// then a *plainError wrapping the *api.Error.
+func responseError(status int, body []byte) error {
+	e := &api.Error{Status: status}
+	if json.Unmarshal(body, e) == nil && e.Code != "" {
+		return e
+	}
+	pe := &plainError{err: e}
+	e.Message = string(bytes.TrimSpace(body))
+	switch status {
+	case http.StatusBadRequest:
+		e.Code = api.CodeBadRequest
+	case http.StatusForbidden:
+		e.Code = api.CodeAccessDenied
+	case http.StatusNotFound:
+		e.Code = api.CodeNotFound
+	case http.StatusPreconditionFailed:
+		e.Code = api.CodeVersionClaimed
+	case http.StatusTooManyRequests:
+		e.Code = api.CodeRateLimited
+	default:
+		e.Code = api.CodeInternal
+	}
+	return pe
+}
+
+// A plainError is an error reported by a response whose body is not a
+// structured error, as from a server that predates them or a method it does
+// not route to the API.
+type plainError struct{ err *api.Error }
+
+func (e *plainError) Error() string { return e.err.Error() }
+func (e *plainError) Unwrap() error { return e.err }
+
+// isUnsupported reports whether err indicates that the server does not
+// implement the API method called. Servers report such methods as
+// unknown-method or, if they predate that code, with a plain-text 404 Not
+// Found or, if they route the method to the dashboard, a plain-text 400 Bad
+// Request. Structured errors, such as a secret that is not found or a request
+// the method rejects, are not reported as unsupported.
+func isUnsupported(err error) bool {
+	var ae *api.Error
+	if !errors.As(err, &ae) {
+		return false
+	}
+	if ae.Code == api.CodeUnknownMethod {
+		return true
+	}
+	var pe *plainError
+	return errors.As(err, &pe) && (ae.Status == http.StatusNotFound || ae.Status == http.StatusBadRequest)
+}
+
+// GetResult is the result of fetching one secret with [Client.GetMany].
+type GetResult struct {
+	// Name is the name of the secret.
+	Name string
+	// Value is the value fetched, if Err is nil.
+	Value *api.SecretValue
+	// Err is the error fetching the secret, if any. It is
+	// api.ErrValueNotChanged if a known version was given and is still
+	// active.
+	Err error
+}
+
+// GetMany fetches the active values of several secrets in a single request.
+// For each item with a non-zero version, the value is fetched only if the
+// active version differs, as for GetIfChanged. The results are reported in
+// the order of items; errors fetching individual secrets are reported in the
+// results, and do not cause GetMany to fail.
+//
+// Access requirement: "get", for each secret
+func (c Client) GetMany(ctx context.Context, items []api.GetManyItem) ([]GetResult, error) {
+	rsp, err := do[*api.GetManyResponse](ctx, c, "/api/get-many", api.GetManyRequest{Secrets: items})
+	if err != nil {
+		return nil, err
+	} else if len(rsp.Results) != len(items) {
+		return nil, fmt.Errorf("got %d results for %d secrets", len(rsp.Results), len(items))
+	}
+	out := make([]GetResult, len(items))
+	for i, r := range rsp.Results {
+		out[i] = GetResult{Name: r.Name, Value: r.Value}
+		switch {
+		case r.NotChanged:
+			out[i].Err = api.ErrValueNotChanged
+		case r.Error == api.ErrorNotFound:
+			out[i].Err = api.ErrNotFound
+		case r.Error == api.ErrorAccessDenied:
+			out[i].Err = api.ErrAccessDenied
+		case r.Error != "":
+			out[i].Err = fmt.Errorf("fetching %q: %s", r.Name, r.Error)
+		case r.Value == nil:
+			out[i].Err = fmt.Errorf("fetching %q: no value reported", r.Name)
+		}
+	}
+	return out, nil
+}
+
 // Get fetches the current active secret value for name.
 //
 // Access requirement: "get"
 func (c Client) Get(ctx context.Context, name string) (*api.SecretValue, error) {
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+	return c.get(ctx, api.GetRequest{
 		Name:    name,
 		Version: api.SecretVersionDefault,
 	})
@@ -202,7 +410,7 @@ func (c Client) GetIfChanged(ctx context.Context, name string, oldVersion api.Se
 	if oldVersion == api.SecretVersionDefault {
 		return c.Get(ctx, name)
 	}
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+	return c.get(ctx, api.GetRequest{
 		Name:            name,
 		Version:         oldVersion,
 		UpdateIfChanged: true,
@@ -214,16 +422,49 @@ func (c Client) GetIfChanged(ctx context.Context, name string, oldVersion api.Se
 //
 // Access requirement: "get"
 func (c Client) GetVersion(ctx context.Context, name string, version api.SecretVersion) (*api.SecretValue, error) {
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+	return c.get(ctx, api.GetRequest{
 		Name:    name,
 		Version: version,
 	})
 }
 
+func (c Client) get(ctx context.Context, req api.GetRequest) (*api.SecretValue, error) {
+	if c.useV2() {
+		if sv, err := c.getV2(ctx, req); !isUnsupported(err) {
+			return sv, err
+		}
+	}
+	return do[*api.SecretValue](ctx, c, "/api/get", req)
+}
+
+// Watch waits until the active version of any of the given secrets differs
+// from the version given for it, or the timeout elapses, and reports the
+// secrets that changed with their current active versions. A secret that no
+// longer exists is reported with version 0. If the timeout elapses without a
+// change, Watch reports no secrets and no error. If timeout is zero, the
+// server uses a default; the server may also impose a lower limit.
+//
+// Access requirement: "get", for each secret
+func (c Client) Watch(ctx context.Context, secrets []api.WatchSecret, timeout time.Duration) ([]api.WatchSecret, error) {
+	rsp, err := do[*api.WatchResponse](ctx, c, "/api/watch", api.WatchRequest{
+		Secrets:        secrets,
+		TimeoutSeconds: int(timeout / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Changed, nil
+}
+
 // Info fetches metadata for a given secret name.
 //
 // Access requirement: "info"
 func (c Client) Info(ctx context.Context, name string) (*api.SecretInfo, error) {
+	if c.useV2() {
+		if info, err := c.infoV2(ctx, name); !isUnsupported(err) {
+			return info, err
+		}
+	}
 	return do[*api.SecretInfo](ctx, c, "/api/info", api.InfoRequest{
 		Name: name,
 	})
@@ -234,17 +475,43 @@ func (c Client) Info(ctx context.Context, name string) (*api.SecretInfo, error)
 //
 // Access requirement: "put"
 func (c Client) Put(ctx context.Context, name string, value []byte) (version api.SecretVersion, err error) {
+	if c.useV2() {
+		if v, err := c.putV2(ctx, name, value); !isUnsupported(err) {
+			return v, err
+		}
+	}
 	return do[api.SecretVersion](ctx, c, "/api/put", api.PutRequest{
 		Name:  name,
 		Value: value,
 	})
 }
 
+// Generate is like Put, but the server generates the value as described by
+// spec, so that it is never handled by the client. Use Get to fetch the value.
+//
+// Access requirement: "put"
+func (c Client) Generate(ctx context.Context, name string, spec api.GenerateSpec) (api.SecretVersion, error) {
+	return do[api.SecretVersion](ctx, c, "/api/generate", api.GenerateRequest{
+		Name: name,
+		Spec: spec,
+	})
+}
+
 // CreateVersion creates a specific version of a secret, sets its value and immediately activates that version.
 // It fails if this version of the secret ever had a value.
 //
 // Access requirement: "create-version"
 func (c Client) CreateVersion(ctx context.Context, name string, version api.SecretVersion, value []byte) error {
+	if c.useV2() {
+		_, err := do[*apiv2.CreateVersionResponse](ctx, c, apiv2.PathPrefix+"create-version", apiv2.CreateVersionRequest{
+			Name:    name,
+			Version: version,
+			Value:   value,
+		})
+		if !isUnsupported(err) {
+			return err
+		}
+	}
 	_, err := do[struct{}](ctx, c, "/api/create-version", api.CreateVersionRequest{
 		Name:    name,
 		Version: version,
@@ -255,8 +522,21 @@ func (c Client) CreateVersion(ctx context.Context, name string, version api.Secr
 
 // Activate changes the active version of the secret called name to version.
 //
+// If the server requires two-person approval for the operation, Activate
+// reports an error satisfying errors.Is(err, api.ErrApprovalRequired), whose
+// concrete type *api.ApprovalRequiredError describes the pending request.
+//
 // Access requirement: "activate"
 func (c Client) Activate(ctx context.Context, name string, version api.SecretVersion) error {
+	if c.useV2() {
+		_, err := do[*apiv2.ActivateResponse](ctx, c, apiv2.PathPrefix+"activate", apiv2.ActivateRequest{
+			Name:    name,
+			Version: version,
+		})
+		if !isUnsupported(err) {
+			return err
+		}
+	}
 	_, err := do[struct{}](ctx, c, "/api/activate", api.ActivateRequest{
 		Name:    name,
 		Version: version,
@@ -269,8 +549,22 @@ func (c Client) Activate(ctx context.Context, name string, version api.SecretVer
 // Note: DeleteVersion will report an error if the caller attempts to delete
 // the active version, even if they have permission to do so.
 //
+// If the server requires two-person approval for the operation, DeleteVersion
+// reports an *api.ApprovalRequiredError (see [Client.Activate]).
+//
 // Access requirement: "delete"
 func (c Client) DeleteVersion(ctx context.Context, name string, version api.SecretVersion) error {
+	if version == api.SecretVersionDefault {
+		return &api.Error{Status: http.StatusBadRequest, Code: api.CodeInvalidVersion, Message: "invalid version"}
+	} else if c.useV2() {
+		_, err := do[*apiv2.DeleteResponse](ctx, c, apiv2.PathPrefix+"delete", apiv2.DeleteRequest{
+			Name:    name,
+			Version: version,
+		})
+		if !isUnsupported(err) {
+			return err
+		}
+	}
 	_, err := do[struct{}](ctx, c, "/api/delete-version", api.DeleteVersionRequest{
 		Name:    name,
 		Version: version,
@@ -283,14 +577,113 @@ func (c Client) DeleteVersion(ctx context.Context, name string, version api.Secr
 // Note: Delete will delete all versions of the secret, including the active
 // one, if the caller has permission to do so.
 //
+// If the server requires two-person approval for the operation, Delete
+// reports an *api.ApprovalRequiredError (see [Client.Activate]).
+//
 // Access requirement: "delete"
 func (c Client) Delete(ctx context.Context, name string) error {
+	if c.useV2() {
+		_, err := do[*apiv2.DeleteResponse](ctx, c, apiv2.PathPrefix+"delete", apiv2.DeleteRequest{Name: name, All: true})
+		if !isUnsupported(err) {
+			return err
+		}
+	}
 	_, err := do[struct{}](ctx, c, "/api/delete", api.DeleteRequest{
 		Name: name,
 	})
 	return err
 }
 
+// ListPending lists pending requests for operations that require two-person
+// approval, for those secrets on which the caller has "approve" or "info"
+// access.
+func (c Client) ListPending(ctx context.Context) ([]*api.PendingRequest, error) {
+	return do[[]*api.PendingRequest](ctx, c, "/api/pending", api.ListPendingRequest{})
+}
+
+// Approve approves the pending request with the given ID, causing the
+// requested operation to take effect. The caller may not approve their own
+// requests.
+//
+// Access requirement: "approve"
+func (c Client) Approve(ctx context.Context, id string) error {
+	_, err := do[struct{}](ctx, c, "/api/approve", api.ApproveRequest{ID: id})
+	return err
+}
+
+// Reject discards the pending request with the given ID without performing
+// the requested operation.
+//
+// Access requirement: "approve", or the caller made the request
+func (c Client) Reject(ctx context.Context, id string) error {
+	_, err := do[struct{}](ctx, c, "/api/reject", api.RejectRequest{ID: id})
+	return err
+}
+
+// SearchAudit reports the audit log entries matching req, in chronological
+// order. Only entries for secrets on which the caller has "audit" permission
+// are reported.
+//
+// Access requirement: "audit"
+func (c Client) SearchAudit(ctx context.Context, req api.AuditRequest) ([]*audit.Entry, error) {
+	return do[[]*audit.Entry](ctx, c, "/api/audit", req)
+}
+
+// ExportAudit returns a signed export of the audit log entries matching req,
+// in chronological order. As with SearchAudit, only entries for secrets on
+// which the caller has "audit" permission are included. The recipient of the
+// export can check it with its Verify method.
+//
+// Access requirement: "audit"
+func (c Client) ExportAudit(ctx context.Context, req api.AuditRequest) (*audit.Export, error) {
+	return do[*audit.Export](ctx, c, "/api/audit/export", req)
+}
+
+// AuditExportKey returns the public key with which the server signs audit
+// log exports. Recipients of an export should check it against this key,
+// obtained directly from the server, rather than the key embedded in the
+// export. It does not require any particular access.
+func (c Client) AuditExportKey(ctx context.Context) (ed25519.PublicKey, error) {
+	rsp, err := do[*api.AuditExportKeyResponse](ctx, c, "/api/audit/export-key", api.AuditExportKeyRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid export key length %d", len(rsp.PublicKey))
+	}
+	return ed25519.PublicKey(rsp.PublicKey), nil
+}
+
+// Usage reports usage statistics of the secret called name, or if name is
+// empty, of all secrets for which the caller has "info" permission. Consumers
+// that read a secret within the given number of days are reported; if days
+// is zero, the server uses 30 days.
+//
+// Access requirement: "info"
+func (c Client) Usage(ctx context.Context, name string, days int) (*api.UsageResponse, error) {
+	return do[*api.UsageResponse](ctx, c, "/api/usage", api.UsageRequest{
+		Name: name,
+		Days: days,
+	})
+}
+
+// WhoAmI reports the identity and permissions the server derives for the
+// caller. It does not require any particular access.
+func (c Client) WhoAmI(ctx context.Context) (*api.WhoAmIResponse, error) {
+	return do[*api.WhoAmIResponse](ctx, c, "/api/whoami", api.WhoAmIRequest{})
+}
+
+// Check reports whether the caller is permitted to perform action on the
+// named secret, and explains which of the caller's rules is responsible for
+// the decision. The secret need not exist. It does not require any particular
+// access.
+func (c Client) Check(ctx context.Context, action acl.Action, name string) (*api.CheckResponse, error) {
+	return do[*api.CheckResponse](ctx, c, "/api/check", api.CheckRequest{
+		Action: action,
+		Name:   name,
+	})
+}
+
 // GetKeyring fetches all available versions of the named secret, and
 // returns a [Keyring] containing them.
 func (c Client) GetKeyring(ctx context.Context, name string) (*Keyring, error) {
@@ -5,6 +5,7 @@ package setec_test
 
 import (
 	"errors"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -171,3 +172,36 @@ func TestFileClientCacheCompatibility(t *testing.T) {
 	checkSecretValue(t, st, "pear", "p1")
 	checkSecretValue(t, st, "cherry", "c2")
 }
+
+func TestPlainTextErrors(t *testing.T) {
+	// Servers that predate structured errors report plain text.
+	tests := []struct {
+		status int
+		code   string
+		is     error
+	}{
+		{http.StatusNotFound, api.CodeNotFound, api.ErrNotFound},
+		{http.StatusForbidden, api.CodeAccessDenied, api.ErrAccessDenied},
+		{http.StatusPreconditionFailed, api.CodeVersionClaimed, api.ErrVersionClaimed},
+		{http.StatusInternalServerError, api.CodeInternal, nil},
+	}
+	for _, tc := range tests {
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "something happened", tc.status)
+		}))
+		defer hs.Close()
+
+		cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+		_, err := cli.Get(t.Context(), "test")
+		var aerr *api.Error
+		if !errors.As(err, &aerr) {
+			t.Fatalf("Get (status %d): got %v, want *api.Error", tc.status, err)
+		}
+		if aerr.Status != tc.status || aerr.Code != tc.code || aerr.Message != "something happened" {
+			t.Errorf("Get: got %+v, want status %d code %q", aerr, tc.status, tc.code)
+		}
+		if tc.is != nil && !errors.Is(err, tc.is) {
+			t.Errorf("Get (status %d): got %v, want %v", tc.status, err, tc.is)
+		}
+	}
+}
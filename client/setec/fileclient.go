@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/tailscale/setec/types/api"
 )
@@ -117,3 +118,23 @@ type VersioningStoreClient interface {
 	// It fails if this version of the secret ever had a value.
 	CreateVersion(ctx context.Context, name string, version api.SecretVersion, value []byte) error
 }
+
+// BatchStoreClient is an extension of [StoreClient] that can fetch several
+// secrets in a single request.
+type BatchStoreClient interface {
+	StoreClient
+
+	// GetMany fetches the active values of several secrets. See
+	// [Client.GetMany].
+	GetMany(ctx context.Context, items []api.GetManyItem) ([]GetResult, error)
+}
+
+// WatchingStoreClient is an extension of [StoreClient] that can wait for the
+// active versions of secrets to change.
+type WatchingStoreClient interface {
+	StoreClient
+
+	// Watch waits until the active version of any of the given secrets
+	// changes, or the timeout elapses. See [Client.Watch].
+	Watch(ctx context.Context, secrets []api.WatchSecret, timeout time.Duration) ([]api.WatchSecret, error)
+}
@@ -4,6 +4,8 @@
 package setec
 
 import (
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -104,3 +106,24 @@ func TestPollDisabled(t *testing.T) {
 		t.Error("Polling is unexpectedly enabled")
 	}
 }
+
+func TestIsUnsupported(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusNotFound, `{"Code":"unknown-method","Message":"unknown API method"}`, true},
+		{http.StatusBadRequest, "invalid method\n", true},
+		{http.StatusNotFound, "404 page not found\n", true},
+		{http.StatusBadRequest, `{"Code":"bad-request","Message":"invalid page token"}`, false},
+		{http.StatusNotFound, `{"Code":"not-found","Message":"not found"}`, false},
+		{http.StatusForbidden, "access denied\n", false},
+	}
+	for _, tc := range tests {
+		err := responseError(tc.status, []byte(tc.body))
+		if got := isUnsupported(fmt.Errorf("wrapped: %w", err)); got != tc.want {
+			t.Errorf("isUnsupported(%d %q): got %v, want %v", tc.status, tc.body, got, tc.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"os"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/msync/throttle"
@@ -34,6 +35,7 @@ type Store struct {
 	newTicker   func(time.Duration) Ticker
 	timeNow     func() time.Time
 	single      throttle.Set[string, Secret]
+	noBatch     atomic.Bool // the service does not support batched gets
 
 	// Undeclared secrets not accessed in at least this long are eligible to be
 	// purged from the cache. If zero, no expiry is performed.
@@ -140,6 +142,13 @@ type StoreConfig struct {
 	// BackgroundContext, if non-nil, is a context that is used for background operations
 	// instead of context.Background.
 	BackgroundContext context.Context
+
+	// Watch, if true, instructs the store to wait for changes to its secrets
+	// with long polls to the service, so that new values are seen promptly
+	// rather than at the next poll. Polling at PollInterval continues as a
+	// fallback. The Client must be a [WatchingStoreClient]. If the service
+	// does not support watching, the store relies on polling alone.
+	Watch bool
 }
 
 func (c StoreConfig) logger() logger.Logf {
@@ -186,6 +195,13 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	if cfg.Client == nil {
 		return nil, errors.New("no service client is set")
 	}
+	var wc WatchingStoreClient
+	if cfg.Watch {
+		var ok bool
+		if wc, ok = cfg.Client.(WatchingStoreClient); !ok {
+			return nil, fmt.Errorf("client %T does not support watching", cfg.Client)
+		}
+	}
 
 	secrets, structs, err := cfg.secretNames()
 	if err != nil {
@@ -268,12 +284,20 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	done := make(chan struct{})
 	s.done = done
 
+	var wg sync.WaitGroup
 	if pi := cfg.pollInterval(); pi > 0 {
-		go s.run(pctx, pi, done)
+		wg.Go(func() { s.run(pctx, pi) })
 	} else {
-		close(done) // unblock shutdown, which will wait for this
 		s.logf("[store] automatic polling for new values is disabled")
 	}
+	if wc != nil {
+		wg.Go(func() { s.watch(pctx, wc) })
+	}
+	if cfg.pollInterval() <= 0 && wc == nil {
+		close(done) // unblock shutdown, which will wait for this
+	} else {
+		go func() { wg.Wait(); close(done) }()
+	}
 
 	return s, nil
 }
@@ -517,21 +541,38 @@ func (s *Store) snapshotActive() map[string]cachedSecret {
 // If the named secret has expired, the value is nil.
 // Otherwise, the value is a new secret version for that secret.
 func (s *Store) poll(ctx context.Context, updates map[string]*cachedSecret) error {
-	var errs []error
-	for name, cs := range s.snapshotActive() {
+	snap := s.snapshotActive()
+	var items []api.GetManyItem
+	for name, cs := range snap {
 		// If the secret has expired, mark it for deletion.
 		if s.hasExpired(cs) {
 			updates[name] = nil // nil means "delete me"
+			delete(snap, name)
 			continue
 		}
-
 		if cs.Secret != nil {
 			// We are tracking the active version of this secret, check if it's changed.
-			if err := s.pollSecret(ctx, name, &cs, updates); err != nil {
-				errs = append(errs, err)
-			}
+			items = append(items, api.GetManyItem{Name: name, Version: cs.Secret.Version})
+		}
+	}
+
+	var errs []error
+	for _, r := range s.getMany(ctx, items) {
+		if errors.Is(r.Err, api.ErrValueNotChanged) {
+			continue // all is well, but nothing to update
+		} else if r.Err != nil {
+			errs = append(errs, r.Err)
+			continue
 		}
+		cs := snap[r.Name]
+		if r.Value.Version != cs.Secret.Version {
+			cs.Secret = r.Value
+			snap[r.Name] = cs
+			updates[r.Name] = &cs
+		}
+	}
 
+	for name, cs := range snap {
 		if cs.Versions != nil {
 			// We are tracking specific versions of this secret, check if any have been
 			// deleted.
@@ -543,18 +584,40 @@ func (s *Store) poll(ctx context.Context, updates map[string]*cachedSecret) erro
 	return errors.Join(errs...)
 }
 
-func (s *Store) pollSecret(ctx context.Context, name string, cs *cachedSecret, updates map[string]*cachedSecret) error {
-	got, err := s.client.GetIfChanged(ctx, name, cs.Secret.Version)
-	if errors.Is(err, api.ErrValueNotChanged) {
-		return nil // all is well, but nothing to update
-	} else if err != nil {
-		return err
+// getMany fetches the secrets described by items, in a single request if the
+// client supports it, and otherwise with one request per secret. The results
+// are in the same order as items.
+func (s *Store) getMany(ctx context.Context, items []api.GetManyItem) []GetResult {
+	if len(items) == 0 {
+		return nil
 	}
-	if got.Version != cs.Secret.Version {
-		cs.Secret = got
-		updates[name] = cs
+	if bc, ok := s.client.(BatchStoreClient); ok && !s.noBatch.Load() {
+		rs, err := bc.GetMany(ctx, items)
+		if err == nil {
+			return rs
+		} else if !isUnsupported(err) {
+			out := make([]GetResult, len(items))
+			for i, item := range items {
+				out[i] = GetResult{Name: item.Name, Err: err}
+			}
+			return out
+		}
+		s.logf("[store] service does not support batched gets; fetching secrets individually")
+		s.noBatch.Store(true)
 	}
-	return nil
+
+	out := make([]GetResult, len(items))
+	for i, item := range items {
+		var sv *api.SecretValue
+		var err error
+		if item.Version != 0 {
+			sv, err = s.client.GetIfChanged(ctx, item.Name, item.Version)
+		} else {
+			sv, err = s.client.Get(ctx, item.Name)
+		}
+		out[i] = GetResult{Name: item.Name, Value: sv, Err: err}
+	}
+	return out
 }
 
 func (s *Store) pollVersionedSecret(ctx context.Context, name string, cs *cachedSecret, updates map[string]*cachedSecret) error {
@@ -581,11 +644,9 @@ func (s *Store) pollVersionedSecret(ctx context.Context, name string, cs *cached
 	return nil
 }
 
-// run runs a polling loop at approximately the given interval until ctx ends,
-// then closes done. It should be run in a separate goroutine.
-func (s *Store) run(ctx context.Context, interval time.Duration, done chan<- struct{}) {
-	defer close(done)
-
+// run runs a polling loop at approximately the given interval until ctx ends.
+// It should be run in a separate goroutine.
+func (s *Store) run(ctx context.Context, interval time.Duration) {
 	// Jitter polls by ±10% of the total interval to avert a thundering herd.
 	jitter := time.Duration(rand.Intn(2*int(interval)/10) - (int(interval) / 10))
 
@@ -613,6 +674,86 @@ func (s *Store) run(ctx context.Context, interval time.Duration, done chan<- str
 	}
 }
 
+// watch waits for changes to the secrets in s using long polls to wc, and
+// applies them, until ctx ends or wc reports that the service does not
+// support watching. It should be run in a separate goroutine.
+func (s *Store) watch(ctx context.Context, wc WatchingStoreClient) {
+	const baseRetryWait = time.Second
+	retryWait := baseRetryWait
+
+	// The latest versions reported by the service, which may differ from the
+	// versions we have if fetching a new value failed. Watching for changes
+	// from these versions keeps us from reacting to the same change again.
+	seen := make(map[string]api.SecretVersion)
+
+	s.logf("[store] begin watching for updates")
+	for ctx.Err() == nil {
+		snap := s.snapshotActive()
+		var ws []api.WatchSecret
+		for name, cs := range snap {
+			if cs.Secret == nil {
+				continue // only tracking specific versions
+			}
+			v, ok := seen[name]
+			if !ok || v == cs.Secret.Version {
+				delete(seen, name) // caught up
+				v = cs.Secret.Version
+			}
+			ws = append(ws, api.WatchSecret{Name: name, Version: v})
+		}
+		if len(ws) == 0 {
+			sleepFor(ctx, time.Minute) // nothing to watch yet
+			continue
+		}
+
+		changed, err := wc.Watch(ctx, ws, 0)
+		if isUnsupported(err) {
+			s.logf("[store] service does not support watching; relying on polling")
+			return
+		} else if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.countPollErrors.Add(1)
+			s.logf("[store] watching for updates failed: %v (retrying)", err)
+			sleepFor(ctx, retryWait)
+			if retryWait < time.Minute {
+				retryWait += retryWait
+			}
+			continue
+		}
+		retryWait = baseRetryWait
+
+		var items []api.GetManyItem
+		for _, c := range changed {
+			seen[c.Name] = c.Version
+			cs, ok := snap[c.Name]
+			if !ok || c.Version == 0 {
+				continue // unknown to us, or deleted on the server
+			}
+			items = append(items, api.GetManyItem{Name: c.Name, Version: cs.Secret.Version})
+		}
+		updates := make(map[string]*cachedSecret)
+		for _, r := range s.getMany(ctx, items) {
+			if errors.Is(r.Err, api.ErrValueNotChanged) {
+				continue
+			} else if r.Err != nil {
+				s.logf("[store] fetching update for %q failed: %v", r.Name, r.Err)
+				continue
+			}
+			cs := snap[r.Name]
+			if r.Value.Version != cs.Secret.Version {
+				cs.Secret = r.Value
+				updates[r.Name] = &cs
+			}
+		}
+		if err := s.applyUpdates(updates); err != nil {
+			s.logf("[store] applying updates failed: %v", err)
+		}
+	}
+	s.logf("[store] stopping update watcher")
+}
+
 // applyUpdates applies the specified updates to the secret values, and if a
 // cache is present flushes the data to the cache.
 func (s *Store) applyUpdates(updates map[string]*cachedSecret) error {
@@ -708,15 +849,17 @@ func (s *Store) initializeActive(ctx context.Context) error {
 	_, waitingIsPointless := s.client.(*FileClient)
 
 	for {
-		var missing int
+		var items []api.GetManyItem
 		for name, cs := range s.active.m {
-			if cs != nil {
-				continue
+			if cs == nil {
+				items = append(items, api.GetManyItem{Name: name})
 			}
-			sv, err := s.client.Get(ctx, name)
-			if err == nil {
-				s.active.m[name] = &cachedSecret{
-					Secret:     sv,
+		}
+		var missing int
+		for _, r := range s.getMany(ctx, items) {
+			if r.Err == nil {
+				s.active.m[r.Name] = &cachedSecret{
+					Secret:     r.Value,
 					LastAccess: s.timeNow().Unix(),
 					Declared:   true,
 
@@ -726,9 +869,9 @@ func (s *Store) initializeActive(ctx context.Context) error {
 				}
 				continue
 			} else if ctx.Err() != nil {
-				return err // context ended, give up
+				return r.Err // context ended, give up
 			}
-			s.logf("[store] error fetching %q: %v (retrying)", name, err)
+			s.logf("[store] error fetching %q: %v (retrying)", r.Name, r.Err)
 			missing++
 		}
 		if missing == 0 {
@@ -7,9 +7,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -851,3 +853,111 @@ func (c *closeable[T]) Close() error {
 	c.Closed = true
 	return nil
 }
+
+func TestStoreWatch(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "alpha", "ok") // active
+	v2 := d.MustPut(d.Superuser, "alpha", "better")
+
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if _, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:  &setec.FileClient{},
+		Secrets: []string{"alpha"},
+		Watch:   true,
+	}); err == nil {
+		t.Error("NewStore with FileClient and Watch: got nil, want error")
+	}
+
+	// With polling disabled, updates arrive only by watching.
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       cli,
+		Secrets:      []string{"alpha"},
+		PollInterval: -1,
+		Watch:        true,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: unexpected error: %v", err)
+	}
+	defer st.Close()
+
+	alpha := st.Secret("alpha")
+	if got := alpha.GetString(); got != "ok" {
+		t.Fatalf("Initial value: got %q, want %q", got, "ok")
+	}
+	d.MustActivate(d.Superuser, "alpha", v2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for alpha.GetString() != "better" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Updated value: got %q, want %q", alpha.GetString(), "better")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreGetMany(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	names := []string{"alpha", "bravo", "charlie"}
+	for _, name := range names {
+		d.MustPut(d.Superuser, name, name+"-value")
+	}
+
+	ts := setectest.NewServer(t, d, nil)
+	for _, batch := range []bool{true, false} {
+		var gets, getMany atomic.Int64
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/get":
+				gets.Add(1)
+			case "/api/get-many":
+				getMany.Add(1)
+				if !batch {
+					// Simulate an older server that routes unknown methods to the UI.
+					http.Error(w, "invalid method", http.StatusBadRequest)
+					return
+				}
+			}
+			ts.Mux.ServeHTTP(w, r)
+		}))
+		defer hs.Close()
+
+		st, err := setec.NewStore(t.Context(), setec.StoreConfig{
+			Client:       setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+			Secrets:      names,
+			PollInterval: -1,
+		})
+		if err != nil {
+			t.Fatalf("NewStore (batch=%v): unexpected error: %v", batch, err)
+		}
+		for _, name := range names {
+			checkSecretValue(t, st, name, name+"-value")
+		}
+		if err := st.Refresh(t.Context()); err != nil {
+			t.Fatalf("Refresh (batch=%v): unexpected error: %v", batch, err)
+		}
+		st.Close()
+
+		if batch {
+			if got := gets.Load(); got != 0 {
+				t.Errorf("Individual gets (batch): got %d, want 0", got)
+			}
+			if got := getMany.Load(); got != 2 {
+				t.Errorf("Batched gets: got %d, want 2", got)
+			}
+		} else {
+			// Once the batch call fails, the store stops trying it.
+			if got := getMany.Load(); got != 1 {
+				t.Errorf("Batched gets (fallback): got %d, want 1", got)
+			}
+			if got, want := gets.Load(), int64(2*len(names)); got != want {
+				t.Errorf("Individual gets (fallback): got %d, want %d", got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+)
+
+// loadAuditKey reads the PEM-encoded ed25519 private key used to sign audit
+// log checkpoints from path. If path does not exist, loadAuditKey generates
+// a new key and writes it to path, and writes the corresponding public key
+// to path + ".pub".
+func loadAuditKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newAuditKey(path)
+	} else if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(data)
+	if blk == nil || blk.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: key is %T, not ed25519", path, key)
+	}
+	return priv, nil
+}
+
+func newAuditKey(path string) (ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// readAuditPublicKey reads a PEM-encoded ed25519 public key from path. For
+// convenience, path may also name the private key file.
+func readAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	var key any
+	switch blk.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(blk.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, blk.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("%s: key is %T, not ed25519", path, key)
+	}
+}
+
+// auditSinkErrors counts failures to deliver audit entries to sinks other
+// than the local audit log.
+var auditSinkErrors = expvar.NewInt("counter_setec_audit_sink_errors")
+
+func reportAuditSinkError(err error) {
+	auditSinkErrors.Add(1)
+	log.Printf("WARNING: audit sink: %v", err)
+}
+
+// auditRotationErrors counts failures to rotate, compress or expire segments
+// of the local audit log.
+var auditRotationErrors = expvar.NewInt("counter_setec_audit_rotation_errors")
+
+func reportAuditRotationError(err error) {
+	auditRotationErrors.Add(1)
+	log.Printf("WARNING: audit log rotation: %v", err)
+}
+
+// addAuditSinks adds the audit sinks selected by the server flags to w.
+func addAuditSinks(w *audit.Writer) error {
+	w.OnSinkError(reportAuditSinkError)
+	buf := audit.BufferOptions{OnError: reportAuditSinkError}
+	if serverArgs.AuditSyslog {
+		s, err := audit.NewSyslogSink(audit.SyslogOptions{Buffer: buf})
+		if err != nil {
+			return err
+		}
+		w.AddSink(s)
+	}
+	if serverArgs.AuditWebhook != "" {
+		var hdr http.Header
+		if tok := os.Getenv("SETEC_AUDIT_WEBHOOK_TOKEN"); tok != "" {
+			hdr = http.Header{"Authorization": {"Bearer " + tok}}
+		}
+		w.AddSink(audit.NewWebhookSink(serverArgs.AuditWebhook, audit.WebhookOptions{
+			Header: hdr,
+			Buffer: buf,
+		}))
+	}
+	return nil
+}
+
+var auditVerifyArgs struct {
+	PublicKey string `flag:"public-key,Path of the PEM public key for checkpoint signatures"`
+}
+
+func runAuditVerify(env *command.Env, path string, more ...string) error {
+	var key ed25519.PublicKey
+	if auditVerifyArgs.PublicKey != "" {
+		var err error
+		key, err = readAuditPublicKey(auditVerifyArgs.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Multiple files are checked as a single chain, in the order given.
+	var rs []io.Reader
+	for _, p := range append([]string{path}, more...) {
+		rc, err := audit.OpenSegment(p)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		rs = append(rs, rc)
+	}
+	if len(more) != 0 {
+		path = fmt.Sprintf("%s (+%d files)", path, len(more))
+	}
+
+	rep, err := audit.Verify(io.MultiReader(rs...), key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if rep.Unchained != 0 {
+		fmt.Printf("%s: %d entries predate hash chaining and cannot be verified\n", path, rep.Unchained)
+	}
+	if rep.Last == 0 {
+		fmt.Printf("%s: no chained entries\n", path)
+		return nil
+	}
+	fmt.Printf("%s: entries %d-%d OK (%d entries, %d checkpoints)\n",
+		path, rep.First, rep.Last, rep.Entries, rep.Checkpoints)
+	switch {
+	case key == nil:
+		fmt.Println("  Checkpoint signatures were not checked; use --public-key to check them")
+	case rep.Verified == 0:
+		fmt.Println("  WARNING: No signed checkpoints found")
+	case rep.Verified < rep.Last:
+		fmt.Printf("  Signed through entry %d; later entries are not covered by a checkpoint\n", rep.Verified)
+	default:
+		fmt.Println("  All entries are covered by a signed checkpoint")
+	}
+	return nil
+}
+
+// auditFilterArgs are the flags that select audit log entries, shared by the
+// search and export commands.
+var auditFilterArgs struct {
+	Principal  string `flag:"principal,Select entries for this user or hostname"`
+	Tag        string `flag:"tag,Select entries for principals with this tag"`
+	Secret     string `flag:"secret,Select entries for secrets matching this pattern"`
+	Action     string `flag:"action,Select entries for this action"`
+	Authorized string `flag:"authorized,Select authorized (true) or denied (false) entries"`
+	Since      string `flag:"since,Select entries at or after this time (RFC 3339) or duration ago"`
+	Until      string `flag:"until,Select entries before this time (RFC 3339) or duration ago"`
+}
+
+// auditRequest returns an audit log request for the entries selected by the
+// filter flags, and at most limit entries.
+func auditRequest(limit int) (api.AuditRequest, error) {
+	req := api.AuditRequest{
+		Principal: auditFilterArgs.Principal,
+		Tag:       auditFilterArgs.Tag,
+		Secret:    acl.Secret(auditFilterArgs.Secret),
+		Action:    acl.Action(auditFilterArgs.Action),
+		Limit:     limit,
+	}
+	if s := auditFilterArgs.Authorized; s != "" {
+		ok, err := strconv.ParseBool(s)
+		if err != nil {
+			return req, fmt.Errorf("invalid --authorized: %w", err)
+		}
+		req.Authorized = &ok
+	}
+	var err error
+	if req.Since, err = parseTimeFlag(auditFilterArgs.Since); err != nil {
+		return req, fmt.Errorf("invalid --since: %w", err)
+	}
+	if req.Until, err = parseTimeFlag(auditFilterArgs.Until); err != nil {
+		return req, fmt.Errorf("invalid --until: %w", err)
+	}
+	return req, nil
+}
+
+var auditSearchArgs struct {
+	Limit int  `flag:"limit,default=100,Maximum number of (most recent) entries to report"`
+	JSON  bool `flag:"json,Print entries as JSON lines"`
+}
+
+// parseTimeFlag parses s as an RFC 3339 timestamp, or as a duration before
+// the current time. An empty string yields the zero time.
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func runAuditSearch(env *command.Env) error {
+	req, err := auditRequest(auditSearchArgs.Limit)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	entries, err := c.SearchAudit(env.Context(), req)
+	if err != nil {
+		return fmt.Errorf("failed to search audit log: %w", err)
+	}
+
+	if auditSearchArgs.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "TIME\tPRINCIPAL\tACTION\tSECRET\tVERSION\tAUTHORIZED\n")
+	for _, e := range entries {
+		who := e.Principal.User
+		if who == "" {
+			who = e.Principal.Hostname
+		}
+		secret := e.Secret
+		if secret == "" {
+			secret = "-"
+		}
+		ver := "-"
+		if e.SecretVersion != 0 {
+			ver = e.SecretVersion.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n",
+			e.Time.Local().Format(time.DateTime), who, e.Action, secret, ver, e.Authorized)
+	}
+	return tw.Flush()
+}
+
+var auditExportArgs struct {
+	Limit  int    `flag:"limit,default=10000,Maximum number of (most recent) entries to export"`
+	Output string `flag:"output,Write the export to this file (default stdout)"`
+}
+
+func runAuditExport(env *command.Env) error {
+	req, err := auditRequest(auditExportArgs.Limit)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	x, err := c.ExportAudit(env.Context(), req)
+	if err != nil {
+		return fmt.Errorf("failed to export audit log: %w", err)
+	}
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if auditExportArgs.Output == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(auditExportArgs.Output, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d entries\n", len(x.Entries))
+	return nil
+}
+
+var auditExportKeyArgs struct {
+	Output string `flag:"output,Write the key to this file (default stdout)"`
+}
+
+func runAuditExportKey(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	key, err := c.AuditExportKey(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get audit export key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding public key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if auditExportKeyArgs.Output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(auditExportKeyArgs.Output, data, 0644)
+}
+
+var auditVerifyExportArgs struct {
+	PublicKey string `flag:"public-key,Path of the PEM public key of the server that signed the export (required)"`
+}
+
+func runAuditVerifyExport(env *command.Env, path string) error {
+	if auditVerifyExportArgs.PublicKey == "" {
+		return errors.New("--public-key is required (get it with \"setec audit export-key\")")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var x audit.Export
+	if err := json.Unmarshal(data, &x); err != nil {
+		return fmt.Errorf("%s: invalid export: %w", path, err)
+	}
+	key, err := readAuditPublicKey(auditVerifyExportArgs.PublicKey)
+	if err != nil {
+		return err
+	}
+	entries, err := x.Verify(key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	fmt.Printf("%s: signature OK (%d entries, exported %s)\n",
+		path, len(entries), x.Time.Local().Format(time.DateTime))
+	if len(entries) != 0 {
+		first, last := entries[0], entries[len(entries)-1]
+		fmt.Printf("  Entries from %s to %s\n",
+			first.Time.Local().Format(time.DateTime), last.Time.Local().Format(time.DateTime))
+	}
+	return nil
+}
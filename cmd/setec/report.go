@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/setec/types/api"
+)
+
+var reportArgs struct {
+	Days int  `flag:"days,default=30,Report reads within this many days"`
+	JSON bool `flag:"json,Print the usage statistics as JSON"`
+}
+
+// formatGet formats the time of a read for a report.
+func formatGet(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func runReportUnused(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	rsp, err := c.Usage(env.Context(), "", reportArgs.Days)
+	if err != nil {
+		return fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -reportArgs.Days)
+	var unused []*api.SecretUsage
+	for _, su := range rsp.Secrets {
+		if su.LastGet.Before(cutoff) {
+			unused = append(unused, su)
+		}
+	}
+	if reportArgs.JSON {
+		return json.NewEncoder(os.Stdout).Encode(unused)
+	}
+
+	fmt.Printf("Secrets not read in the last %d days (reads recorded since %s):\n\n",
+		reportArgs.Days, rsp.Since.Local().Format(time.DateTime))
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "NAME\tACTIVE\tLAST GET\n")
+	for _, su := range unused {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", su.Name, su.ActiveVersion, formatGet(su.LastGet))
+	}
+	return tw.Flush()
+}
+
+func runReportConsumers(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	rsp, err := c.Usage(env.Context(), name, reportArgs.Days)
+	if err != nil {
+		return fmt.Errorf("failed to get usage: %w", err)
+	} else if len(rsp.Secrets) != 1 {
+		return fmt.Errorf("server reported %d secrets, want 1", len(rsp.Secrets))
+	}
+	su := rsp.Secrets[0]
+	if reportArgs.JSON {
+		return json.NewEncoder(os.Stdout).Encode(su)
+	}
+
+	fmt.Printf("Consumers of %q in the last %d days (reads recorded since %s):\n\n",
+		su.Name, reportArgs.Days, rsp.Since.Local().Format(time.DateTime))
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "PRINCIPAL\tVERSION\tLAST GET\n")
+	var stale int
+	for _, sc := range su.Consumers {
+		ver := "-"
+		if sc.Version != 0 {
+			ver = sc.Version.String()
+			if sc.Version != su.ActiveVersion {
+				ver += " (old)"
+				stale++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", sc.Principal, ver, formatGet(sc.LastGet))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nActive version: %s", su.ActiveVersion)
+	if stale != 0 {
+		fmt.Printf(" (%d of %d consumers last read an old version)", stale, len(su.Consumers))
+	}
+	fmt.Println()
+	if len(su.Versions) != 0 {
+		fmt.Println()
+		tw = newTabWriter(os.Stdout)
+		io.WriteString(tw, "VERSION\tGETS\tLAST GET\n")
+		for _, vu := range su.Versions {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", vu.Version, vu.Gets, formatGet(vu.LastGet))
+		}
+		return tw.Flush()
+	}
+	return nil
+}
@@ -9,11 +9,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,14 +31,18 @@ import (
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
+	"github.com/tailscale/hujson"
+	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/internal/tinktestutil"
+	"github.com/tailscale/setec/kms"
 	"github.com/tailscale/setec/server"
 	"github.com/tailscale/setec/types/api"
-	"github.com/tink-crypto/tink-go-awskms/v2/integration/awskms"
 	"github.com/tink-crypto/tink-go/v2/tink"
 	"golang.org/x/term"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tsnet"
 	"tailscale.com/tsweb"
 )
@@ -66,6 +74,15 @@ With the --dev flag, the server runs with a dummy KMS. This mode is intended
 for debugging and is NOT SAFE for production use.
 
 Otherwise you must provide a --kms-key-name to use to encrypt the database.
+The key name is a URI whose scheme selects the key store:
+
+  aws-kms://arn:aws:kms:<region>:<account>:key/<id>   (AWS KMS)
+  gcp-kms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>   (Cloud KMS)
+  file:///path/to/kek.json?passphrase-env=SETEC_KEK_PASSPHRASE
+  file:///path/to/kek.json?master-key-file=/path/to/master.key
+
+A name without a scheme is treated as an AWS KMS key ARN. Use "setec create-kek"
+to create a file key.
 
 Most of the settings can be set via environment variables as well as flags.
 
@@ -78,16 +95,106 @@ Most of the settings can be set via environment variables as well as flags.
     --backup-bucket        SETEC_BACKUP_BUCKET        string    (optional)
     --backup-bucket-region SETEC_BACKUP_BUCKET_REGION string    (optional)
     --backup-role          SETEC_BACKUP_ROLE          string    (optional)
+    --backup-max-age       SETEC_BACKUP_MAX_AGE       duration  1h
     --login-server         SETEC_LOGIN_SERVER         string    (optional)
+    --approval-required    SETEC_APPROVAL_REQUIRED    patterns  (optional)
+    --approval-expiry      SETEC_APPROVAL_EXPIRY      duration  24h
+    --audit-max-size       SETEC_AUDIT_MAX_SIZE       MiB       (no limit)
+    --audit-max-age        SETEC_AUDIT_MAX_AGE        duration  (no limit)
+    --audit-retention      SETEC_AUDIT_RETENTION      duration  (forever)
+    --audit-syslog         SETEC_AUDIT_SYSLOG         bool      false
+    --audit-webhook        SETEC_AUDIT_WEBHOOK        URL       (optional)
+    --usage-history        SETEC_USAGE_HISTORY        duration  720h
+    --rate-limit           SETEC_RATE_LIMIT           calls/s   (no limit)
+    --rate-burst           SETEC_RATE_BURST           calls     (same as rate)
+    --external-addr        SETEC_EXTERNAL_ADDR        host:port (optional)
+    --external-cert        SETEC_EXTERNAL_CERT        path      (required with --external-addr)
+    --external-key         SETEC_EXTERNAL_KEY         path      (required with --external-addr)
+    --client-ca            SETEC_CLIENT_CA            path      (optional)
+    --cert-acl             SETEC_CERT_ACL             path      (required with --client-ca)
+    --token-file           SETEC_TOKEN_FILE           path      (optional)
+    --rotation-policy      SETEC_ROTATION_POLICY      path      (optional)
+
+With --approval-required, activating or deleting a secret whose name matches
+one of the comma-separated patterns requires approval by a second principal
+with "approve" permission (see "setec help approve").
+
+With --audit-max-size or --audit-max-age, the audit log is rotated when it
+reaches the given size or age. Rotated logs are compressed with gzip, and
+deleted after the --audit-retention period, if one is set.
+
+With --audit-syslog and/or --audit-webhook, audit log entries are also sent to
+the local syslog daemon and/or POSTed to the given URL as JSON. If the
+SETEC_AUDIT_WEBHOOK_TOKEN environment variable is set, webhook requests carry
+it as a bearer token. Entries are always written to the local audit log first;
+failures to deliver them elsewhere are logged and counted, but do not cause
+requests to fail.
+
+With --rate-limit, each caller may call each API method at most the given
+number of times per second on average, with bursts of up to --rate-burst
+calls. Callers are identified by their user, or if they have none, their tags.
+Calls beyond the limit are rejected with 429 Too Many Requests.
+
+Callers are identified as tailnet peers, with the permissions granted by the
+tailnet policy. To give narrow access to callers outside the tailnet, such as
+CI systems, serve the API on --external-addr using the TLS certificate and key
+in --external-cert and --external-key, and identify callers by:
+
+ - Client certificates, issued by a CA in --client-ca. The subject alternative
+   names of a certificate are granted permissions by the JSON ACL file in
+   --cert-acl.
+ - Bearer tokens, whose SHA-256 hashes and permissions are listed in the JSON
+   file in --token-file. Clients give the token in SETEC_TOKEN.
+
+Only the API is served on --external-addr. See docs/server.md for the formats
+of the files.
+
+With --rotation-policy, the server rotates secrets automatically, as described
+by the policies in the given JSON file. Each policy applies to the secrets
+whose names begin with its prefix: every interval, the server generates a new
+version (see "setec help generate"), activates it after the activation delay,
+and deletes old versions beyond the number to keep. These actions are recorded
+in the audit log under the principal "system:setec".
+
+The server reports its health at /healthz and /readyz, without requiring
+authentication. Readiness also covers backups, which are reported as degraded
+if changes have gone more than --backup-max-age without one.
+
+At startup, the server reads the --usage-history period of the audit log to
+initialize the usage statistics reported by "setec report". A negative value
+skips this, so that usage is reported only from when the server starts.
 `,
 
 				SetFlags: command.Flags(flax.MustBind, &serverArgs),
 				Run:      command.Adapt(runServer),
 			},
+			{
+				Name:  "create-kek",
+				Usage: "<file-uri>",
+				Help: `Create a file key for the server's --kms-key-name.
+
+The key is a fresh tink keyset, written to the path named by the file URI and
+encrypted by the master key or passphrase its options select:
+
+  file:///path/to/kek.json?master-key-file=/path/to/master.key
+  file:///path/to/kek.json?passphrase-file=/path/to/passphrase
+  file:///path/to/kek.json?passphrase-env=VAR
+
+With no option, the passphrase is read from $SETEC_KEK_PASSPHRASE. A master key
+file must contain exactly 32 random bytes. The key file is not overwritten if
+it already exists.`,
+
+				Run: command.Adapt(runCreateKEK),
+			},
 			{
 				Name: "list",
-				Help: "List all secrets visible to the caller.",
-				Run:  command.Adapt(runList),
+				Help: `List secrets visible to the caller.
+
+With --prefix or --glob, list only secrets whose names match. Secrets are
+fetched from the server in pages of --page-size names.`,
+
+				SetFlags: command.Flags(flax.MustBind, &listArgs),
+				Run:      command.Adapt(runList),
 			},
 			{
 				Name:  "info",
@@ -124,6 +231,28 @@ where whitespace matters, such as PEM-formatted certificates and SSH keys.`,
 				SetFlags: command.Flags(flax.MustBind, &putArgs),
 				Run:      command.Adapt(runPut),
 			},
+			{
+				Name:  "generate",
+				Usage: "<secret-name>",
+				Help: `Put a new value for the specified secret, generated by the server.
+
+The value is generated by the server, so it is never handled by the user. The
+--type flag selects the kind of value:
+
+  password     random letters and digits (--length characters, default 32)
+  bytes        random bytes (--length bytes, default 32)
+  ed25519      an Ed25519 key pair, as PEM private and public keys
+  ecdsa        an ECDSA key pair, as PEM private and public keys
+               (--algorithm P256, P384 or P521; default P256)
+  tink-keyset  a tink keyset in cleartext JSON (--algorithm AES256_GCM,
+               AES128_GCM, XCHACHA20_POLY1305 or HMAC_SHA256; default AES256_GCM)
+
+As with put, the new version is not activated unless it is the first version
+of the secret.`,
+
+				SetFlags: command.Flags(flax.MustBind, &generateArgs),
+				Run:      command.Adapt(runGenerate),
+			},
 			{
 				Name:  "activate",
 				Usage: "<secret-name> <secret-version>",
@@ -150,6 +279,195 @@ generate the token, then re-run appending the provided value.`,
 
 				Run: command.Adapt(runDeleteSecret),
 			},
+			{
+				Name: "whoami",
+				Help: "Print the identity and permissions the server assigns to the caller.",
+				Run:  command.Adapt(runWhoAmI),
+			},
+			{
+				Name:  "can",
+				Usage: "<action> <secret-name>",
+				Help: `Check whether the caller may perform an action on a secret.
+
+Prints which of the caller's rules allows or denies the action. The command
+fails if the action is denied. The secret need not exist.`,
+
+				Run: command.Adapt(runCan),
+			},
+			{
+				Name: "acl",
+				Help: "Commands for working with access control policies.",
+				Commands: []*command.C{
+					{
+						Name:  "lint",
+						Usage: "<policy-file>",
+						Help: `Check setec access rules in a policy file for errors.
+
+The file may be a tailnet policy file (JSON or HuJSON), in which case the
+setec capabilities granted by each entry in "grants" are checked, or a JSON
+array of setec access rules.
+
+Each rule is checked for unknown actions, empty action or secret lists,
+malformed secret patterns, and unrecognized fields. The command fails if any
+problems are found. No server is contacted.`,
+
+						Run: command.Adapt(runACLLint),
+					},
+				},
+			},
+			{
+				Name: "audit",
+				Help: "Commands for working with audit logs.",
+				Commands: []*command.C{
+					{
+						Name: "search",
+						Help: `Search the server's audit log.
+
+Reports the most recent entries (up to --limit) matching all the given
+filters, in chronological order. Only entries for secrets on which the caller
+has "audit" permission are reported; entries that do not name a secret, such
+as list operations, require "audit" permission on a pattern matching the
+empty name, such as "*".
+
+The --since and --until flags accept either an RFC 3339 timestamp or a
+duration before the current time, for example:
+
+   setec audit search --secret=prod/stripe-key --action=get --since=168h`,
+
+						SetFlags: command.Flags(flax.MustBind, &auditFilterArgs, &auditSearchArgs),
+						Run:      command.Adapt(runAuditSearch),
+					},
+					{
+						Name:  "verify",
+						Usage: "<log-file> ...",
+						Help: `Check the integrity of audit log files.
+
+Each entry in the audit log records the hash of the entry before it, and the
+server periodically appends a checkpoint signed with the key in audit-key.pem
+in its state directory. This command checks that the entries form an unbroken
+chain, reporting any entries that were modified, removed, inserted or
+reordered.
+
+With --public-key, the signature of each checkpoint is also checked. The
+server writes its public key to audit-key.pem.pub in the state directory.
+Entries after the last checkpoint could have been truncated without
+detection. No server is contacted.
+
+Multiple files, such as the closed segments of a rotated log followed by the
+current log, are checked as a single chain in the order given. Compressed
+(.gz) segments are decompressed automatically. For example:
+
+   setec audit verify audit.log.*.gz audit.log`,
+
+						SetFlags: command.Flags(flax.MustBind, &auditVerifyArgs),
+						Run:      command.Adapt(runAuditVerify),
+					},
+					{
+						Name: "export",
+						Help: `Export a signed extract of the server's audit log.
+
+Selects entries with the same flags as "setec audit search", and writes them
+as a JSON object signed by the server, with an ed25519 key held in its
+database. An auditor holding the server's public key can check with
+"setec audit verify-export" that the export came from the server and has not
+been modified. Only entries for secrets on which the caller has "audit"
+permission are exported. For example:
+
+   setec audit export --secret='prod/*' --since=720h --output=prod.json
+
+Give auditors the server's public key, from "setec audit export-key", by a
+trusted channel. The key embedded in an export cannot establish where the
+export came from.`,
+
+						SetFlags: command.Flags(flax.MustBind, &auditFilterArgs, &auditExportArgs),
+						Run:      command.Adapt(runAuditExport),
+					},
+					{
+						Name: "export-key",
+						Help: `Print the public key with which the server signs audit log exports.
+
+The key is written in PEM form, for use with "setec audit verify-export".`,
+
+						SetFlags: command.Flags(flax.MustBind, &auditExportKeyArgs),
+						Run:      command.Adapt(runAuditExportKey),
+					},
+					{
+						Name:  "verify-export",
+						Usage: "<export-file>",
+						Help: `Check the signature of an audit log export.
+
+Checks that the export was signed by the server with the public key given by
+--public-key (as written by "setec audit export-key"), and has not been
+modified. The key is required. No server is contacted.`,
+
+						SetFlags: command.Flags(flax.MustBind, &auditVerifyExportArgs),
+						Run:      command.Adapt(runAuditVerifyExport),
+					},
+				},
+			},
+			{
+				Name: "report",
+				Help: `Report how secrets are being used.
+
+Usage statistics are derived from the reads of secrets recorded by the
+server, including those in its audit log from before it last started (see
+--usage-history in "setec help server"). Only secrets on which the caller has
+"info" permission are reported.`,
+
+				Commands: []*command.C{
+					{
+						Name: "unused",
+						Help: `List secrets that have not been read recently.
+
+Reports the secrets that no principal has read in the last --days days, which
+may no longer be needed.`,
+
+						SetFlags: command.Flags(flax.MustBind, &reportArgs),
+						Run:      command.Adapt(runReportUnused),
+					},
+					{
+						Name:  "consumers",
+						Usage: "<secret-name>",
+						Help: `List the principals that read a secret recently.
+
+Reports each principal that read the secret in the last --days days, with the
+version it last read, and the number of reads of each version. After a
+rotation, consumers still reading an old version are marked.`,
+
+						SetFlags: command.Flags(flax.MustBind, &reportArgs),
+						Run:      command.Adapt(runReportConsumers),
+					},
+				},
+			},
+			{
+				Name: "pending",
+				Help: "List pending requests for operations that require approval.",
+				Run:  command.Adapt(runPending),
+			},
+			{
+				Name:  "approve",
+				Usage: "<request-id>",
+				Help: `Approve a pending request, performing the requested operation.
+
+When the server is configured to require two-person approval, activating or
+deleting matching secrets records a pending request instead of taking effect.
+A different principal with "approve" permission for the secret must approve
+the request before it expires. You cannot approve your own requests.
+
+Use "setec pending" to list the pending requests.`,
+
+				Run: command.Adapt(runApprove),
+			},
+			{
+				Name:  "reject",
+				Usage: "<request-id>",
+				Help: `Reject a pending request without performing the requested operation.
+
+A request may be rejected by a principal with "approve" permission for the
+secret, or withdrawn by the principal who made it.`,
+
+				Run: command.Adapt(runReject),
+			},
 			command.HelpCommand(nil),
 			command.VersionCommand(),
 		},
@@ -161,18 +479,37 @@ generate the token, then re-run appending the provided value.`,
 }
 
 var serverArgs struct {
-	StateDir           string `flag:"state-dir,default=$SETEC_STATE_DIR,Server state directory"`
-	Hostname           string `flag:"hostname,default=$SETEC_HOSTNAME,Tailscale hostname to use"`
-	KMSKeyName         string `flag:"kms-key-name,default=$SETEC_KMS_KEY_NAME,Name of KMS key to use for database encryption"`
-	BackupBucket       string `flag:"backup-bucket,default=$SETEC_BACKUP_BUCKET,Name of AWS S3 bucket to use for database backups"`
-	BackupBucketRegion string `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
-	BackupRole         string `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to write backups"`
-	LoginServer        string `flag:"login-server,default=$SETEC_LOGIN_SERVER,URL of control server to use for tsnet"`
-	Dev                bool   `flag:"dev,Run in developer mode"`
+	StateDir           string        `flag:"state-dir,default=$SETEC_STATE_DIR,Server state directory"`
+	Hostname           string        `flag:"hostname,default=$SETEC_HOSTNAME,Tailscale hostname to use"`
+	KMSKeyName         string        `flag:"kms-key-name,default=$SETEC_KMS_KEY_NAME,URI of KMS key to use for database encryption"`
+	BackupBucket       string        `flag:"backup-bucket,default=$SETEC_BACKUP_BUCKET,Name of AWS S3 bucket to use for database backups"`
+	BackupBucketRegion string        `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
+	BackupRole         string        `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to write backups"`
+	BackupMaxAge       time.Duration `flag:"backup-max-age,default=$SETEC_BACKUP_MAX_AGE,How long changes may go without a backup before readiness checks report it (default 1h)"`
+	LoginServer        string        `flag:"login-server,default=$SETEC_LOGIN_SERVER,URL of control server to use for tsnet"`
+	ApprovalRequired   string        `flag:"approval-required,default=$SETEC_APPROVAL_REQUIRED,Comma-separated secret patterns for which activate and delete require approval"`
+	ApprovalExpiry     time.Duration `flag:"approval-expiry,default=$SETEC_APPROVAL_EXPIRY,How long pending approval requests remain valid (default 24h)"`
+	AuditMaxSize       int64         `flag:"audit-max-size,default=$SETEC_AUDIT_MAX_SIZE,Size in MiB at which to rotate the audit log (0 means no limit)"`
+	AuditMaxAge        time.Duration `flag:"audit-max-age,default=$SETEC_AUDIT_MAX_AGE,Interval at which to rotate the audit log (0 means no limit)"`
+	AuditRetention     time.Duration `flag:"audit-retention,default=$SETEC_AUDIT_RETENTION,How long to keep rotated audit logs (0 means forever)"`
+	AuditSyslog        bool          `flag:"audit-syslog,default=$SETEC_AUDIT_SYSLOG,Also send audit log entries to the local syslog daemon"`
+	AuditWebhook       string        `flag:"audit-webhook,default=$SETEC_AUDIT_WEBHOOK,URL to which to also POST audit log entries"`
+	UsageHistory       time.Duration `flag:"usage-history,default=$SETEC_USAGE_HISTORY,Period of the audit log from which to load usage statistics (0 means 720h)"`
+	RateLimit          float64       `flag:"rate-limit,default=$SETEC_RATE_LIMIT,Calls per second each caller may make to each API method (0 means no limit)"`
+	RateBurst          int           `flag:"rate-burst,default=$SETEC_RATE_BURST,Calls each caller may make to each API method in a burst (0 means the rate)"`
+	ExternalAddr       string        `flag:"external-addr,default=$SETEC_EXTERNAL_ADDR,Address on which to also serve the API outside the tailnet"`
+	ExternalCert       string        `flag:"external-cert,default=$SETEC_EXTERNAL_CERT,Path of the PEM TLS certificate for --external-addr"`
+	ExternalKey        string        `flag:"external-key,default=$SETEC_EXTERNAL_KEY,Path of the PEM TLS key for --external-addr"`
+	ClientCA           string        `flag:"client-ca,default=$SETEC_CLIENT_CA,Path of PEM CA certificates for client certificates on --external-addr"`
+	CertACL            string        `flag:"cert-acl,default=$SETEC_CERT_ACL,Path of the JSON file granting permissions to client certificates"`
+	TokenFile          string        `flag:"token-file,default=$SETEC_TOKEN_FILE,Path of the JSON file of static bearer tokens"`
+	RotationPolicy     string        `flag:"rotation-policy,default=$SETEC_ROTATION_POLICY,Path of the JSON file of rotation policies"`
+	Dev                bool          `flag:"dev,Run in developer mode"`
 }
 
 var clientArgs struct {
-	Server string `flag:"s,default=$SETEC_SERVER,Server address"`
+	Server        string `flag:"s,default=$SETEC_SERVER,Server address"`
+	Justification string `flag:"justification,Reason for the request, recorded in the audit log (required for break-glass access)"`
 }
 
 func runServer(env *command.Env) error {
@@ -208,16 +545,15 @@ func runServer(env *command.Env) error {
 		if serverArgs.KMSKeyName == "" {
 			return errors.New("--kms-key-name must be specified")
 		}
-		// Tink requires prefixing the key identifier with a URI
-		// scheme that identifies the correct backend to use.
-		uri := "aws-kms://" + serverArgs.KMSKeyName
-		kmsClient, err := awskms.NewClientWithOptions(uri)
-		if err != nil {
-			return fmt.Errorf("creating AWS KMS client: %v", err)
+		// For compatibility, a bare key name is an AWS KMS key ARN.
+		uri := serverArgs.KMSKeyName
+		if !strings.Contains(uri, "://") {
+			uri = "aws-kms://" + uri
 		}
-		kek, err = kmsClient.GetAEAD(uri)
+		var err error
+		kek, err = kms.Open(env.Context(), uri)
 		if err != nil {
-			return fmt.Errorf("getting KMS key handle: %v", err)
+			return fmt.Errorf("opening KMS key: %w", err)
 		}
 	}
 
@@ -246,20 +582,83 @@ func runServer(env *command.Env) error {
 	mux := http.NewServeMux()
 	tsweb.Debugger(mux)
 
-	audit, err := audit.NewFile(filepath.Join(serverArgs.StateDir, "audit.log"))
+	audit, err := audit.NewRotatingFile(filepath.Join(serverArgs.StateDir, "audit.log"), audit.RotateOptions{
+		MaxSize:   serverArgs.AuditMaxSize << 20,
+		MaxAge:    serverArgs.AuditMaxAge,
+		Retention: serverArgs.AuditRetention,
+		OnError:   reportAuditRotationError,
+	})
 	if err != nil {
 		return fmt.Errorf("opening audit log: %w", err)
 	}
+	defer audit.Close()
+	auditKey, err := loadAuditKey(filepath.Join(serverArgs.StateDir, "audit-key.pem"))
+	if err != nil {
+		return fmt.Errorf("loading audit signing key: %w", err)
+	}
+	audit.SignCheckpoints(auditKey, 0)
+	if err := addAuditSinks(audit); err != nil {
+		return err
+	}
+
+	var approval *db.ApprovalPolicy
+	if serverArgs.ApprovalRequired != "" {
+		approval = &db.ApprovalPolicy{Expiry: serverArgs.ApprovalExpiry}
+		rule := acl.Rule{Action: []acl.Action{acl.ActionActivate, acl.ActionDelete}}
+		for _, pat := range strings.Split(serverArgs.ApprovalRequired, ",") {
+			rule.Secret = append(rule.Secret, acl.Secret(strings.TrimSpace(pat)))
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("invalid --approval-required: %w", err)
+		}
+		approval.Rules = acl.Rules{rule}
+	}
+
+	var rateLimits map[string]server.RateLimit
+	if serverArgs.RateLimit > 0 {
+		burst := serverArgs.RateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(serverArgs.RateLimit))
+		}
+		rateLimits = map[string]server.RateLimit{
+			server.DefaultRateLimit: {Rate: serverArgs.RateLimit, Burst: burst},
+		}
+	}
+
+	identity, err := serverIdentity(lc.WhoIs)
+	if err != nil {
+		return err
+	}
+
+	var rotation []db.RotationPolicy
+	if serverArgs.RotationPolicy != "" {
+		rotation, err = server.LoadRotationPolicies(serverArgs.RotationPolicy)
+		if err != nil {
+			return fmt.Errorf("loading --rotation-policy: %w", err)
+		}
+	}
 
 	srv, err := server.New(env.Context(), server.Config{
 		DBPath:             filepath.Join(serverArgs.StateDir, "database"),
 		Key:                kek,
 		AuditLog:           audit,
-		WhoIs:              lc.WhoIs,
+		Identity:           identity,
 		BackupBucket:       serverArgs.BackupBucket,
 		BackupBucketRegion: serverArgs.BackupBucketRegion,
 		BackupAssumeRole:   serverArgs.BackupRole,
-		Mux:                mux,
+		BackupMaxAge:       serverArgs.BackupMaxAge,
+		TailscaleState: func(ctx context.Context) (string, error) {
+			st, err := lc.StatusWithoutPeers(ctx)
+			if err != nil {
+				return "", err
+			}
+			return st.BackendState, nil
+		},
+		Approval:         approval,
+		UsageHistory:     serverArgs.UsageHistory,
+		RateLimits:       rateLimits,
+		RotationPolicies: rotation,
+		Mux:              mux,
 	})
 	if err != nil {
 		return fmt.Errorf("initializing setec server: %v", err)
@@ -280,6 +679,12 @@ func runServer(env *command.Env) error {
 		}
 	}()
 
+	if serverArgs.ExternalAddr != "" {
+		if err := serveExternal(env.Context(), mux); err != nil {
+			return err
+		}
+	}
+
 	l, err := s.ListenTLS("tcp", ":443")
 	if err != nil {
 		return fmt.Errorf("creating TLS listener: %v", err)
@@ -300,11 +705,100 @@ func runServer(env *command.Env) error {
 	return nil
 }
 
+// serverIdentity returns the identity provider for the server, accepting
+// the credentials configured by the server flags as well as tailnet
+// identities.
+func serverIdentity(whois func(context.Context, string) (*apitype.WhoIsResponse, error)) (server.IdentityProvider, error) {
+	var providers []server.IdentityProvider
+	if serverArgs.TokenFile != "" {
+		tokens, err := server.LoadTokens(serverArgs.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading --token-file: %w", err)
+		}
+		providers = append(providers, server.TokenIdentity{Tokens: tokens})
+	}
+	if serverArgs.ClientCA != "" {
+		if serverArgs.CertACL == "" {
+			return nil, errors.New("--cert-acl must be specified with --client-ca")
+		}
+		certACL, err := server.LoadCertACL(serverArgs.CertACL)
+		if err != nil {
+			return nil, fmt.Errorf("loading --cert-acl: %w", err)
+		}
+		providers = append(providers, server.CertIdentity{ACL: certACL})
+	}
+	providers = append(providers, server.TailscaleIdentity{WhoIs: whois})
+	return server.ChainIdentity(providers...), nil
+}
+
+// serveExternal serves the API methods of mux over TLS on the
+// --external-addr, for callers outside the tailnet.
+func serveExternal(ctx context.Context, mux *http.ServeMux) error {
+	if serverArgs.ExternalCert == "" || serverArgs.ExternalKey == "" {
+		return errors.New("--external-cert and --external-key must be specified with --external-addr")
+	}
+	cert, err := tls.LoadX509KeyPair(serverArgs.ExternalCert, serverArgs.ExternalKey)
+	if err != nil {
+		return fmt.Errorf("loading external TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if serverArgs.ClientCA != "" {
+		bs, err := os.ReadFile(serverArgs.ClientCA)
+		if err != nil {
+			return fmt.Errorf("reading --client-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("no certificates found in --client-ca %q", serverArgs.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	l, err := tls.Listen("tcp", serverArgs.ExternalAddr, cfg)
+	if err != nil {
+		return fmt.Errorf("creating external listener: %w", err)
+	}
+	ext := http.NewServeMux()
+	ext.Handle("/api/", mux)
+	hs := &http.Server{Handler: ext}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	go func() {
+		if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("serving external API: %v", err)
+		}
+	}()
+	log.Printf("Serving the API outside the tailnet on %s", l.Addr())
+	return nil
+}
+
 func newClient() (*setec.Client, error) {
 	if clientArgs.Server == "" {
 		return nil, errors.New("no server address is set")
 	}
-	return &setec.Client{Server: clientArgs.Server}, nil
+	return &setec.Client{
+		Server:        clientArgs.Server,
+		Justification: clientArgs.Justification,
+		Token:         os.Getenv("SETEC_TOKEN"),
+	}, nil
+}
+
+var listArgs struct {
+	Prefix   string `flag:"prefix,List only secrets whose names have this prefix"`
+	Glob     string `flag:"glob,List only secrets whose names match this pattern"`
+	PageSize int    `flag:"page-size,default=500,Fetch this many secrets per request (0 means all at once)"`
+	JSON     bool   `flag:"json,Print the secrets as JSON"`
+}
+
+func runCreateKEK(env *command.Env, uri string) error {
+	if err := kms.CreateFile(uri); err != nil {
+		return err
+	}
+	fmt.Printf("Created key %s\n", uri)
+	return nil
 }
 
 func runList(env *command.Env) error {
@@ -313,10 +807,17 @@ func runList(env *command.Env) error {
 		return err
 	}
 
-	secrets, err := c.List(env.Context())
+	secrets, err := c.ListMatching(env.Context(), api.ListRequest{
+		Prefix: listArgs.Prefix,
+		Glob:   listArgs.Glob,
+		Limit:  listArgs.PageSize,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to list secrets: %v", err)
 	}
+	if listArgs.JSON {
+		return json.NewEncoder(os.Stdout).Encode(secrets)
+	}
 
 	tw := newTabWriter(os.Stdout)
 	io.WriteString(tw, "NAME\tACTIVE\tVERSIONS\n")
@@ -463,6 +964,32 @@ func runPut(env *command.Env, name string) error {
 	return nil
 }
 
+var generateArgs struct {
+	Type      string `flag:"type,default=password,Kind of value to generate"`
+	Length    int    `flag:"length,Length of generated passwords and bytes (default 32)"`
+	Algorithm string `flag:"algorithm,Curve or keyset template of generated keys"`
+}
+
+func runGenerate(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	ver, err := c.Generate(env.Context(), name, api.GenerateSpec{
+		Type:      generateArgs.Type,
+		Length:    generateArgs.Length,
+		Algorithm: generateArgs.Algorithm,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate secret: %w", err)
+	}
+	fmt.Printf("Secret generated as %q, version %d\n", name, ver)
+	if ver != 1 {
+		fmt.Printf("  To activate this version, run 'setec activate %q %d'\n", name, ver)
+	}
+	return nil
+}
+
 func runActivate(env *command.Env, name, versionString string) error {
 	c, err := newClient()
 	if err != nil {
@@ -475,7 +1002,7 @@ func runActivate(env *command.Env, name, versionString string) error {
 	}
 
 	if err := c.Activate(env.Context(), name, api.SecretVersion(version)); err != nil {
-		return fmt.Errorf("failed to set active version: %w", err)
+		return fmt.Errorf("failed to set active version: %w", checkApproval(err))
 	}
 
 	return nil
@@ -500,7 +1027,7 @@ func runDeleteVersion(env *command.Env, name, versionString string, rest ...stri
 		return err
 	}
 	if err := c.DeleteVersion(env.Context(), name, api.SecretVersion(version)); err != nil {
-		return fmt.Errorf("failed to delete secret %q version %d: %w", name, version, err)
+		return fmt.Errorf("failed to delete secret %q version %d: %w", name, version, checkApproval(err))
 	}
 	return nil
 }
@@ -520,11 +1047,198 @@ func runDeleteSecret(env *command.Env, name string, rest ...string) error {
 		return err
 	}
 	if err := c.Delete(env.Context(), name); err != nil {
-		return fmt.Errorf("failed to delete secret %q: %w", name, err)
+		return fmt.Errorf("failed to delete secret %q: %w", name, checkApproval(err))
+	}
+	return nil
+}
+
+// checkApproval reports whether err indicates that an operation requires
+// approval. If so, it returns an error explaining how to get approval;
+// otherwise it returns err unmodified.
+func checkApproval(err error) error {
+	var areq *api.ApprovalRequiredError
+	if !errors.As(err, &areq) {
+		return err
+	}
+	return fmt.Errorf("approval required, request %s is pending until %s\n"+
+		"  Another operator must run 'setec approve %s'\n"+
+		"  (pending requests are discarded if the server restarts)",
+		areq.Request.ID, areq.Request.Expires.Local().Format(time.DateTime), areq.Request.ID)
+}
+
+func runPending(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	reqs, err := c.ListPending(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to list pending requests: %v", err)
+	}
+
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "ID\tACTION\tSECRET\tVERSION\tREQUESTER\tEXPIRES\n")
+	for _, r := range reqs {
+		ver := "all"
+		if r.Version != 0 {
+			ver = r.Version.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Action, r.Name, ver, r.Requester,
+			r.Expires.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func runApprove(env *command.Env, id string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Approve(env.Context(), id); err != nil {
+		return fmt.Errorf("failed to approve request %q: %w", id, err)
 	}
 	return nil
 }
 
+func runReject(env *command.Env, id string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Reject(env.Context(), id); err != nil {
+		return fmt.Errorf("failed to reject request %q: %w", id, err)
+	}
+	return nil
+}
+
+func runWhoAmI(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	who, err := c.WhoAmI(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "Hostname:\t%s\n", who.Hostname)
+	fmt.Fprintf(tw, "IP:\t%s\n", who.IP)
+	if who.User != "" {
+		fmt.Fprintf(tw, "User:\t%s\n", who.User)
+	}
+	if len(who.Tags) != 0 {
+		fmt.Fprintf(tw, "Tags:\t%s\n", strings.Join(who.Tags, ", "))
+	}
+	if len(who.Permissions) == 0 {
+		fmt.Fprintf(tw, "Permissions:\t(none)\n")
+	}
+	for i, r := range who.Permissions {
+		acts := make([]string, len(r.Action))
+		for j, a := range r.Action {
+			acts[j] = string(a)
+		}
+		secs := make([]string, len(r.Secret))
+		for j, s := range r.Secret {
+			secs[j] = string(s)
+		}
+		fmt.Fprintf(tw, "Rule %d:\t%s on %s\n", i, strings.Join(acts, ","), strings.Join(secs, ","))
+	}
+	return tw.Flush()
+}
+
+func runCan(env *command.Env, action, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	rsp, err := c.Check(env.Context(), acl.Action(action), name)
+	if err != nil {
+		return fmt.Errorf("failed to check access: %w", err)
+	}
+	if rsp.BreakGlass {
+		fmt.Printf("break-glass: %s\n", rsp.Reason)
+		fmt.Println("  Access requires a --justification, and will be recorded for review")
+		return nil
+	} else if !rsp.Allowed {
+		return fmt.Errorf("denied: %s", rsp.Reason)
+	}
+	fmt.Printf("allowed: %s\n", rsp.Reason)
+	return nil
+}
+
+func runACLLint(env *command.Env, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	nrules, errs := lintPolicy(data)
+	for _, err := range errs {
+		fmt.Fprintf(env, "%s: %v\n", path, err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("found %d problems in %d rules", len(errs), nrules)
+	}
+	fmt.Printf("%s: %d rules OK\n", path, nrules)
+	return nil
+}
+
+// lintPolicy checks the setec access rules in a policy file, which is either
+// a tailnet policy file containing grants, or a plain JSON array of rules. It
+// returns the number of rules found and a list of problems.
+func lintPolicy(data []byte) (int, []error) {
+	std, err := hujson.Standardize(data)
+	if err != nil {
+		return 0, []error{fmt.Errorf("parsing policy: %w", err)}
+	}
+
+	type labeled struct {
+		where string
+		raw   json.RawMessage
+	}
+	var rules []labeled
+	if t := bytes.TrimSpace(std); len(t) != 0 && t[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(std, &raw); err != nil {
+			return 0, []error{fmt.Errorf("parsing rules: %w", err)}
+		}
+		for i, r := range raw {
+			rules = append(rules, labeled{fmt.Sprintf("rule %d", i), r})
+		}
+	} else {
+		var pol struct {
+			Grants []struct {
+				App map[string][]json.RawMessage `json:"app"`
+			} `json:"grants"`
+		}
+		if err := json.Unmarshal(std, &pol); err != nil {
+			return 0, []error{fmt.Errorf("parsing policy: %w", err)}
+		}
+		for i, g := range pol.Grants {
+			for _, capName := range []string{string(server.ACLCap), "https://" + string(server.ACLCap)} {
+				for j, r := range g.App[capName] {
+					rules = append(rules, labeled{fmt.Sprintf("grant %d rule %d", i, j), r})
+				}
+			}
+		}
+	}
+
+	var errs []error
+	for _, r := range rules {
+		var rule acl.Rule
+		dec := json.NewDecoder(bytes.NewReader(r.raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rule); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.where, err))
+		} else if err := rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.where, err))
+		}
+	}
+	return len(rules), errs
+}
+
 // newConfirmationToken returns a nonce "token" that must be supplied to
 // perform a dangerous operation like deleting a secret or secret value.
 // The token is not a security feature, it is just a request digest with a
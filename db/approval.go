@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+	"tailscale.com/util/multierr"
+)
+
+// DefaultApprovalExpiry is the length of time a pending request remains valid
+// if an ApprovalPolicy does not specify one.
+const DefaultApprovalExpiry = 24 * time.Hour
+
+// MaxPendingPerPrincipal is the largest number of unexpired pending requests
+// a single principal may have at once.
+const MaxPendingPerPrincipal = 32
+
+var (
+	// ErrSelfApproval is the error returned by Approve when the caller is the
+	// principal who made the request.
+	ErrSelfApproval = errors.New("cannot approve own request")
+	// ErrTooManyPending is the error returned when an operation requires
+	// approval, but the caller already has MaxPendingPerPrincipal pending
+	// requests.
+	ErrTooManyPending = errors.New("too many pending requests")
+)
+
+// ApprovalPolicy selects operations that require two-person approval.
+//
+// When an operation requires approval, the database does not perform it
+// immediately. Instead it records a pending request, and reports an
+// *api.ApprovalRequiredError to the caller. The operation takes effect when a
+// different principal with acl.ActionApprove permission for the secret
+// approves the request.
+//
+// Only activation and deletion are subject to approval.
+//
+// Pending requests are held in memory only: they do not survive a restart
+// of the server, after which the operations must be requested again.
+type ApprovalPolicy struct {
+	// Rules select the operations that require approval: An operation
+	// requires approval if any of the rules allows its action on its secret.
+	// Rules naming actions other than acl.ActionActivate and acl.ActionDelete
+	// have no effect.
+	Rules acl.Rules
+
+	// Expiry is how long a pending request remains valid before it lapses.
+	// If zero, DefaultApprovalExpiry is used.
+	Expiry time.Duration
+}
+
+func (p ApprovalPolicy) expiry() time.Duration {
+	if p.Expiry <= 0 {
+		return DefaultApprovalExpiry
+	}
+	return p.Expiry
+}
+
+// SetApprovalPolicy replaces the approval policy for db. Requests that are
+// already pending are not affected. An empty policy means no operations
+// require approval, which is the default.
+func (db *DB) SetApprovalPolicy(p ApprovalPolicy) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.approval = p
+}
+
+// principalKey returns a string identifying the principal for the purposes
+// of two-person approval. A human user is identified by login name across all
+// their devices; a tagged device is identified by its node name.
+func principalKey(p audit.Principal) string {
+	if p.User != "" {
+		return "user:" + p.User
+	}
+	return "node:" + p.Hostname
+}
+
+// authorizeOrDefer is as authorize, but if the approval policy for db
+// requires approval for action on secret and the caller is otherwise
+// authorized, it records a pending request and returns an error describing
+// it. If the caller has already requested the same operation, and that
+// request is still pending, the existing request is reported instead of
+// recording another. The caller must not perform the requested operation if
+// an error is returned.
+func (db *DB) authorizeOrDefer(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) (breakGlass bool, err error) {
+	db.mu.Lock()
+	need := db.approval.Rules.Allow(action, secret)
+	db.mu.Unlock()
+	breakGlass, err = db.authorize(caller, action, secret, secretVersion)
+	if err != nil || !need {
+		return breakGlass, err
+	}
+
+	now := time.Now().UTC()
+	requester := principalKey(caller.Principal)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pruneExpiredLocked()
+	e := caller.entry(action, secret, secretVersion, true, breakGlass)
+
+	var n int // the number of requests pending for requester
+	for _, op := range db.pending {
+		if op.Requester != requester {
+			continue
+		}
+		if op.Action == action && op.Name == secret && op.Version == secretVersion {
+			e.Approval = &audit.Approval{ID: op.ID, Action: action, State: "pending"}
+			if err := db.writeEntry(e); err != nil {
+				return false, err
+			}
+			req := *op
+			return false, &api.ApprovalRequiredError{Request: &req}
+		}
+		n++
+	}
+	if n >= MaxPendingPerPrincipal {
+		e.Outcome = audit.OutcomeError
+		if err := db.writeEntry(e); err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("%w: %s has %d", ErrTooManyPending, requester, n)
+	}
+
+	op := &api.PendingRequest{
+		ID:        rand.Text(),
+		Action:    action,
+		Name:      secret,
+		Version:   secretVersion,
+		Requester: requester,
+		Created:   now,
+		Expires:   now.Add(db.approval.expiry()),
+	}
+	e.Approval = &audit.Approval{ID: op.ID, Action: action, State: "pending"}
+	if err := db.writeEntry(e); err != nil {
+		return false, err
+	}
+	db.pending[op.ID] = op
+	req := *op
+	return false, &api.ApprovalRequiredError{Request: &req}
+}
+
+// pruneExpiredLocked discards pending requests that have expired.
+func (db *DB) pruneExpiredLocked() {
+	now := time.Now()
+	maps.DeleteFunc(db.pending, func(_ string, op *api.PendingRequest) bool {
+		return now.After(op.Expires)
+	})
+}
+
+// ListPending returns the pending approval requests for secrets on which the
+// caller has acl.ActionApprove or acl.ActionInfo permission.
+func (db *DB) ListPending(caller Caller) ([]*api.PendingRequest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// As with List, record a single audit entry for the listing rather than
+	// one per request.
+	e := caller.entry(acl.ActionApprove, "", 0, true, false)
+	e.Outcome = audit.OutcomeOK
+	if err := db.writeEntry(e); err != nil {
+		return nil, err
+	}
+
+	db.pruneExpiredLocked()
+	var ret []*api.PendingRequest
+	for _, op := range db.pending {
+		if caller.Permissions.Allow(acl.ActionApprove, op.Name) || caller.Permissions.Allow(acl.ActionInfo, op.Name) {
+			req := *op
+			ret = append(ret, &req)
+		}
+	}
+	slices.SortFunc(ret, func(a, b *api.PendingRequest) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return ret, nil
+}
+
+// lookupPending returns the unexpired pending request with the given ID.
+func (db *DB) lookupPending(id string) (*api.PendingRequest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pruneExpiredLocked()
+	op, ok := db.pending[id]
+	if !ok {
+		return nil, fmt.Errorf("request %q: %w", id, ErrNotFound)
+	}
+	return op, nil
+}
+
+// Approve approves the pending request with the given ID, and performs the
+// requested operation. The caller must have acl.ActionApprove permission for
+// the secret, and must not be the principal who made the request.
+//
+// The request is consumed whether or not the operation succeeds.
+//
+// Access requirement: "approve"
+func (db *DB) Approve(caller Caller, id string) error {
+	op, err := db.lookupPending(id)
+	if err != nil {
+		return err
+	}
+	if err := db.authorizeApproval(caller, op); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.pending[id]; !ok {
+		return fmt.Errorf("request %q: %w", id, ErrNotFound) // lost a race
+	}
+	delete(db.pending, id)
+	e := caller.entry(acl.ActionApprove, op.Name, op.Version, true, false)
+	e.Approval = &audit.Approval{ID: op.ID, Action: op.Action, State: "approved"}
+	_, err = db.mutateLocked(e, op.Name, func() (api.SecretVersion, error) {
+		switch op.Action {
+		case acl.ActionActivate:
+			return op.Version, db.activateLocked(op.Name, op.Version)
+		case acl.ActionDelete:
+			if op.Version == 0 {
+				return 0, db.deleteLocked(op.Name)
+			}
+			return op.Version, db.deleteVersionLocked(op.Name, op.Version)
+		default:
+			return 0, fmt.Errorf("unexpected action %q in pending request", op.Action)
+		}
+	})
+	if err != nil && errors.Is(err, errAuditWrite) {
+		db.pending[id] = op // the approval did not take effect
+	}
+	return err
+}
+
+// Reject discards the pending request with the given ID without performing
+// the requested operation. The caller must either have acl.ActionApprove
+// permission for the secret, or be the principal who made the request.
+//
+// Access requirement: "approve", or the original requester.
+func (db *DB) Reject(caller Caller, id string) error {
+	op, err := db.lookupPending(id)
+	if err != nil {
+		return err
+	}
+	// The requester may always withdraw their own request.
+	action := op.Action
+	if principalKey(caller.Principal) != op.Requester {
+		if err := db.authorizeApproval(caller, op); err != nil {
+			return err
+		}
+		action = acl.ActionApprove
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.pending[id]; !ok {
+		return fmt.Errorf("request %q: %w", id, ErrNotFound) // lost a race
+	}
+	e := caller.entry(action, op.Name, op.Version, true, false)
+	e.Approval = &audit.Approval{ID: op.ID, Action: op.Action, State: "rejected"}
+	e.Outcome = audit.OutcomeOK
+	if err := db.writeEntry(e); err != nil {
+		return err
+	}
+	delete(db.pending, id)
+	return nil
+}
+
+// authorizeApproval verifies that caller may approve or reject op. If not,
+// it writes an audit log entry recording the denial, and reports an error.
+func (db *DB) authorizeApproval(caller Caller, op *api.PendingRequest) error {
+	var errs []error
+	if !caller.Permissions.Allow(acl.ActionApprove, op.Name) {
+		errs = append(errs, ErrAccessDenied)
+	} else if principalKey(caller.Principal) == op.Requester {
+		errs = append(errs, ErrSelfApproval)
+	} else {
+		return nil
+	}
+	e := caller.entry(acl.ActionApprove, op.Name, op.Version, false, false)
+	e.Approval = &audit.Approval{ID: op.ID, Action: op.Action, State: "pending"} // unchanged
+	if err := db.writeEntry(e); err != nil {
+		errs = append(errs, err)
+	}
+	return multierr.New(errs...)
+}
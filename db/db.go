@@ -18,15 +18,18 @@ package db
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/types/api"
 	"github.com/tink-crypto/tink-go/v2/tink"
+	"tailscale.com/metrics"
 	"tailscale.com/util/multierr"
 )
 
@@ -35,6 +38,22 @@ type DB struct {
 	mu       sync.Mutex
 	kv       *kv
 	auditLog *audit.Writer
+	approval ApprovalPolicy
+	pending  map[string]*api.PendingRequest // :: request ID → pending request
+
+	countBreakGlass  expvar.Int         // accesses authorized by break-glass rules
+	countNotModified expvar.Int         // unaudited conditional gets that found no change
+	saveTime         *metrics.Histogram // durations of database saves
+	auditWriteTime   *metrics.Histogram // durations of audit log writes
+
+	healthMu sync.Mutex
+	auditOK  time.Time // when an audit log entry was last written
+	auditErr error     // the error from the last audit log write, or nil
+
+	usage      map[string]*secretUsage // :: secret name → usage
+	usageSince time.Time               // when usage was first recorded
+
+	changed chan struct{} // if non-nil, closed when the database changes
 }
 
 // We might store some of setec's configuration in the secrets
@@ -43,6 +62,10 @@ type DB struct {
 // internal use.
 const configPrefix = "_internal/"
 
+// isInternal reports whether name is reserved for internal use. Secrets with
+// such names are never revealed to callers, whatever their permissions.
+func isInternal(name string) bool { return strings.HasPrefix(name, configPrefix) }
+
 var (
 	// ErrAccessDenied is the error returned by DB methods when the
 	// caller lacks necessary permissions.
@@ -57,6 +80,12 @@ var (
 	// ErrInvalidVersion indicates that an attempt was made to create a
 	// version of a secret using an invalid version number (<=0).
 	ErrInvalidVersion = errors.New("invalid version")
+	// ErrActiveVersion indicates that an attempt was made to delete the
+	// active version of a secret.
+	ErrActiveVersion = errors.New("cannot delete active version")
+	// ErrInvalidRequest indicates that a request was malformed, for example
+	// by giving an empty secret name.
+	ErrInvalidRequest = errors.New("invalid request")
 )
 
 // Open loads the secrets database at path, decrypting it using key.
@@ -74,43 +103,168 @@ func Open(path string, key tink.AEAD, auditLog *audit.Writer) (*DB, error) {
 	ret := &DB{
 		kv:       kv,
 		auditLog: auditLog,
+		pending:  make(map[string]*api.PendingRequest),
+
+		usage:      make(map[string]*secretUsage),
+		usageSince: time.Now(),
+
+		saveTime:       metrics.NewHistogram(durationBuckets),
+		auditWriteTime: metrics.NewHistogram(durationBuckets),
 	}
+	kv.saveTime = ret.saveTime
 
 	return ret, nil
 }
 
 // Caller encapsulates a caller identity. It is required by all database
-// methods. The contents of Caller should be derived from a tailsale WhoIs
-// API call.
+// methods. The contents of Caller should be derived from the caller's
+// credentials, such as the result of a Tailscale WhoIs API call.
 type Caller struct {
 	// Principal is the caller identity that gets written to audit
 	// logs.
 	Principal audit.Principal
 	// Permissions are the permissions the caller has.
 	Permissions acl.Rules
+	// Justification is the reason the caller gave for the request, if
+	// any. It is recorded in the audit log, and is required for access
+	// granted by break-glass rules.
+	Justification string
+	// Request, if non-nil, describes the API request on whose behalf the
+	// caller is acting, and is recorded in the audit log.
+	Request *audit.Request
 }
 
-// checkAndLog verifies that caller can perform action on secret, and
-// writes an appropriate audit log entry.
-// The caller must not perform the requested operation if an error is
-// returned.
-func (db *DB) checkAndLog(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) error {
-	var errs []error
-	authorized := caller.Permissions.Allow(action, secret)
-	if !authorized {
-		errs = append(errs, ErrAccessDenied)
+// allow reports whether the caller may perform action on secret, and
+// whether that access is granted only by a break-glass rule.
+func (c Caller) allow(action acl.Action, secret string) (authorized, breakGlass bool) {
+	if c.Permissions.Allow(action, secret) {
+		return true, false
+	}
+	if c.Justification != "" && c.Permissions.AllowBreakGlass(action, secret) {
+		return true, true
 	}
-	err := db.auditLog.WriteEntries(&audit.Entry{
-		Principal:     caller.Principal,
+	return false, false
+}
+
+// entry returns an audit entry for caller performing action on secret,
+// recording the caller's justification and any use of break-glass access.
+func (c Caller) entry(action acl.Action, secret string, secretVersion api.SecretVersion, authorized, breakGlass bool) *audit.Entry {
+	e := &audit.Entry{
+		Principal:     c.Principal,
 		Action:        action,
 		Secret:        secret,
 		SecretVersion: secretVersion,
 		Authorized:    authorized,
-	})
+		Justification: c.Justification,
+		BreakGlass:    breakGlass,
+		Request:       c.Request,
+	}
+	if breakGlass {
+		e.Severity = audit.SeverityHigh
+	}
+	return e
+}
+
+// outcome returns the audit outcome for an operation that reported err.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return audit.OutcomeOK
+	case errors.Is(err, ErrNotFound):
+		return audit.OutcomeNotFound
+	case errors.Is(err, api.ErrValueNotChanged):
+		return audit.OutcomeNotModified
+	default:
+		return audit.OutcomeError
+	}
+}
+
+// writeEntry writes e to the audit log.
+func (db *DB) writeEntry(e *audit.Entry) error {
+	if e.Authorized && e.BreakGlass {
+		db.countBreakGlass.Add(1)
+	}
+	start := time.Now()
+	err := db.auditLog.WriteEntries(e)
+	db.auditWriteTime.Observe(time.Since(start).Seconds())
+	db.recordAuditWrite(start, err)
 	if err != nil {
-		errs = append(errs, fmt.Errorf("writing audit log: %w", err))
+		return fmt.Errorf("%w: %w", errAuditWrite, err)
+	}
+	return nil
+}
+
+// errAuditWrite is reported, wrapped, when an audit log entry cannot be
+// written.
+var errAuditWrite = errors.New("writing audit log")
+
+// authorize verifies that caller can perform action on secret, and reports
+// whether access is granted only by a break-glass rule. If the caller is not
+// authorized, authorize writes an audit entry recording the denial, and
+// reports an error wrapping ErrAccessDenied.
+//
+// The caller must not perform the requested operation if an error is
+// returned, and must record the outcome of the operation with an audit entry
+// if not.
+func (db *DB) authorize(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) (breakGlass bool, err error) {
+	authorized, breakGlass := caller.allow(action, secret)
+	if authorized {
+		return breakGlass, nil
+	}
+	var errs []error
+	errs = append(errs, ErrAccessDenied)
+	if err := db.writeEntry(caller.entry(action, secret, secretVersion, false, false)); err != nil {
+		errs = append(errs, err)
+	}
+	return false, multierr.New(errs...)
+}
+
+// readLocked performs an authorized read operation and records its outcome
+// in e. The result of the read is not reported unless the audit entry is
+// written. Internal secrets are reported as not found. db.mu must be held.
+func readLocked[T any](db *DB, e *audit.Entry, read func() (T, api.SecretVersion, error)) (T, error) {
+	var v T
+	var version api.SecretVersion
+	var err error
+	if isInternal(e.Secret) {
+		err = ErrNotFound
+	} else {
+		v, version, err = read()
+	}
+	e.Outcome = outcome(err)
+	if version != 0 {
+		e.SecretVersion = version
+	}
+	if lerr := db.writeEntry(e); lerr != nil {
+		var zero T
+		return zero, lerr
+	}
+	db.recordUsageLocked(e)
+	return v, err
+}
+
+// mutateLocked performs an authorized operation that modifies the secret
+// called name, and records its outcome in e. If the audit entry cannot be
+// written, the modification is reverted. db.mu must be held.
+func (db *DB) mutateLocked(e *audit.Entry, name string, mutate func() (api.SecretVersion, error)) (api.SecretVersion, error) {
+	restore := db.kv.snapshot(name)
+	version, err := mutate()
+	e.Outcome = outcome(err)
+	if version != 0 {
+		e.SecretVersion = version
+	}
+	if lerr := db.writeEntry(e); lerr != nil {
+		if err == nil {
+			if rerr := restore(); rerr != nil {
+				lerr = errors.Join(lerr, fmt.Errorf("reverting change: %w", rerr))
+			}
+		}
+		return 0, lerr
+	}
+	if err == nil {
+		db.notifyLocked()
 	}
-	return multierr.New(errs...)
+	return version, err
 }
 
 // Path returns the path to the database file on disk.
@@ -130,9 +284,13 @@ func (db *DB) WriteGen() uint64 {
 	return db.kv.writeGen()
 }
 
-// List returns secret metadata for all secrets on which at least one
-// member of 'from' has acl.ActionInfo permissions.
-func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
+// BreakGlassCount returns a counter of accesses to db that were authorized
+// only by break-glass rules.
+func (db *DB) BreakGlassCount() *expvar.Int { return &db.countBreakGlass }
+
+// List returns secret metadata for the secrets selected by req on which at
+// least one member of 'from' has acl.ActionInfo permissions, in order by name.
+func (db *DB) List(caller Caller, req api.ListRequest) ([]*api.SecretInfo, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -144,87 +302,124 @@ func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
 	// to reflect that List took place, then do per-secret permission
 	// checks to construct the response without generating individual
 	// audit entries there.
-	err := db.auditLog.WriteEntries(&audit.Entry{
-		Principal:  caller.Principal,
-		Action:     acl.ActionInfo,
-		Authorized: true,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("writing audit log: %w", err)
+	e := caller.entry(acl.ActionInfo, "", 0, true, false)
+	e.Outcome = audit.OutcomeOK
+	if err := db.writeEntry(e); err != nil {
+		return nil, err
 	}
 
 	var ret []*api.SecretInfo
+	var names []string
 	for _, name := range db.kv.list() {
-		if !caller.Permissions.Allow(acl.ActionInfo, name) {
+		if isInternal(name) || !caller.Permissions.Allow(acl.ActionInfo, name) {
+			continue
+		} else if !strings.HasPrefix(name, req.Prefix) || name <= req.After {
+			continue
+		} else if req.Glob != "" && !acl.Secret(req.Glob).Match(name) {
 			continue
 		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if req.Limit > 0 && len(names) > req.Limit {
+		names = names[:req.Limit]
+	}
+	for _, name := range names {
 		info, err := db.kv.info(name)
 		if err != nil {
 			return nil, err
 		}
 		ret = append(ret, info)
 	}
-	slices.SortFunc(ret, func(a, b *api.SecretInfo) int { return strings.Compare(a.Name, b.Name) })
 	return ret, nil
 }
 
 // Info returns metadata for the given secret.
 func (db *DB) Info(caller Caller, name string) (*api.SecretInfo, error) {
-	if err := db.checkAndLog(caller, acl.ActionInfo, name, 0); err != nil {
+	breakGlass, err := db.authorize(caller, acl.ActionInfo, name, 0)
+	if err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.info(name)
+	e := caller.entry(acl.ActionInfo, name, 0, true, breakGlass)
+	return readLocked(db, e, func() (*api.SecretInfo, api.SecretVersion, error) {
+		info, err := db.kv.info(name)
+		return info, 0, err
+	})
 }
 
 // Get returns a secret's active value.
 func (db *DB) Get(caller Caller, name string) (*api.SecretValue, error) {
-	if err := db.checkAndLog(caller, acl.ActionGet, name, 0); err != nil {
+	breakGlass, err := db.authorize(caller, acl.ActionGet, name, 0)
+	if err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.get(name)
+	e := caller.entry(acl.ActionGet, name, 0, true, breakGlass)
+	return readLocked(db, e, func() (*api.SecretValue, api.SecretVersion, error) {
+		sv, err := db.kv.get(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return sv, sv.Version, nil
+	})
 }
 
 // GetConditional returns a secret's active value if it is different from oldVersion.
 // If the active version is the same as oldVersion, it reports api.ErrValueNotChanged.
+//
+// Clients poll with GetConditional, so a poll that finds no change is not
+// audited unless it was authorized by a break-glass rule; it is counted in
+// the database metrics instead.
 func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVersion) (*api.SecretValue, error) {
-	// This case is special in that we only log an access if the condition
-	// succeeds and we report a fresh value to the caller. However, we still
-	// want a log if authorization fails.
-	if !caller.Permissions.Allow(acl.ActionGet, name) {
-		return nil, db.checkAndLog(caller, acl.ActionGet, name, 0)
-	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	sv, err := db.kv.get(name)
+	breakGlass, err := db.authorize(caller, acl.ActionGet, name, 0)
 	if err != nil {
 		return nil, err
-	} else if sv.Version == oldVersion {
-		return nil, api.ErrValueNotChanged
 	}
 
-	// Reaching here, we have a value we need to deliver back to the caller, and
-	// we must write an audit log. We already know it's authorized.
-	if err := db.checkAndLog(caller, acl.ActionGet, name, 0); err != nil {
-		return nil, err
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e := caller.entry(acl.ActionGet, name, 0, true, breakGlass)
+	if !breakGlass && !isInternal(name) {
+		if sv, err := db.kv.get(name); err == nil && sv.Version == oldVersion {
+			db.countNotModified.Add(1)
+			e.Time, e.SecretVersion, e.Outcome = time.Now(), oldVersion, audit.OutcomeNotModified
+			db.recordUsageLocked(e)
+			return nil, api.ErrValueNotChanged
+		}
 	}
-	return sv, nil
+	return readLocked(db, e, func() (*api.SecretValue, api.SecretVersion, error) {
+		sv, err := db.kv.get(name)
+		if err != nil {
+			return nil, 0, err
+		} else if sv.Version == oldVersion {
+			return nil, oldVersion, api.ErrValueNotChanged
+		}
+		return sv, sv.Version, nil
+	})
 }
 
 // GetVersion returns a secret's value at a specific version.
 func (db *DB) GetVersion(caller Caller, name string, version api.SecretVersion) (*api.SecretValue, error) {
-	if err := db.checkAndLog(caller, acl.ActionGet, name, version); err != nil {
+	breakGlass, err := db.authorize(caller, acl.ActionGet, name, version)
+	if err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.getVersion(name, version)
+	e := caller.entry(acl.ActionGet, name, version, true, breakGlass)
+	return readLocked(db, e, func() (*api.SecretValue, api.SecretVersion, error) {
+		sv, err := db.kv.getVersion(name, version)
+		if err != nil {
+			return nil, 0, err
+		}
+		return sv, sv.Version, nil
+	})
 }
 
 // Put writes value to the secret called name. If the secret already
@@ -233,24 +428,28 @@ func (db *DB) GetVersion(caller Caller, name string, version api.SecretVersion)
 // active. On success, returns the secret version for the new value.
 func (db *DB) Put(caller Caller, name string, value []byte) (api.SecretVersion, error) {
 	if name == "" {
-		return 0, errors.New("empty secret name")
+		return 0, fmt.Errorf("%w: empty secret name", ErrInvalidRequest)
 	}
-	if err := db.checkAndLog(caller, acl.ActionPut, name, 0); err != nil {
+	breakGlass, err := db.authorize(caller, acl.ActionPut, name, 0)
+	if err != nil {
 		return 0, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if strings.HasPrefix(name, configPrefix) {
-		return db.putConfigLocked(name, value)
-	}
-	return db.kv.put(name, value)
+	e := caller.entry(acl.ActionPut, name, 0, true, breakGlass)
+	return db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		if strings.HasPrefix(name, configPrefix) {
+			return db.putConfigLocked(name, value)
+		}
+		return db.kv.put(name, value)
+	})
 }
 
 func (db *DB) putConfigLocked(name string, value []byte) (api.SecretVersion, error) {
 	switch name {
 	default:
-		return 0, fmt.Errorf("unknown config value %q", name)
+		return 0, fmt.Errorf("%w: unknown config value %q", ErrInvalidRequest, name)
 	}
 }
 
@@ -264,31 +463,50 @@ func (db *DB) putConfigLocked(name string, value []byte) (api.SecretVersion, err
 // Access requirement: "create-version"
 func (db *DB) CreateVersion(caller Caller, name string, version api.SecretVersion, value []byte) error {
 	if name == "" {
-		return errors.New("empty secret name")
+		return fmt.Errorf("%w: empty secret name", ErrInvalidRequest)
 	}
 	if version <= 0 {
 		return ErrInvalidVersion
 	}
-	if err := db.checkAndLog(caller, acl.ActionCreateVersion, name, version); err != nil {
+	breakGlass, err := db.authorize(caller, acl.ActionCreateVersion, name, version)
+	if err != nil {
 		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.createVersion(name, version, value)
+	e := caller.entry(acl.ActionCreateVersion, name, version, true, breakGlass)
+	_, err = db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		if isInternal(name) {
+			return 0, fmt.Errorf("%w: unknown config value %q", ErrInvalidRequest, name)
+		}
+		return version, db.kv.createVersion(name, version, value)
+	})
+	return err
 }
 
 // Activate changes the active version of the secret called name to version.
+// If the approval policy requires it, Activate records a pending request and
+// reports an *api.ApprovalRequiredError instead.
 func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) error {
 	if name == "" {
-		return errors.New("empty secret name")
+		return fmt.Errorf("%w: empty secret name", ErrInvalidRequest)
 	}
-	if err := db.checkAndLog(caller, acl.ActionActivate, name, version); err != nil {
+	breakGlass, err := db.authorizeOrDefer(caller, acl.ActionActivate, name, version)
+	if err != nil {
 		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	e := caller.entry(acl.ActionActivate, name, version, true, breakGlass)
+	_, err = db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return version, db.activateLocked(name, version)
+	})
+	return err
+}
+
+func (db *DB) activateLocked(name string, version api.SecretVersion) error {
 	if strings.HasPrefix(name, configPrefix) {
 		return db.activateConfigLocked(name, version)
 	}
@@ -298,19 +516,30 @@ func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) er
 func (db *DB) activateConfigLocked(name string, version api.SecretVersion) error {
 	switch name {
 	default:
-		return fmt.Errorf("unknown config value %q", name)
+		return fmt.Errorf("%w: unknown config value %q", ErrInvalidRequest, name)
 	}
 }
 
 // DeleteVersion deletes the specified version of a secret.
 // It reports an error without change if version is the active version.
+// If the approval policy requires it, DeleteVersion records a pending request
+// and reports an *api.ApprovalRequiredError instead.
 func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersion) error {
-	if err := db.checkAndLog(caller, acl.ActionDelete, name, version); err != nil {
+	breakGlass, err := db.authorizeOrDefer(caller, acl.ActionDelete, name, version)
+	if err != nil {
 		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	e := caller.entry(acl.ActionDelete, name, version, true, breakGlass)
+	_, err = db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return version, db.deleteVersionLocked(name, version)
+	})
+	return err
+}
+
+func (db *DB) deleteVersionLocked(name string, version api.SecretVersion) error {
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
 		return db.deleteConfigVersionLocked(cfg, version)
 	}
@@ -318,19 +547,29 @@ func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersio
 }
 
 func (db *DB) deleteConfigVersionLocked(name string, version api.SecretVersion) error {
-	return fmt.Errorf("unknown config value %q", name)
+	return fmt.Errorf("%w: unknown config value %q", ErrInvalidRequest, name)
 }
 
 // Delete deletes all the versions of a secret. If the specified secret does
 // not exist, this is a no-op without error, provided the caller has access to
-// delete things at all.
+// delete things at all. If the approval policy requires it, Delete records a
+// pending request and reports an *api.ApprovalRequiredError instead.
 func (db *DB) Delete(caller Caller, name string) error {
-	if err := db.checkAndLog(caller, acl.ActionDelete, name, 0); err != nil {
+	breakGlass, err := db.authorizeOrDefer(caller, acl.ActionDelete, name, 0)
+	if err != nil {
 		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	e := caller.entry(acl.ActionDelete, name, 0, true, breakGlass)
+	_, err = db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return 0, db.deleteLocked(name)
+	})
+	return err
+}
+
+func (db *DB) deleteLocked(name string) error {
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
 		return db.deleteConfigLocked(cfg)
 	}
@@ -338,5 +577,39 @@ func (db *DB) Delete(caller Caller, name string) error {
 }
 
 func (db *DB) deleteConfigLocked(name string) error {
-	return fmt.Errorf("unknown config value %q", name)
+	return fmt.Errorf("%w: unknown config value %q", ErrInvalidRequest, name)
+}
+
+// SearchAudit reports the audit log entries matching q for secrets on which
+// the caller has acl.ActionAudit permission, in chronological order. A caller
+// with acl.ActionAudit permission on no secrets is denied.
+func (db *DB) SearchAudit(caller Caller, q audit.Query) ([]*audit.Entry, error) {
+	if !grantsAction(caller.Permissions, acl.ActionAudit) {
+		errs := []error{ErrAccessDenied}
+		if err := db.writeEntry(caller.entry(acl.ActionAudit, "", 0, false, false)); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, multierr.New(errs...)
+	}
+
+	// As with List, record a single audit entry for the search, and filter
+	// the results by permission without logging each one.
+	e := caller.entry(acl.ActionAudit, "", 0, true, false)
+	e.Outcome = audit.OutcomeOK
+	if err := db.writeEntry(e); err != nil {
+		return nil, err
+	}
+	return db.auditLog.Search(q, func(e *audit.Entry) bool {
+		return caller.Permissions.Allow(acl.ActionAudit, e.Secret)
+	})
+}
+
+// grantsAction reports whether any of rr grants action on any secret.
+func grantsAction(rr acl.Rules, action acl.Action) bool {
+	for _, r := range rr {
+		if len(r.Secret) != 0 && slices.Contains(r.Action, action) {
+			return true
+		}
+	}
+	return false
 }
@@ -5,18 +5,34 @@ package db_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/setectest"
 	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/insecurecleartextkeyset"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	"github.com/tink-crypto/tink-go/v2/mac"
 )
 
 func TestCreate(t *testing.T) {
@@ -49,7 +65,7 @@ func TestList(t *testing.T) {
 
 	checkList := func(d *db.DB, want []*api.SecretInfo) {
 		t.Helper()
-		l, err := d.List(id)
+		l, err := d.List(id, api.ListRequest{})
 		if err != nil {
 			t.Fatalf("listing secrets: %v", err)
 		}
@@ -124,6 +140,41 @@ func TestList(t *testing.T) {
 	})
 }
 
+func TestListSelect(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	for _, name := range []string{"dev/a", "dev/b", "dev/c/key", "prod/a", "prod/b"} {
+		d.MustPut(d.Superuser, name, "x")
+	}
+
+	tests := []struct {
+		req  api.ListRequest
+		want []string
+	}{
+		{api.ListRequest{}, []string{"dev/a", "dev/b", "dev/c/key", "prod/a", "prod/b"}},
+		{api.ListRequest{Prefix: "dev/"}, []string{"dev/a", "dev/b", "dev/c/key"}},
+		{api.ListRequest{Prefix: "nonesuch/"}, nil},
+		{api.ListRequest{Glob: "*/a"}, []string{"dev/a", "prod/a"}},
+		{api.ListRequest{Prefix: "prod/", Glob: "*/a"}, []string{"prod/a"}},
+		{api.ListRequest{Limit: 2}, []string{"dev/a", "dev/b"}},
+		{api.ListRequest{Limit: 2, After: "dev/b"}, []string{"dev/c/key", "prod/a"}},
+		{api.ListRequest{Limit: 2, After: "prod/a"}, []string{"prod/b"}},
+		{api.ListRequest{Prefix: "dev/", After: "dev/c/key"}, nil},
+	}
+	for _, tc := range tests {
+		infos, err := d.Actual.List(d.Superuser, tc.req)
+		if err != nil {
+			t.Fatalf("List %+v: unexpected error: %v", tc.req, err)
+		}
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Name)
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("List %+v (-got, +want):\n%s", tc.req, diff)
+		}
+	}
+}
+
 func TestGet(t *testing.T) {
 	d := setectest.NewDB(t, nil)
 	id := d.Superuser
@@ -442,7 +493,974 @@ func TestDeleteVersion(t *testing.T) {
 	d.MustGetVersion(id, testName, v1)
 }
 
+func TestApproval(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	alice := d.Superuser
+	bob := d.Superuser
+	bob.Principal.User = "bob"
+	carol := d.Superuser
+	carol.Principal.User = "carol"
+	carol.Permissions = acl.Rules{{Action: []acl.Action{acl.ActionInfo}, Secret: []acl.Secret{"*"}}}
+
+	v1 := d.MustPut(alice, "prod/key", "v1")
+	v2 := d.MustPut(alice, "prod/key", "v2")
+	d.MustPut(alice, "dev/key", "v1")
+
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{
+		Rules: acl.Rules{{
+			Action: []acl.Action{acl.ActionActivate, acl.ActionDelete},
+			Secret: []acl.Secret{"prod/*"},
+		}},
+	})
+
+	// Operations not matching the policy take effect immediately.
+	if err := d.Actual.Delete(alice, "dev/key"); err != nil {
+		t.Fatalf("Delete dev/key: unexpected error: %v", err)
+	}
+
+	// Operations matching the policy are deferred.
+	err := d.Actual.Activate(alice, "prod/key", v2)
+	var areq *api.ApprovalRequiredError
+	if !errors.As(err, &areq) || !errors.Is(err, api.ErrApprovalRequired) {
+		t.Fatalf("Activate prod/key: got %v, want approval required", err)
+	}
+	if got := d.MustGet(alice, "prod/key"); got.Version != v1 {
+		t.Errorf("Active version before approval: got %v, want %v", got.Version, v1)
+	}
+	id := areq.Request.ID
+
+	// Repeating the operation reports the same request.
+	err = d.Actual.Activate(alice, "prod/key", v2)
+	if !errors.As(err, &areq) || areq.Request.ID != id {
+		t.Errorf("Activate prod/key again: got %v, want request %q", err, id)
+	}
+
+	// The pending request is visible to principals with info or approve.
+	for _, who := range []db.Caller{alice, bob, carol} {
+		reqs, err := d.Actual.ListPending(who)
+		if err != nil {
+			t.Fatalf("ListPending: unexpected error: %v", err)
+		} else if len(reqs) != 1 || reqs[0].ID != id {
+			t.Errorf("ListPending: got %+v, want request %q", reqs, id)
+		}
+	}
+
+	// The requester cannot approve their own request.
+	if err := d.Actual.Approve(alice, id); !errors.Is(err, db.ErrSelfApproval) {
+		t.Errorf("Approve by requester: got %v, want %v", err, db.ErrSelfApproval)
+	}
+	// A principal without approve permission cannot approve.
+	if err := d.Actual.Approve(carol, id); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("Approve without permission: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	// A different principal with approve permission can.
+	if err := d.Actual.Approve(bob, id); err != nil {
+		t.Fatalf("Approve: unexpected error: %v", err)
+	}
+	if got := d.MustGet(alice, "prod/key"); got.Version != v2 {
+		t.Errorf("Active version after approval: got %v, want %v", got.Version, v2)
+	}
+	// The request is consumed.
+	if err := d.Actual.Approve(bob, id); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Approve again: got %v, want %v", err, db.ErrNotFound)
+	}
+
+	// A rejected request does not take effect.
+	err = d.Actual.DeleteVersion(alice, "prod/key", v1)
+	if !errors.As(err, &areq) {
+		t.Fatalf("DeleteVersion prod/key: got %v, want approval required", err)
+	}
+	if err := d.Actual.Reject(alice, areq.Request.ID); err != nil {
+		t.Fatalf("Reject own request: unexpected error: %v", err)
+	}
+	d.MustGetVersion(alice, "prod/key", v1)
+
+	// Expired requests cannot be approved.
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{
+		Rules:  acl.Rules{{Action: []acl.Action{acl.ActionDelete}, Secret: []acl.Secret{"*"}}},
+		Expiry: time.Nanosecond,
+	})
+	err = d.Actual.Delete(alice, "prod/key")
+	if !errors.As(err, &areq) {
+		t.Fatalf("Delete prod/key: got %v, want approval required", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := d.Actual.Approve(bob, areq.Request.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Approve expired: got %v, want %v", err, db.ErrNotFound)
+	}
+	d.MustGet(alice, "prod/key")
+}
+
+func TestApprovalLimit(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	alice := d.Superuser
+	bob := d.Superuser
+	bob.Principal.User = "bob"
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{
+		Rules: acl.Rules{{Action: []acl.Action{acl.ActionDelete}, Secret: []acl.Secret{"*"}}},
+	})
+	for i := range db.MaxPendingPerPrincipal + 1 {
+		d.MustPut(alice, fmt.Sprintf("key%d", i), "v1")
+	}
+
+	for i := range db.MaxPendingPerPrincipal {
+		if err := d.Actual.Delete(alice, fmt.Sprintf("key%d", i)); !errors.Is(err, api.ErrApprovalRequired) {
+			t.Fatalf("Delete key%d: got %v, want approval required", i, err)
+		}
+	}
+	last := fmt.Sprintf("key%d", db.MaxPendingPerPrincipal)
+	if err := d.Actual.Delete(alice, last); !errors.Is(err, db.ErrTooManyPending) {
+		t.Errorf("Delete %s: got %v, want %v", last, err, db.ErrTooManyPending)
+	}
+	// Repeating a pending operation is still allowed, since it records no
+	// new request.
+	if err := d.Actual.Delete(alice, "key0"); !errors.Is(err, api.ErrApprovalRequired) {
+		t.Errorf("Delete key0 again: got %v, want approval required", err)
+	}
+	// The limit applies to each principal separately.
+	if err := d.Actual.Delete(bob, last); !errors.Is(err, api.ErrApprovalRequired) {
+		t.Errorf("Delete %s by bob: got %v, want approval required", last, err)
+	}
+	reqs, err := d.Actual.ListPending(alice)
+	if err != nil {
+		t.Fatalf("ListPending: unexpected error: %v", err)
+	}
+	if len(reqs) != db.MaxPendingPerPrincipal+1 {
+		t.Errorf("ListPending: got %d requests, want %d", len(reqs), db.MaxPendingPerPrincipal+1)
+	}
+}
+
 // TODO(corp/13375): tests that verify ACL enforcement. Not
 // implementing yet because the structure and behavior of ACLs is
 // about to change a bunch, and I'd like to not have to implement the
 // tests twice.
+
+func TestBreakGlass(t *testing.T) {
+	var buf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&buf)})
+	d.MustPut(d.Superuser, "prod/key", "hunter2")
+
+	oncall := d.Superuser
+	oncall.Principal.User = "oncall"
+	oncall.Permissions = acl.Rules{{
+		Action: []acl.Action{acl.ActionGet.BreakGlass()},
+		Secret: []acl.Secret{"prod/*"},
+	}}
+
+	// Without a justification, break-glass rules grant nothing.
+	if _, err := d.Actual.Get(oncall, "prod/key"); !errors.Is(err, db.ErrAccessDenied) {
+		t.Fatalf("Get without justification: got %v, want %v", err, db.ErrAccessDenied)
+	}
+
+	oncall.Justification = "incident 1234"
+	buf.Reset()
+	v, err := d.Actual.Get(oncall, "prod/key")
+	if err != nil {
+		t.Fatalf("Get with justification: unexpected error: %v", err)
+	} else if got := string(v.Value); got != "hunter2" {
+		t.Errorf("Get with justification: got %q, want %q", got, "hunter2")
+	}
+
+	var e audit.Entry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("Decoding audit entry: %v", err)
+	}
+	if !e.Authorized || !e.BreakGlass || e.Severity != audit.SeverityHigh || e.Justification != "incident 1234" {
+		t.Errorf("Audit entry: got %+v, want authorized break-glass with justification", e)
+	}
+	if got := d.Actual.BreakGlassCount().Value(); got != 1 {
+		t.Errorf("BreakGlassCount: got %d, want 1", got)
+	}
+
+	// A justification is recorded for ordinary accesses, but they are not
+	// break-glass events.
+	admin := d.Superuser
+	admin.Justification = "routine check"
+	buf.Reset()
+	d.MustGet(admin, "prod/key")
+	e = audit.Entry{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("Decoding audit entry: %v", err)
+	}
+	if e.BreakGlass || e.Severity != "" || e.Justification != "routine check" {
+		t.Errorf("Audit entry: got %+v, want ordinary access with justification", e)
+	}
+	if got := d.Actual.BreakGlassCount().Value(); got != 1 {
+		t.Errorf("BreakGlassCount: got %d, want 1", got)
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	var buf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&buf)})
+	caller := d.Superuser
+	caller.Request = &audit.Request{ID: "req1", Path: "/api/test", UserAgent: "test"}
+
+	lastEntry := func(t *testing.T) audit.Entry {
+		t.Helper()
+		var e audit.Entry
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Fatalf("Decoding audit entry: %v", err)
+		}
+		buf.Reset()
+		return e
+	}
+	check := func(t *testing.T, action acl.Action, version api.SecretVersion, outcome string) {
+		t.Helper()
+		e := lastEntry(t)
+		if e.Action != action || e.SecretVersion != version || e.Outcome != outcome {
+			t.Errorf("Audit entry: got %s v%d %q, want %s v%d %q",
+				e.Action, e.SecretVersion, e.Outcome, action, version, outcome)
+		}
+		if diff := cmp.Diff(e.Request, caller.Request); diff != "" {
+			t.Errorf("Audit entry request (-got, +want):\n%s", diff)
+		}
+	}
+
+	buf.Reset()
+	d.MustPut(caller, "test", "v1")
+	check(t, acl.ActionPut, 1, audit.OutcomeOK)
+	d.MustPut(caller, "test", "v2")
+	check(t, acl.ActionPut, 2, audit.OutcomeOK)
+
+	d.MustGet(caller, "test")
+	check(t, acl.ActionGet, 1, audit.OutcomeOK)
+	if _, err := d.Actual.GetConditional(caller, "test", 1); !errors.Is(err, api.ErrValueNotChanged) {
+		t.Fatalf("GetConditional: got %v, want %v", err, api.ErrValueNotChanged)
+	}
+	// Polls that find no change are counted, not audited.
+	if buf.Len() != 0 {
+		t.Errorf("GetConditional: got audit entry %q, want none", buf.String())
+	}
+	if m := d.Actual.Metrics().String(); !strings.Contains(m, `"counter_not_modified_gets": 1`) {
+		t.Errorf("Metrics: got %s, want counter_not_modified_gets 1", m)
+	}
+	if _, err := d.Actual.GetConditional(caller, "test", 2); err != nil {
+		t.Fatalf("GetConditional: unexpected error: %v", err)
+	}
+	check(t, acl.ActionGet, 1, audit.OutcomeOK)
+	if _, err := d.Actual.Get(caller, "nonexistent"); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Get: got %v, want %v", err, db.ErrNotFound)
+	}
+	check(t, acl.ActionGet, 0, audit.OutcomeNotFound)
+	if err := d.Actual.DeleteVersion(caller, "test", 1); err == nil {
+		t.Fatal("DeleteVersion of active version: got nil, want error")
+	}
+	check(t, acl.ActionDelete, 1, audit.OutcomeError)
+
+	// Denied operations have no outcome.
+	nobody := caller
+	nobody.Permissions = nil
+	if _, err := d.Actual.Get(nobody, "test"); !errors.Is(err, db.ErrAccessDenied) {
+		t.Fatalf("Get: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	if e := lastEntry(t); e.Authorized || e.Outcome != "" {
+		t.Errorf("Audit entry: got %+v, want denied without outcome", e)
+	}
+}
+
+type failWriter struct{ fail bool }
+
+func (w *failWriter) Write(data []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("disk full")
+	}
+	return len(data), nil
+}
+
+func TestAuditFailure(t *testing.T) {
+	w := new(failWriter)
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(w)})
+	d.MustPut(d.Superuser, "test", "v1")
+
+	// If the audit log cannot be written, operations do not take effect.
+	w.fail = true
+	if _, err := d.Actual.Put(d.Superuser, "test", []byte("v2")); err == nil {
+		t.Error("Put: got nil, want error")
+	}
+	if _, err := d.Actual.Put(d.Superuser, "other", []byte("v1")); err == nil {
+		t.Error("Put: got nil, want error")
+	}
+	if _, err := d.Actual.Get(d.Superuser, "test"); err == nil {
+		t.Error("Get: got nil, want error")
+	}
+
+	w.fail = false
+	info, err := d.Actual.Info(d.Superuser, "test")
+	if err != nil {
+		t.Fatalf("Info: unexpected error: %v", err)
+	} else if len(info.Versions) != 1 {
+		t.Errorf("Info: got versions %v, want [1]", info.Versions)
+	}
+	if _, err := d.Actual.Info(d.Superuser, "other"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Info other: got %v, want %v", err, db.ErrNotFound)
+	}
+
+	// The reverted state persists.
+	d2, err := db.Open(d.Path, d.Key, audit.New(io.Discard))
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	if info, err := d2.Info(d.Superuser, "test"); err != nil {
+		t.Fatalf("Info after reopen: unexpected error: %v", err)
+	} else if len(info.Versions) != 1 {
+		t.Errorf("Info after reopen: got versions %v, want [1]", info.Versions)
+	}
+}
+
+func TestExportAudit(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+	d.MustPut(d.Superuser, "test", "v1")
+
+	x, err := d.Actual.ExportAudit(d.Superuser, audit.Query{Secret: "test"})
+	if err != nil {
+		t.Fatalf("ExportAudit: unexpected error: %v", err)
+	}
+	key, err := d.Actual.AuditExportKey()
+	if err != nil {
+		t.Fatalf("AuditExportKey: unexpected error: %v", err)
+	}
+	if entries, err := x.Verify(key); err != nil {
+		t.Errorf("Verify: unexpected error: %v", err)
+	} else if len(entries) != 1 || entries[0].Action != acl.ActionPut {
+		t.Errorf("Verify: got %+v, want one put", entries)
+	}
+
+	// The signing key is stored in the database, but is not visible to
+	// callers.
+	d2, err := db.Open(d.Path, d.Key, audit.New(io.Discard))
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	if key2, err := d2.AuditExportKey(); err != nil {
+		t.Errorf("AuditExportKey after reopen: unexpected error: %v", err)
+	} else if !key2.Equal(key) {
+		t.Error("AuditExportKey after reopen: key changed")
+	}
+	if got := d.MustList(d.Superuser); len(got) != 1 || got[0].Name != "test" {
+		t.Errorf("List: got %+v, want only test", got)
+	}
+	if _, err := d.Actual.Get(d.Superuser, "_internal/audit-export-key"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get export key: got %v, want %v", err, db.ErrNotFound)
+	}
+	if err := d.Actual.CreateVersion(d.Superuser, "_internal/audit-export-key", 2, []byte("x")); err == nil {
+		t.Error("CreateVersion of export key: got nil, want error")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+	d.MustPut(d.Superuser, "used", "v1")
+	d.MustPut(d.Superuser, "unused", "x")
+
+	alice, bob := d.Superuser, d.Superuser
+	alice.Principal = audit.Principal{User: "alice"}
+	bob.Principal = audit.Principal{User: "bob"}
+	d.MustGet(alice, "used")
+	d.MustGet(bob, "used")
+	v2 := d.MustPut(d.Superuser, "used", "v2")
+	d.MustActivate(d.Superuser, "used", v2)
+	d.MustGet(alice, "used")
+	if _, err := d.Actual.GetConditional(bob, "used", 1); err != nil {
+		t.Fatalf("GetConditional: unexpected error: %v", err)
+	}
+	if _, err := d.Actual.GetConditional(alice, "used", v2); !errors.Is(err, api.ErrValueNotChanged) {
+		t.Fatalf("GetConditional: got %v, want %v", err, api.ErrValueNotChanged)
+	}
+
+	type consumer struct {
+		Principal string
+		Version   api.SecretVersion
+	}
+	type version struct {
+		Version api.SecretVersion
+		Gets    int64
+	}
+	check := func(t *testing.T, kdb *db.DB, wantConsumers []consumer, wantVersions []version) {
+		t.Helper()
+		rsp, err := kdb.Usage(d.Superuser, "", 0)
+		if err != nil {
+			t.Fatalf("Usage: unexpected error: %v", err)
+		}
+		var names []string
+		var consumers []consumer
+		var versions []version
+		for _, su := range rsp.Secrets {
+			names = append(names, su.Name)
+			if su.Name != "used" {
+				if !su.LastGet.IsZero() || su.Consumers != nil {
+					t.Errorf("Usage %q: got %+v, want no reads", su.Name, su)
+				}
+				continue
+			}
+			for _, c := range su.Consumers {
+				consumers = append(consumers, consumer{c.Principal, c.Version})
+			}
+			for _, v := range su.Versions {
+				versions = append(versions, version{v.Version, v.Gets})
+			}
+		}
+		if diff := cmp.Diff(names, []string{"unused", "used"}); diff != "" {
+			t.Errorf("Usage names (-got, +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(consumers, wantConsumers); diff != "" {
+			t.Errorf("Usage consumers (-got, +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(versions, wantVersions); diff != "" {
+			t.Errorf("Usage versions (-got, +want):\n%s", diff)
+		}
+	}
+	// Most recent consumer first.
+	check(t, d.Actual, []consumer{{"user:alice", 2}, {"user:bob", 2}}, []version{{1, 2}, {2, 3}})
+
+	// Usage can be reconstructed from the audit log, except for polls that
+	// found no change, which are not audited.
+	d2, err := db.Open(d.Path, d.Key, log)
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	if err := d2.LoadUsage(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("LoadUsage: unexpected error: %v", err)
+	}
+	check(t, d2, []consumer{{"user:bob", 2}, {"user:alice", 2}}, []version{{1, 2}, {2, 2}})
+
+	// Usage requires info permission.
+	nobody := alice
+	nobody.Permissions = nil
+	if _, err := d.Actual.Usage(nobody, "used", 0); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("Usage: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	if rsp, err := d.Actual.Usage(nobody, "", 0); err != nil {
+		t.Errorf("Usage: unexpected error: %v", err)
+	} else if len(rsp.Secrets) != 0 {
+		t.Errorf("Usage: got %+v, want no secrets", rsp.Secrets)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var buf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&buf)})
+	d.MustPut(d.Superuser, "a", "1")
+	d.MustPut(d.Superuser, "b", "1")
+	v2 := d.MustPut(d.Superuser, "b", "2")
+	ctx := t.Context()
+
+	// A stale version is reported at once.
+	got, err := d.Actual.Watch(ctx, d.Superuser, []api.WatchSecret{{Name: "a", Version: 1}, {Name: "b", Version: 2}})
+	if err != nil {
+		t.Fatalf("Watch: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, []api.WatchSecret{{Name: "b", Version: 1}}); diff != "" {
+		t.Errorf("Watch stale (-got, +want):\n%s", diff)
+	}
+
+	// Without a change, Watch reports nothing when the context ends.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	got, err = d.Actual.Watch(tctx, d.Superuser, []api.WatchSecret{{Name: "a", Version: 1}})
+	cancel()
+	if err != nil || got != nil {
+		t.Errorf("Watch timeout: got (%v, %v), want (nil, nil)", got, err)
+	}
+
+	// A change wakes a waiting watcher; deleted secrets report version 0.
+	type result struct {
+		got []api.WatchSecret
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		got, err := d.Actual.Watch(ctx, d.Superuser, []api.WatchSecret{{Name: "a", Version: 1}, {Name: "b", Version: 1}})
+		done <- result{got, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	d.MustActivate(d.Superuser, "b", v2)
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Errorf("Watch: unexpected error: %v", r.err)
+		} else if diff := cmp.Diff(r.got, []api.WatchSecret{{Name: "b", Version: v2}}); diff != "" {
+			t.Errorf("Watch change (-got, +want):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not report a change")
+	}
+	if err := d.Actual.Delete(d.Superuser, "a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	got, err = d.Actual.Watch(ctx, d.Superuser, []api.WatchSecret{{Name: "a", Version: 1}})
+	if err != nil {
+		t.Errorf("Watch: unexpected error: %v", err)
+	} else if diff := cmp.Diff(got, []api.WatchSecret{{Name: "a", Version: 0}}); diff != "" {
+		t.Errorf("Watch deleted (-got, +want):\n%s", diff)
+	}
+
+	// Every secret requires get permission.
+	limited := d.Superuser
+	limited.Permissions = acl.Rules{{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"b"}}}
+	if _, err := d.Actual.Watch(ctx, limited, []api.WatchSecret{{Name: "b", Version: v2}, {Name: "c"}}); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("Watch without permission: got %v, want %v", err, db.ErrAccessDenied)
+	}
+
+	// Each secret watched is audited as a get, including any break-glass
+	// access that authorized it.
+	oncall := d.Superuser
+	oncall.Justification = "incident 1234"
+	oncall.Permissions = acl.Rules{
+		{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"a"}},
+		{Action: []acl.Action{acl.ActionGet.BreakGlass()}, Secret: []acl.Secret{"b"}},
+	}
+	buf.Reset()
+	if _, err := d.Actual.Watch(ctx, oncall, []api.WatchSecret{{Name: "a", Version: 0}, {Name: "b", Version: 1}}); err != nil {
+		t.Fatalf("Watch with break-glass: unexpected error: %v", err)
+	}
+	type auditGet struct {
+		Action     acl.Action
+		Secret     string
+		Version    api.SecretVersion
+		BreakGlass bool
+	}
+	var entries []auditGet
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e audit.Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Decoding audit entry: %v", err)
+		}
+		entries = append(entries, auditGet{e.Action, e.Secret, e.SecretVersion, e.BreakGlass})
+	}
+	if diff := cmp.Diff(entries, []auditGet{
+		{acl.ActionGet, "a", 0, false},
+		{acl.ActionGet, "b", 1, true},
+	}); diff != "" {
+		t.Errorf("Watch audit entries (-got, +want):\n%s", diff)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+
+	alice := d.Superuser
+	alice.Principal = audit.Principal{User: "alice"}
+	d.MustPut(alice, "test", "v1")
+	v2 := d.MustPut(d.Superuser, "test", "v2")
+	d.MustPut(d.Superuser, "test", "v3")
+	d.MustPut(d.Superuser, "other", "x")
+	d.MustActivate(d.Superuser, "test", v2)
+	if err := d.Actual.DeleteVersion(d.Superuser, "test", 1); err != nil {
+		t.Fatalf("DeleteVersion: unexpected error: %v", err)
+	}
+
+	hist, err := d.Actual.History(d.Superuser, "test", time.Time{}, 3)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	}
+	if !hist.Searchable || hist.ActiveVersion != v2 {
+		t.Errorf("History: got searchable %v, active %d; want true, %d", hist.Searchable, hist.ActiveVersion, v2)
+	}
+	type version struct {
+		Version         api.SecretVersion
+		Active, Deleted bool
+		CreatedBy       string
+	}
+	var got []version
+	for _, v := range hist.Versions {
+		if v.Created.IsZero() {
+			t.Errorf("History: version %d has no creation time", v.Version)
+		}
+		got = append(got, version{v.Version, v.Active, v.Deleted, v.CreatedBy.User})
+	}
+	want := []version{
+		{1, false, true, "alice"},
+		{2, true, false, d.Superuser.Principal.User},
+		{3, false, false, d.Superuser.Principal.User},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("History versions (-got, +want):\n%s", diff)
+	}
+
+	// The most recent entries are reported, and only for the secret.
+	var actions []acl.Action
+	for _, e := range hist.Entries {
+		if e.Secret != "test" {
+			t.Errorf("History: entry for %q, want only %q", e.Secret, "test")
+		}
+		actions = append(actions, e.Action)
+	}
+	if diff := cmp.Diff(actions, []acl.Action{acl.ActionActivate, acl.ActionDelete, acl.ActionInfo}); diff != "" {
+		t.Errorf("History actions (-got, +want):\n%s", diff)
+	}
+
+	// Viewing the history requires info permission.
+	getOnly := d.Superuser
+	getOnly.Permissions = acl.Rules{{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"*"}}}
+	if _, err := d.Actual.History(getOnly, "test", time.Time{}, 0); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("History without info: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	if _, err := d.Actual.History(d.Superuser, "nonesuch", time.Time{}, 0); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("History nonesuch: got %v, want %v", err, db.ErrNotFound)
+	}
+
+	// Only the log since the time given is searched.
+	hist, err = d.Actual.History(d.Superuser, "test", time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("History since: unexpected error: %v", err)
+	}
+	if len(hist.Entries) != 0 || !hist.Versions[0].Created.IsZero() {
+		t.Errorf("History since: got %d entries, created %v; want none", len(hist.Entries), hist.Versions[0].Created)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+
+	generate := func(spec api.GenerateSpec) []byte {
+		t.Helper()
+		v, err := d.Actual.Generate(d.Superuser, "test", spec)
+		if err != nil {
+			t.Fatalf("Generate %v: unexpected error: %v", spec, err)
+		}
+		return d.MustGetVersion(d.Superuser, "test", v).Value
+	}
+
+	t.Run("Password", func(t *testing.T) {
+		for _, n := range []int{0, 1, 64} {
+			got := generate(api.GenerateSpec{Type: api.GeneratePassword, Length: n})
+			want := n
+			if n == 0 {
+				want = api.DefaultGenerateLength
+			}
+			if len(got) != want {
+				t.Errorf("Password %d: got length %d, want %d", n, len(got), want)
+			}
+			for _, c := range got {
+				if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+					t.Errorf("Password %d: got %q, want only letters and digits", n, got)
+					break
+				}
+			}
+		}
+	})
+	t.Run("Bytes", func(t *testing.T) {
+		a := generate(api.GenerateSpec{Type: api.GenerateBytes, Length: 16})
+		b := generate(api.GenerateSpec{Type: api.GenerateBytes, Length: 16})
+		if len(a) != 16 || len(b) != 16 || bytes.Equal(a, b) {
+			t.Errorf("Bytes: got %x, %x; want 16 distinct random bytes", a, b)
+		}
+	})
+	t.Run("Ed25519", func(t *testing.T) {
+		priv, pub := parseKeyPair(t, generate(api.GenerateSpec{Type: api.GenerateEd25519}))
+		if k, ok := priv.(ed25519.PrivateKey); !ok || !k.Public().(ed25519.PublicKey).Equal(pub) {
+			t.Errorf("Ed25519: got %T, %T; want a matching Ed25519 key pair", priv, pub)
+		}
+	})
+	t.Run("ECDSA", func(t *testing.T) {
+		priv, pub := parseKeyPair(t, generate(api.GenerateSpec{Type: api.GenerateECDSA, Algorithm: "P384"}))
+		k, ok := priv.(*ecdsa.PrivateKey)
+		if !ok || k.Curve != elliptic.P384() || !k.PublicKey.Equal(pub) {
+			t.Errorf("ECDSA: got %T, %T; want a matching P-384 key pair", priv, pub)
+		}
+	})
+	t.Run("Keyset", func(t *testing.T) {
+		for _, tc := range []struct {
+			algorithm string
+			check     func(*keyset.Handle) error
+		}{
+			{"", func(h *keyset.Handle) error { _, err := aead.New(h); return err }},
+			{"HMAC_SHA256", func(h *keyset.Handle) error { _, err := mac.New(h); return err }},
+		} {
+			v := generate(api.GenerateSpec{Type: api.GenerateKeyset, Algorithm: tc.algorithm})
+			h, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(v)))
+			if err != nil {
+				t.Fatalf("Keyset %q: reading keyset: %v", tc.algorithm, err)
+			}
+			if err := tc.check(h); err != nil {
+				t.Errorf("Keyset %q: unusable keyset: %v", tc.algorithm, err)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, spec := range []api.GenerateSpec{
+			{},
+			{Type: "bogus"},
+			{Type: api.GeneratePassword, Length: -1},
+			{Type: api.GenerateBytes, Length: 1 << 20},
+			{Type: api.GenerateECDSA, Algorithm: "P224"},
+			{Type: api.GenerateKeyset, Algorithm: "bogus"},
+		} {
+			if _, err := d.Actual.Generate(d.Superuser, "test", spec); !errors.Is(err, db.ErrInvalidRequest) {
+				t.Errorf("Generate %v: got %v, want %v", spec, err, db.ErrInvalidRequest)
+			}
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		reader := d.Superuser
+		reader.Permissions = acl.Rules{{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"*"}}}
+		spec := api.GenerateSpec{Type: api.GeneratePassword}
+		if _, err := d.Actual.Generate(reader, "test", spec); !errors.Is(err, db.ErrAccessDenied) {
+			t.Errorf("Generate: got %v, want %v", err, db.ErrAccessDenied)
+		}
+	})
+
+	// The spec of each generated value is recorded in the audit log.
+	hist, err := d.Actual.History(d.Superuser, "test", time.Time{}, 100)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	}
+	var last string
+	for _, e := range hist.Entries {
+		if e.Action == acl.ActionPut && e.Outcome == audit.OutcomeOK {
+			last = e.Generated
+		}
+	}
+	if want := "tink-keyset:HMAC_SHA256"; last != want {
+		t.Errorf("History: last generated %q, want %q", last, want)
+	}
+}
+
+// parseKeyPair parses the PEM private and public keys in v.
+func parseKeyPair(t *testing.T, v []byte) (priv, pub any) {
+	t.Helper()
+	privBlock, rest := pem.Decode(v)
+	pubBlock, _ := pem.Decode(rest)
+	if privBlock == nil || pubBlock == nil {
+		t.Fatalf("got %q, want PEM private and public keys", v)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(privBlock.Bytes)
+	if err != nil {
+		t.Fatalf("parsing private key: %v", err)
+	}
+	pub, err = x509.ParsePKIXPublicKey(pubBlock.Bytes)
+	if err != nil {
+		t.Fatalf("parsing public key: %v", err)
+	}
+	return priv, pub
+}
+
+func TestRotate(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+
+	d.MustPut(d.Superuser, "hmac/slow", "v1")
+	d.MustPut(d.Superuser, "hmac/fast/key", "v1")
+	d.MustPut(d.Superuser, "other", "v1")
+	policies := []db.RotationPolicy{{
+		Prefix:          "hmac/",
+		Interval:        24 * time.Hour,
+		Generate:        api.GenerateSpec{Type: api.GenerateBytes, Length: 16},
+		ActivationDelay: time.Hour,
+		Keep:            1,
+	}, {
+		Prefix:   "hmac/fast/",
+		Interval: time.Hour,
+		Generate: api.GenerateSpec{Type: api.GeneratePassword},
+	}}
+
+	start := time.Now()
+	checkInfo := func(at time.Duration, name string, active api.SecretVersion, versions ...api.SecretVersion) {
+		t.Helper()
+		if err := d.Actual.Rotate(policies, start.Add(at)); err != nil {
+			t.Fatalf("Rotate at %v: unexpected error: %v", at, err)
+		}
+		info, err := d.Actual.Info(d.Superuser, name)
+		if err != nil {
+			t.Fatalf("Info %q: unexpected error: %v", name, err)
+		}
+		if info.ActiveVersion != active || !slices.Equal(info.Versions, versions) {
+			t.Errorf("At %v, %q: got active %d, versions %v; want %d, %v",
+				at, name, info.ActiveVersion, info.Versions, active, versions)
+		}
+	}
+
+	// Intervals are counted from when a policy is first applied.
+	checkInfo(0, "hmac/slow", 1, 1)
+	checkInfo(23*time.Hour, "hmac/slow", 1, 1)
+
+	// A new version is generated, and activated after the delay.
+	checkInfo(24*time.Hour, "hmac/slow", 1, 1, 2)
+	checkInfo(24*time.Hour+30*time.Minute, "hmac/slow", 1, 1, 2)
+
+	// Rotation state is saved with the database.
+	reopened, err := db.Open(d.Path, d.Key, log)
+	if err != nil {
+		t.Fatalf("Reopen database: %v", err)
+	}
+	d.Actual = reopened
+	checkInfo(25*time.Hour, "hmac/slow", 2, 1, 2)
+
+	// Versions beyond those kept are deleted on activation.
+	checkInfo(48*time.Hour, "hmac/slow", 2, 1, 2, 3)
+	checkInfo(49*time.Hour, "hmac/slow", 3, 2, 3)
+
+	// The longest matching prefix applies, and with no delay new versions
+	// are activated at once. With no limit, all versions are kept. The key
+	// was rotated by each call after the first, all an hour or more apart.
+	checkInfo(50*time.Hour, "hmac/fast/key", 7, 1, 2, 3, 4, 5, 6, 7)
+	if got := d.MustGet(d.Superuser, "hmac/fast/key").Value; len(got) != api.DefaultGenerateLength {
+		t.Errorf("Get hmac/fast/key: got %q, want a generated password", got)
+	}
+
+	// Secrets that match no policy are not rotated.
+	checkInfo(50*time.Hour, "other", 1, 1)
+
+	// Every change is audited under the system principal.
+	hist, err := d.Actual.History(d.Superuser, "hmac/slow", time.Time{}, 100)
+	if err != nil {
+		t.Fatalf("History: unexpected error: %v", err)
+	}
+	var actions []string
+	for _, e := range hist.Entries {
+		if e.Principal.User == db.SystemPrincipal.User {
+			actions = append(actions, fmt.Sprintf("%s %d", e.Action, e.SecretVersion))
+		}
+	}
+	want := []string{"put 2", "activate 2", "put 3", "activate 3", "delete 1"}
+	if diff := cmp.Diff(actions, want); diff != "" {
+		t.Errorf("Audit actions (-got, +want):\n%s", diff)
+	}
+}
+
+// failActivateWriter is an audit log destination that fails to write
+// activations while fail is set.
+type failActivateWriter struct{ fail bool }
+
+func (w *failActivateWriter) Write(data []byte) (int, error) {
+	if w.fail && bytes.Contains(data, []byte(`"action":"activate"`)) {
+		return 0, errors.New("disk full")
+	}
+	return len(data), nil
+}
+
+func TestRotateActivateFailure(t *testing.T) {
+	w := new(failActivateWriter)
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(w)})
+	d.MustPut(d.Superuser, "key", "v1")
+	policies := []db.RotationPolicy{{
+		Prefix:   "key",
+		Interval: time.Hour,
+		Generate: api.GenerateSpec{Type: api.GenerateBytes},
+	}}
+	start := time.Now()
+	check := func(at time.Duration, wantErr bool, active api.SecretVersion, versions ...api.SecretVersion) {
+		t.Helper()
+		if err := d.Actual.Rotate(policies, start.Add(at)); (err != nil) != wantErr {
+			t.Fatalf("Rotate at %v: got error %v, want error %v", at, err, wantErr)
+		}
+		info, err := d.Actual.Info(d.Superuser, "key")
+		if err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+		if info.ActiveVersion != active || !slices.Equal(info.Versions, versions) {
+			t.Errorf("At %v: got active %d, versions %v; want %d, %v",
+				at, info.ActiveVersion, info.Versions, active, versions)
+		}
+	}
+	check(0, false, 1, 1)
+
+	// A failed activation is retried, without generating more versions.
+	w.fail = true
+	check(time.Hour, true, 1, 1, 2)
+	check(2*time.Hour, true, 1, 1, 2)
+	w.fail = false
+	check(2*time.Hour, false, 2, 1, 2)
+
+	// The next interval is counted from when the version was generated.
+	check(2*time.Hour+30*time.Minute, false, 3, 1, 2, 3)
+}
+
+func TestRotateApproval(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "prod/key", "v1")
+	d.MustPut(d.Superuser, "dev/key", "v1")
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{Rules: acl.Rules{{
+		Action: []acl.Action{acl.ActionActivate},
+		Secret: []acl.Secret{"prod/*"},
+	}}})
+	gen := api.GenerateSpec{Type: api.GenerateBytes}
+	policies := []db.RotationPolicy{
+		{Prefix: "prod/", Interval: time.Hour, Generate: gen},
+		{Prefix: "dev/", Interval: time.Hour, Generate: gen},
+	}
+
+	// A secret whose activation requires approval is not rotated, and the
+	// refusal is reported every time.
+	start := time.Now()
+	for _, at := range []time.Duration{0, time.Hour} {
+		err := d.Actual.Rotate(policies, start.Add(at))
+		if err == nil || !strings.Contains(err.Error(), "prod/key") || strings.Contains(err.Error(), "dev/key") {
+			t.Errorf("Rotate at %v: got %v, want an error for prod/key only", at, err)
+		}
+	}
+	for name, want := range map[string][]api.SecretVersion{"prod/key": {1}, "dev/key": {1, 2}} {
+		info, err := d.Actual.Info(d.Superuser, name)
+		if err != nil {
+			t.Fatalf("Info %q: unexpected error: %v", name, err)
+		}
+		if !slices.Equal(info.Versions, want) {
+			t.Errorf("Info %q: got versions %v, want %v", name, info.Versions, want)
+		}
+	}
+
+	// Requiring approval of deletion only matters if old versions are
+	// deleted.
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{Rules: acl.Rules{{
+		Action: []acl.Action{acl.ActionDelete},
+		Secret: []acl.Secret{"*/key"},
+	}}})
+	policies[1].Keep = 1
+	if err := d.Actual.Rotate(policies, start.Add(2*time.Hour)); err == nil || strings.Contains(err.Error(), "prod/key") {
+		t.Errorf("Rotate with delete approval: got %v, want an error for dev/key only", err)
+	}
+}
+
+func TestRotationPolicyValidate(t *testing.T) {
+	good := db.RotationPolicy{
+		Prefix:          "hmac/",
+		Interval:        time.Hour,
+		Generate:        api.GenerateSpec{Type: api.GenerateBytes},
+		ActivationDelay: time.Minute,
+	}
+	if err := good.Validate(); err != nil {
+		t.Errorf("Validate %+v: unexpected error: %v", good, err)
+	}
+	for _, edit := range []func(*db.RotationPolicy){
+		func(p *db.RotationPolicy) { p.Prefix = "" },
+		func(p *db.RotationPolicy) { p.Prefix = "_" },
+		func(p *db.RotationPolicy) { p.Interval = 0 },
+		func(p *db.RotationPolicy) { p.ActivationDelay = -time.Second },
+		func(p *db.RotationPolicy) { p.ActivationDelay = time.Hour },
+		func(p *db.RotationPolicy) { p.Keep = -1 },
+		func(p *db.RotationPolicy) { p.Generate.Type = "bogus" },
+	} {
+		bad := good
+		edit(&bad)
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Validate %+v: got nil, want error", bad)
+		}
+	}
+}
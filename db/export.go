@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/setec/audit"
+)
+
+// exportKeyName is the name of the internal secret holding the PKCS #8
+// encoding of the ed25519 key that signs audit log exports.
+const exportKeyName = configPrefix + "audit-export-key"
+
+// exportKeyLocked returns the key that signs audit log exports, generating
+// and storing a new key if there is none. db.mu must be held.
+func (db *DB) exportKeyLocked() (ed25519.PrivateKey, error) {
+	sv, err := db.kv.get(exportKeyName)
+	if errors.Is(err, ErrNotFound) {
+		_, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.kv.put(exportKeyName, der); err != nil {
+			return nil, fmt.Errorf("saving audit export key: %w", err)
+		}
+		return priv, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(sv.Value)
+	if err != nil {
+		return nil, fmt.Errorf("parsing audit export key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("audit export key is %T, not ed25519", key)
+	}
+	return priv, nil
+}
+
+// AuditExportKey returns the public key with which db signs audit log
+// exports. Since the key is public, no access is required.
+func (db *DB) AuditExportKey() (ed25519.PublicKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	priv, err := db.exportKeyLocked()
+	if err != nil {
+		return nil, err
+	}
+	return priv.Public().(ed25519.PublicKey), nil
+}
+
+// ExportAudit returns a signed export of the audit log entries matching q,
+// for secrets on which the caller has acl.ActionAudit permission. The export
+// is signed with a key held in the database, which is generated on first use.
+//
+// Access requirement: "audit"
+func (db *DB) ExportAudit(caller Caller, q audit.Query) (*audit.Export, error) {
+	entries, err := db.SearchAudit(caller, q)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key, err := db.exportKeyLocked()
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewExport(entries, key)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/insecurecleartextkeyset"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	"github.com/tink-crypto/tink-go/v2/mac"
+	tinkpb "github.com/tink-crypto/tink-go/v2/proto/tink_go_proto"
+)
+
+// maxGenerateLength is the largest length of generated bytes or passwords.
+const maxGenerateLength = 4096
+
+// passwordChars are the characters of generated passwords.
+const passwordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+var ecdsaCurves = map[string]elliptic.Curve{
+	"":     elliptic.P256(),
+	"P256": elliptic.P256(),
+	"P384": elliptic.P384(),
+	"P521": elliptic.P521(),
+}
+
+var keysetTemplates = map[string]func() *tinkpb.KeyTemplate{
+	"":                   aead.AES256GCMKeyTemplate,
+	"AES256_GCM":         aead.AES256GCMKeyTemplate,
+	"AES128_GCM":         aead.AES128GCMKeyTemplate,
+	"XCHACHA20_POLY1305": aead.XChaCha20Poly1305KeyTemplate,
+	"HMAC_SHA256":        mac.HMACSHA256Tag256KeyTemplate,
+}
+
+// Generate adds a new value generated from spec as the latest version of the
+// secret called name, and returns its version. As with Put, the new version
+// is not activated, unless it is the first version of the secret.
+//
+// Access requirement: "put"
+func (db *DB) Generate(caller Caller, name string, spec api.GenerateSpec) (api.SecretVersion, error) {
+	if name == "" {
+		return 0, fmt.Errorf("%w: empty secret name", ErrInvalidRequest)
+	}
+	if isInternal(name) {
+		return 0, fmt.Errorf("%w: cannot generate config value %q", ErrInvalidRequest, name)
+	}
+	breakGlass, err := db.authorize(caller, acl.ActionPut, name, 0)
+	if err != nil {
+		return 0, err
+	}
+	value, err := generateValue(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e := caller.entry(acl.ActionPut, name, 0, true, breakGlass)
+	e.Generated = spec.String()
+	return db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return db.kv.put(name, value)
+	})
+}
+
+// generateValue returns a new secret value as described by spec.
+func generateValue(spec api.GenerateSpec) ([]byte, error) {
+	switch spec.Type {
+	case api.GenerateBytes, api.GeneratePassword:
+		n := spec.Length
+		if n == 0 {
+			n = api.DefaultGenerateLength
+		}
+		if n < 0 || n > maxGenerateLength {
+			return nil, fmt.Errorf("%w: length %d out of range (1..%d)", ErrInvalidRequest, n, maxGenerateLength)
+		}
+		if spec.Type == api.GenerateBytes {
+			return randomBytes(n), nil
+		}
+		return randomPassword(n), nil
+
+	case api.GenerateEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return encodeKeyPair(priv, priv.Public())
+
+	case api.GenerateECDSA:
+		curve, ok := ecdsaCurves[spec.Algorithm]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown ECDSA curve %q", ErrInvalidRequest, spec.Algorithm)
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return encodeKeyPair(priv, priv.Public())
+
+	case api.GenerateKeyset:
+		tmpl, ok := keysetTemplates[spec.Algorithm]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown keyset template %q", ErrInvalidRequest, spec.Algorithm)
+		}
+		h, err := keyset.NewHandle(tmpl())
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := insecurecleartextkeyset.Write(h, keyset.NewJSONWriter(&buf)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown value type %q", ErrInvalidRequest, spec.Type)
+}
+
+// randomBytes returns n random bytes.
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return buf
+}
+
+// randomPassword returns n characters chosen uniformly at random from
+// passwordChars.
+func randomPassword(n int) []byte {
+	// Reject bytes at or above the largest multiple of len(passwordChars),
+	// so that every character is equally likely.
+	const limit = 256 - 256%len(passwordChars)
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		for _, b := range randomBytes(n - len(out)) {
+			if int(b) < limit {
+				out = append(out, passwordChars[int(b)%len(passwordChars)])
+			}
+		}
+	}
+	return out
+}
+
+// encodeKeyPair returns the PEM encoding of priv in PKCS #8 form, followed by
+// the PEM encoding of pub in PKIX form.
+func encodeKeyPair(priv, pub any) ([]byte, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})...), nil
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"os"
+	"time"
+)
+
+// CheckFile reports an error if the database file cannot be found on disk,
+// for example because the state directory was removed or unmounted.
+func (db *DB) CheckFile() error {
+	_, err := os.Stat(db.Path())
+	return err
+}
+
+// AuditStatus reports when an audit log entry was last written successfully,
+// and the error from the most recent write, which is nil if it succeeded or
+// nothing has been written.
+func (db *DB) AuditStatus() (lastOK time.Time, err error) {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	return db.auditOK, db.auditErr
+}
+
+// recordAuditWrite records the outcome of an audit log write started at
+// start, for AuditStatus.
+func (db *DB) recordAuditWrite(start time.Time, err error) {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	db.auditErr = err
+	if err == nil {
+		db.auditOK = start
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+)
+
+// SecretHistory is the history of a secret, as reported by History.
+type SecretHistory struct {
+	// Name is the name of the secret.
+	Name string
+	// ActiveVersion is the active version of the secret.
+	ActiveVersion api.SecretVersion
+	// Versions are the versions of the secret, including deleted ones, in
+	// increasing order.
+	Versions []*VersionHistory
+	// Entries are the most recent audit log entries for the secret, in
+	// chronological order.
+	Entries []*audit.Entry
+	// Searchable reports whether the audit log could be searched. If not,
+	// Entries is empty, and the creation of versions is unknown.
+	Searchable bool
+}
+
+// VersionHistory is the history of one version of a secret.
+type VersionHistory struct {
+	Version api.SecretVersion
+	Active  bool // this is the active version
+	Deleted bool // this version has been deleted
+	// Created is when the version was created, or zero if that is not
+	// recorded in the audit log.
+	Created time.Time
+	// CreatedBy is the principal who created the version, if Created is
+	// non-zero.
+	CreatedBy audit.Principal
+}
+
+// History reports the versions of the secret called name, including deleted
+// versions, and up to limit of the most recent audit log entries for it (all
+// of them, if limit <= 0). Only the audit log from since onward is searched
+// (all of it, if since is zero), both for entries and for the creation of
+// versions. Only entries for operations on the secret itself are reported,
+// since the caller's permission to see them derives from their permission on
+// it.
+//
+// Access requirement: "info"
+func (db *DB) History(caller Caller, name string, since time.Time, limit int) (*SecretHistory, error) {
+	breakGlass, err := db.authorize(caller, acl.ActionInfo, name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	e := caller.entry(acl.ActionInfo, name, 0, true, breakGlass)
+	hist, err := readLocked(db, e, func() (*SecretHistory, api.SecretVersion, error) {
+		secret := db.kv.secrets[name]
+		if secret == nil {
+			return nil, 0, ErrNotFound
+		}
+		hist := &SecretHistory{Name: name, ActiveVersion: secret.ActiveVersion}
+		for v := range secret.Versions {
+			hist.Versions = append(hist.Versions, &VersionHistory{Version: v, Active: v == secret.ActiveVersion})
+		}
+		for v := range secret.DeletedVersions {
+			hist.Versions = append(hist.Versions, &VersionHistory{Version: v, Deleted: true})
+		}
+		slices.SortFunc(hist.Versions, func(a, b *VersionHistory) int {
+			return cmp.Compare(a.Version, b.Version)
+		})
+		return hist, 0, nil
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Search the log without holding the lock, as it may take a while.
+	entries, err := db.auditLog.Search(audit.Query{Since: since, Limit: limit}, func(e *audit.Entry) bool {
+		return e.Secret == name
+	})
+	if errors.Is(err, audit.ErrNotSearchable) {
+		return hist, nil
+	} else if err != nil {
+		return nil, err
+	}
+	hist.Searchable = true
+	hist.Entries = entries
+
+	// The creations of versions may be older than the entries reported, so
+	// search for them separately, keeping only those entries.
+	created, err := db.auditLog.Search(audit.Query{Since: since}, func(e *audit.Entry) bool {
+		return e.Secret == name && e.Authorized && e.Outcome == audit.OutcomeOK &&
+			(e.Action == acl.ActionPut || e.Action == acl.ActionCreateVersion)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range created {
+		// If the secret was deleted and recreated, its versions were reused,
+		// and the latest creation is the one that counts.
+		for _, v := range hist.Versions {
+			if v.Version == e.SecretVersion {
+				v.Created, v.CreatedBy = e.Time, e.Principal
+			}
+		}
+	}
+	return hist, nil
+}
@@ -13,12 +13,14 @@ import (
 	"maps"
 	"os"
 	"slices"
+	"time"
 
 	"github.com/tailscale/setec/types/api"
 	"github.com/tink-crypto/tink-go/v2/aead"
 	"github.com/tink-crypto/tink-go/v2/keyset"
 	"github.com/tink-crypto/tink-go/v2/tink"
 	"tailscale.com/atomicfile"
+	"tailscale.com/metrics"
 )
 
 // aeadContextDEK returns the AEAD encryption context to use for
@@ -80,6 +82,10 @@ type kv struct {
 	kekCipher tink.AEAD
 
 	gen uint64
+
+	size     int64              // size in bytes of the last file saved
+	saved    time.Time          // when the file was last saved
+	saveTime *metrics.Histogram // if non-nil, records the duration of saves
 }
 
 // secret is a named secret, which may have multiple versioned secret
@@ -100,6 +106,9 @@ type secret struct {
 	// DeletedVersions tracks versions that were previously set but
 	// have since been deleted. These are not permitted to be set again.
 	DeletedVersions map[api.SecretVersion]bool
+	// Rotation is the state of automatic rotation of the secret, or nil if
+	// no rotation policy has applied to it.
+	Rotation *rotationState `json:",omitempty"`
 }
 
 // byteString is an alias for a string, but encodes to JSON as the conventional
@@ -176,6 +185,10 @@ func openOrCreateKV(path string, kek tink.AEAD) (*kv, error) {
 		return nil, fmt.Errorf("unmarshaling decrypted database: %w", err)
 	}
 
+	var saved time.Time
+	if fi, err := os.Stat(path); err == nil {
+		saved = fi.ModTime()
+	}
 	ret := &kv{
 		path:      path,
 		secrets:   persist.Secrets,
@@ -186,6 +199,9 @@ func openOrCreateKV(path string, kek tink.AEAD) (*kv, error) {
 		// Initialize gen to 1, so that 0 can be used as a sentinel
 		// value by calling code.
 		gen: 1,
+
+		size:  int64(len(bs)),
+		saved: saved,
 	}
 	return ret, nil
 }
@@ -223,9 +239,14 @@ func newKV(path string, key tink.AEAD) (*kv, error) {
 // save encrypts and writes the kv to kv.path. If save return an
 // error, the file at kv.path is unchanged.
 func (kv *kv) save() (err error) {
+	start := time.Now()
 	defer func() {
 		if err == nil {
 			kv.gen++
+			kv.saved = time.Now()
+			if kv.saveTime != nil {
+				kv.saveTime.Observe(kv.saved.Sub(start).Seconds())
+			}
 		}
 	}()
 
@@ -250,6 +271,7 @@ func (kv *kv) save() (err error) {
 	if err := atomicfile.WriteFile(kv.path, out, 0600); err != nil {
 		return fmt.Errorf("writing database to %q: %w", kv.path, err)
 	}
+	kv.size = int64(len(out))
 	return nil
 }
 
@@ -406,7 +428,7 @@ func (kv *kv) createVersion(name string, version api.SecretVersion, value []byte
 // version.
 func (kv *kv) setActive(name string, version api.SecretVersion) error {
 	if version == api.SecretVersionDefault {
-		return errors.New("invalid version")
+		return ErrInvalidVersion
 	}
 	secret := kv.secrets[name]
 	if secret == nil {
@@ -430,13 +452,13 @@ func (kv *kv) setActive(name string, version api.SecretVersion) error {
 // deleteVersion deletes the specified version of a secret.
 func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
 	if version == api.SecretVersionDefault {
-		return errors.New("invalid version")
+		return ErrInvalidVersion
 	}
 	secret := kv.secrets[name]
 	if secret == nil {
 		return fmt.Errorf("secret %q: %w", name, ErrNotFound)
 	} else if version == secret.ActiveVersion {
-		return errors.New("cannot delete active version")
+		return ErrActiveVersion
 	}
 	old, ok := secret.Versions[version]
 	if !ok {
@@ -472,3 +494,30 @@ func (kv *kv) deleteSecret(name string) error {
 	}
 	return nil
 }
+
+// snapshot returns a function that restores the secret called name to its
+// current state, saving the database if it has changed in the meantime.
+func (kv *kv) snapshot(name string) (restore func() error) {
+	gen := kv.gen
+	old := kv.secrets[name]
+	if old != nil {
+		old = &secret{
+			Versions:        maps.Clone(old.Versions),
+			ActiveVersion:   old.ActiveVersion,
+			LatestVersion:   old.LatestVersion,
+			DeletedVersions: maps.Clone(old.DeletedVersions),
+			Rotation:        old.Rotation,
+		}
+	}
+	return func() error {
+		if kv.gen == gen {
+			return nil // nothing was saved
+		}
+		if old == nil {
+			delete(kv.secrets, name)
+		} else {
+			kv.secrets[name] = old
+		}
+		return kv.save()
+	}
+}
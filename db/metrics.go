@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"expvar"
+	"time"
+
+	"tailscale.com/metrics"
+)
+
+// durationBuckets are the bucket boundaries, in seconds, of the histograms
+// of durations of database operations.
+var durationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Metrics returns a collection of metrics for db. The caller is responsible
+// for publishing the result to the metrics exporter.
+func (db *DB) Metrics() *metrics.Set {
+	m := new(metrics.Set)
+	m.Set("gauge_secrets", expvar.Func(func() any {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		var n int64
+		for name := range db.kv.secrets {
+			if !isInternal(name) {
+				n++
+			}
+		}
+		return n
+	}))
+	m.Set("gauge_versions", expvar.Func(func() any {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		var n int64
+		for name, s := range db.kv.secrets {
+			if !isInternal(name) {
+				n += int64(len(s.Versions))
+			}
+		}
+		return n
+	}))
+	m.Set("gauge_pending_approvals", expvar.Func(func() any {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		now := time.Now()
+		var n int64
+		for _, op := range db.pending {
+			if !now.After(op.Expires) {
+				n++
+			}
+		}
+		return n
+	}))
+	m.Set("gauge_file_size_bytes", expvar.Func(func() any {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.kv.size
+	}))
+	m.Set("gauge_last_save_time_seconds", expvar.Func(func() any {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.kv.saved.IsZero() {
+			return float64(0)
+		}
+		return float64(db.kv.saved.UnixNano()) / float64(time.Second)
+	}))
+	m.Set("counter_not_modified_gets", &db.countNotModified)
+	m.Set("counter_audit_skipped_lines", db.auditLog.SkippedLines())
+	m.Set("histogram_save_seconds", db.saveTime)
+	m.Set("histogram_audit_write_seconds", db.auditWriteTime)
+	return m
+}
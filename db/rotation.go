@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+)
+
+// SystemPrincipal is the principal recorded in the audit log for actions
+// taken by the server itself, such as automatic rotation.
+var SystemPrincipal = audit.Principal{User: "system:setec"}
+
+// A RotationPolicy describes the automatic rotation of a set of secrets.
+type RotationPolicy struct {
+	// Prefix selects the secrets to which the policy applies: those whose
+	// names begin with it. If the prefixes of several policies match a
+	// secret, the longest applies.
+	Prefix string
+
+	// Interval is how often a new version is generated.
+	Interval time.Duration
+
+	// Generate describes the values generated.
+	Generate api.GenerateSpec
+
+	// ActivationDelay is how long after it is generated a new version is
+	// activated, giving its consumers time to fetch it in advance. If zero,
+	// the new version is activated immediately.
+	ActivationDelay time.Duration
+
+	// Keep is the number of versions older than the active version that are
+	// kept when a new version is activated. Older versions are deleted. If
+	// zero, all versions are kept.
+	Keep int
+}
+
+// Validate reports whether p is a usable policy.
+func (p *RotationPolicy) Validate() error {
+	switch {
+	case p.Prefix == "":
+		return errors.New("empty prefix")
+	case strings.HasPrefix(p.Prefix, configPrefix) || strings.HasPrefix(configPrefix, p.Prefix):
+		return fmt.Errorf("prefix %q matches internal config values", p.Prefix)
+	case p.Interval <= 0:
+		return errors.New("interval must be positive")
+	case p.ActivationDelay < 0:
+		return errors.New("activation delay must not be negative")
+	case p.ActivationDelay >= p.Interval:
+		return errors.New("activation delay must be less than the interval")
+	case p.Keep < 0:
+		return errors.New("keep must not be negative")
+	}
+	if _, err := generateValue(p.Generate); err != nil {
+		return fmt.Errorf("generate: %w", err)
+	}
+	return nil
+}
+
+// rotationState is the persistent state of the automatic rotation of a
+// secret.
+type rotationState struct {
+	// Rotated is when the secret was last rotated, or when its rotation
+	// began if it has not yet been rotated.
+	Rotated time.Time
+	// Pending is a version awaiting activation, or 0 if there is none.
+	Pending api.SecretVersion `json:",omitempty"`
+	// ActivateAt is when Pending is to be activated.
+	ActivateAt time.Time `json:",omitzero"`
+}
+
+// Rotate carries out the rotation policies for every secret as of now. It
+// should be called periodically. For each secret whose name matches a
+// policy, Rotate generates a new version when the policy's interval has
+// passed since the last, activates it after the policy's delay, and then
+// deletes old versions beyond those the policy keeps. Every change is
+// audited under SystemPrincipal.
+//
+// A secret's interval is counted from the first call of Rotate to find a
+// policy for it, so existing secrets are not all rotated at once when a
+// policy is added. Rotation of a secret continues after an error rotating
+// another; Rotate reports all errors.
+//
+// Rotation is not subject to the approval policy, since no one could approve
+// it. Instead, Rotate refuses to rotate a secret for which the approval
+// policy requires approval of activation, or of deletion if the policy
+// deletes old versions, and reports an error for it each time.
+func (db *DB) Rotate(policies []RotationPolicy, now time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var errs []error
+	var started bool // whether the state of any secret was initialized
+	for _, name := range db.kv.list() {
+		if isInternal(name) {
+			continue
+		}
+		p := matchPolicy(policies, name)
+		if p == nil {
+			continue
+		}
+		if err := db.checkRotationApprovalLocked(p, name); err != nil {
+			errs = append(errs, fmt.Errorf("rotating %q: %w", name, err))
+			continue
+		}
+		s := db.kv.secrets[name]
+		if s.Rotation == nil {
+			s.Rotation = &rotationState{Rotated: now}
+			started = true
+			continue
+		}
+		if err := db.rotateLocked(p, name, now); err != nil {
+			errs = append(errs, fmt.Errorf("rotating %q: %w", name, err))
+		}
+	}
+	if started {
+		if err := db.kv.save(); err != nil {
+			errs = append(errs, fmt.Errorf("saving rotation state: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matchPolicy returns the policy with the longest prefix of name, or nil if
+// no policy matches.
+func matchPolicy(policies []RotationPolicy, name string) *RotationPolicy {
+	var best *RotationPolicy
+	for i, p := range policies {
+		if strings.HasPrefix(name, p.Prefix) && (best == nil || len(p.Prefix) > len(best.Prefix)) {
+			best = &policies[i]
+		}
+	}
+	return best
+}
+
+// checkRotationApprovalLocked reports an error if rotating the secret called
+// name by p would take an action that the approval policy requires to be
+// approved.
+func (db *DB) checkRotationApprovalLocked(p *RotationPolicy, name string) error {
+	if db.approval.Rules.Allow(acl.ActionActivate, name) {
+		return errors.New("activation requires approval")
+	}
+	if p.Keep > 0 && db.approval.Rules.Allow(acl.ActionDelete, name) {
+		return errors.New("deletion requires approval")
+	}
+	return nil
+}
+
+// rotateLocked carries out the next step of p for the secret called name, if
+// one is due.
+func (db *DB) rotateLocked(p *RotationPolicy, name string, now time.Time) error {
+	s := db.kv.secrets[name]
+	st := *s.Rotation
+	if st.Pending != 0 {
+		if now.Before(st.ActivateAt) {
+			return nil
+		}
+		st.Pending, st.ActivateAt = 0, time.Time{}
+		pending := s.Rotation.Pending
+		if _, ok := s.Versions[pending]; !ok || pending <= s.ActiveVersion {
+			// The pending version was deleted, or a newer version activated,
+			// since it was generated.
+			return db.setRotationLocked(name, st)
+		}
+		return db.activateRotatedLocked(p, name, pending, st)
+	}
+	if now.Sub(st.Rotated) < p.Interval {
+		return nil
+	}
+
+	value, err := generateValue(p.Generate)
+	if err != nil {
+		return err
+	}
+	e := systemCaller.entry(acl.ActionPut, name, 0, true, false)
+	e.Generated = p.Generate.String()
+	version, err := db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return db.kv.put(name, value)
+	})
+	if err != nil {
+		return err
+	}
+	// Record the new version before activating it, so that if activation
+	// fails, later calls retry it rather than generating another version.
+	st.Rotated = now
+	st.Pending, st.ActivateAt = version, now.Add(p.ActivationDelay)
+	if err := db.setRotationLocked(name, st); err != nil {
+		return err
+	}
+	if p.ActivationDelay > 0 {
+		return nil
+	}
+	st.Pending, st.ActivateAt = 0, time.Time{}
+	return db.activateRotatedLocked(p, name, version, st)
+}
+
+// activateRotatedLocked activates version of the secret called name, records
+// st as its rotation state, and deletes its versions in excess of p.Keep.
+func (db *DB) activateRotatedLocked(p *RotationPolicy, name string, version api.SecretVersion, st rotationState) error {
+	e := systemCaller.entry(acl.ActionActivate, name, version, true, false)
+	if _, err := db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+		return version, db.kv.setActive(name, version)
+	}); err != nil {
+		return err
+	}
+	if err := db.setRotationLocked(name, st); err != nil {
+		return err
+	}
+	if p.Keep == 0 {
+		return nil
+	}
+
+	s := db.kv.secrets[name]
+	var old []api.SecretVersion
+	for v := range s.Versions {
+		if v < s.ActiveVersion {
+			old = append(old, v)
+		}
+	}
+	slices.Sort(old)
+	for len(old) > p.Keep {
+		v := old[0]
+		old = old[1:]
+		e := systemCaller.entry(acl.ActionDelete, name, v, true, false)
+		if _, err := db.mutateLocked(e, name, func() (api.SecretVersion, error) {
+			return v, db.kv.deleteVersion(name, v)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setRotationLocked records st as the rotation state of the secret called
+// name.
+func (db *DB) setRotationLocked(name string, st rotationState) error {
+	s := db.kv.secrets[name]
+	old := s.Rotation
+	s.Rotation = &st
+	if err := db.kv.save(); err != nil {
+		s.Rotation = old
+		return err
+	}
+	return nil
+}
+
+// systemCaller is the caller for actions taken by the server itself.
+var systemCaller = Caller{Principal: SystemPrincipal}
@@ -0,0 +1,179 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+)
+
+// defaultUsageDays is the period in days for which consumers of a secret are
+// reported, if the caller does not specify one.
+const defaultUsageDays = 30
+
+// secretUsage records how a secret has been read.
+type secretUsage struct {
+	lastGet   time.Time
+	consumers map[string]*api.SecretConsumer // :: principal key → consumer
+	versions  map[api.SecretVersion]*api.VersionUsage
+}
+
+// recordUsageLocked updates the usage statistics of the secret named in e,
+// if e records a successful read. db.mu must be held.
+func (db *DB) recordUsageLocked(e *audit.Entry) {
+	if e.Action != acl.ActionGet || !e.Authorized || e.Secret == "" {
+		return
+	}
+	switch e.Outcome {
+	case audit.OutcomeOK, audit.OutcomeNotModified:
+	case "":
+		// Entries written before outcomes were recorded do not say whether
+		// the read succeeded, nor (for the active version) which version was
+		// read. Count them, since most reads succeed.
+	default:
+		return
+	}
+
+	u := db.usage[e.Secret]
+	if u == nil {
+		u = &secretUsage{
+			consumers: make(map[string]*api.SecretConsumer),
+			versions:  make(map[api.SecretVersion]*api.VersionUsage),
+		}
+		db.usage[e.Secret] = u
+	}
+	if e.Time.After(u.lastGet) {
+		u.lastGet = e.Time
+	}
+
+	key := principalKey(e.Principal)
+	if c := u.consumers[key]; c == nil {
+		u.consumers[key] = &api.SecretConsumer{Principal: key, LastGet: e.Time, Version: e.SecretVersion}
+	} else if !e.Time.Before(c.LastGet) {
+		c.LastGet, c.Version = e.Time, e.SecretVersion
+	}
+
+	if e.SecretVersion == 0 {
+		return // version unknown
+	}
+	v := u.versions[e.SecretVersion]
+	if v == nil {
+		v = &api.VersionUsage{Version: e.SecretVersion}
+		u.versions[e.SecretVersion] = v
+	}
+	v.Gets++
+	if e.Time.After(v.LastGet) {
+		v.LastGet = e.Time
+	}
+}
+
+// LoadUsage initializes the usage statistics of db from the entries of its
+// audit log since the given time, so that they reflect reads made before db
+// was opened. It should be called before db is used. It reports
+// audit.ErrNotSearchable if the audit log is not stored in a file.
+func (db *DB) LoadUsage(since time.Time) error {
+	_, err := db.auditLog.Search(audit.Query{Action: acl.ActionGet, Since: since}, func(e *audit.Entry) bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.recordUsageLocked(e)
+		return false // count, but do not keep
+	})
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if since.Before(db.usageSince) {
+		db.usageSince = since
+	}
+	return nil
+}
+
+// Usage reports usage statistics of the secret called name, or if name is
+// empty, of all secrets for which the caller has acl.ActionInfo permission.
+// Consumers are reported if they read the secret within the given number of
+// days, or 30 days if days <= 0. Usage is recorded from the time db was
+// opened, or from the time given to LoadUsage.
+//
+// Access requirement: "info"
+func (db *DB) Usage(caller Caller, name string, days int) (*api.UsageResponse, error) {
+	if days <= 0 {
+		days = defaultUsageDays
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	if name != "" {
+		breakGlass, err := db.authorize(caller, acl.ActionInfo, name, 0)
+		if err != nil {
+			return nil, err
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		e := caller.entry(acl.ActionInfo, name, 0, true, breakGlass)
+		return readLocked(db, e, func() (*api.UsageResponse, api.SecretVersion, error) {
+			su, err := db.secretUsageLocked(name, cutoff)
+			if err != nil {
+				return nil, 0, err
+			}
+			return &api.UsageResponse{Since: db.usageSince, Secrets: []*api.SecretUsage{su}}, 0, nil
+		})
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// As with List, record a single audit entry for the report.
+	e := caller.entry(acl.ActionInfo, "", 0, true, false)
+	e.Outcome = audit.OutcomeOK
+	if err := db.writeEntry(e); err != nil {
+		return nil, err
+	}
+	rsp := &api.UsageResponse{Since: db.usageSince}
+	for _, name := range db.kv.list() {
+		if isInternal(name) || !caller.Permissions.Allow(acl.ActionInfo, name) {
+			continue
+		}
+		su, err := db.secretUsageLocked(name, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Secrets = append(rsp.Secrets, su)
+	}
+	return rsp, nil
+}
+
+// secretUsageLocked returns the usage statistics of the secret called name,
+// reporting consumers that read it after cutoff. db.mu must be held.
+func (db *DB) secretUsageLocked(name string, cutoff time.Time) (*api.SecretUsage, error) {
+	info, err := db.kv.info(name)
+	if err != nil {
+		return nil, err
+	}
+	su := &api.SecretUsage{Name: name, ActiveVersion: info.ActiveVersion}
+	u := db.usage[name]
+	if u == nil {
+		return su, nil
+	}
+	su.LastGet = u.lastGet
+	for _, c := range u.consumers {
+		if c.LastGet.After(cutoff) {
+			cc := *c
+			su.Consumers = append(su.Consumers, &cc)
+		}
+	}
+	slices.SortFunc(su.Consumers, func(a, b *api.SecretConsumer) int {
+		return cmp.Or(b.LastGet.Compare(a.LastGet), cmp.Compare(a.Principal, b.Principal))
+	})
+	for _, v := range slices.Sorted(maps.Keys(u.versions)) {
+		vu := *u.versions[v]
+		su.Versions = append(su.Versions, &vu)
+	}
+	return su, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
+)
+
+// notifyLocked wakes any callers of Watch waiting for a change to the
+// database. db.mu must be held.
+func (db *DB) notifyLocked() {
+	if db.changed != nil {
+		close(db.changed)
+		db.changed = nil
+	}
+}
+
+// changedLocked returns the secrets whose active versions differ from the
+// versions given. A secret that does not exist has active version 0. db.mu
+// must be held.
+func (db *DB) changedLocked(secrets []api.WatchSecret) []api.WatchSecret {
+	var out []api.WatchSecret
+	for _, ws := range secrets {
+		var cur api.SecretVersion
+		if sv, err := db.kv.get(ws.Name); err == nil && !isInternal(ws.Name) {
+			cur = sv.Version
+		}
+		if cur != ws.Version {
+			out = append(out, api.WatchSecret{Name: ws.Name, Version: cur})
+		}
+	}
+	return out
+}
+
+// Watch waits until the active version of any of the given secrets differs
+// from the version given for it, or ctx ends, and reports the secrets that
+// changed with their current active versions. A secret that does not exist
+// is reported with version 0. If ctx ends before any secret changes, Watch
+// reports no secrets and no error.
+//
+// The caller must have acl.ActionGet permission for every secret. An audit
+// entry is recorded for each secret when the call begins, giving the version
+// the caller holds; the wait itself is not recorded.
+//
+// Access requirement: "get"
+func (db *DB) Watch(ctx context.Context, caller Caller, secrets []api.WatchSecret) ([]api.WatchSecret, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%w: no secrets to watch", ErrInvalidRequest)
+	}
+	breakGlass := make([]bool, len(secrets))
+	for i, ws := range secrets {
+		bg, err := db.authorize(caller, acl.ActionGet, ws.Name, 0)
+		if err != nil {
+			return nil, err
+		}
+		breakGlass[i] = bg
+	}
+
+	db.mu.Lock()
+	for i, ws := range secrets {
+		e := caller.entry(acl.ActionGet, ws.Name, ws.Version, true, breakGlass[i])
+		e.Outcome = audit.OutcomeOK
+		if err := db.writeEntry(e); err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+	}
+	db.mu.Unlock()
+
+	for {
+		db.mu.Lock()
+		out := db.changedLocked(secrets)
+		if len(out) != 0 {
+			db.mu.Unlock()
+			return out, nil
+		}
+		if db.changed == nil {
+			db.changed = make(chan struct{})
+		}
+		ch := db.changed
+		db.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ch:
+		}
+	}
+}
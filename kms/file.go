@@ -0,0 +1,220 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/aead/subtle"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	"github.com/tink-crypto/tink-go/v2/tink"
+	"golang.org/x/crypto/scrypt"
+)
+
+// A file KEK is a tink AEAD keyset stored in a local file, encrypted by a
+// master key. The master key is either read from a file of 32 random bytes,
+// or derived with scrypt from a passphrase. The URI of a file KEK is:
+//
+//	file:///path/to/kek.json[?master-key-file=PATH|passphrase-file=PATH|passphrase-env=NAME]
+//
+// If no option is given, the passphrase is read from the environment
+// variable named by DefaultPassphraseEnv.
+
+// DefaultPassphraseEnv is the environment variable from which the passphrase
+// of a file KEK is read, if its URI does not say otherwise.
+const DefaultPassphraseEnv = "SETEC_KEK_PASSPHRASE"
+
+// masterKeySize is the size in bytes of the master key of a file KEK.
+const masterKeySize = 32
+
+// Parameters for deriving a master key from a passphrase. These are the
+// recommended interactive parameters for scrypt; they are recorded in the
+// file so that they can be changed later.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// keysetAD is the associated data with which a file KEK keyset is encrypted.
+var keysetAD = []byte("setec file KEK")
+
+// fileKEK is the format of a file KEK.
+type fileKEK struct {
+	Version int `json:"version"` // currently 1
+
+	// KDF is how the master key is derived: "scrypt" from a passphrase, or
+	// "none" for a master key read from a file.
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt,omitempty"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+
+	// Keyset is the tink keyset, in binary format, encrypted by the master
+	// key.
+	Keyset []byte `json:"keyset"`
+}
+
+// fileOptions are the options given in the URI of a file KEK.
+type fileOptions struct {
+	path          string
+	masterKeyFile string
+	passphrase    string
+}
+
+func parseFileURI(uri string) (*fileOptions, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KEK URI: %w", err)
+	}
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid KEK URI %q: want file:///path", uri)
+	}
+	opts := &fileOptions{path: u.Path}
+	q := u.Query()
+	for name := range q {
+		switch name {
+		case "master-key-file", "passphrase-file", "passphrase-env":
+		default:
+			return nil, fmt.Errorf("invalid KEK URI %q: unknown option %q", uri, name)
+		}
+	}
+	if opts.masterKeyFile = q.Get("master-key-file"); opts.masterKeyFile != "" {
+		return opts, nil
+	}
+	if pf := q.Get("passphrase-file"); pf != "" {
+		bs, err := os.ReadFile(pf)
+		if err != nil {
+			return nil, fmt.Errorf("reading KEK passphrase: %w", err)
+		}
+		opts.passphrase = strings.TrimRight(string(bs), "\r\n")
+	} else {
+		env := q.Get("passphrase-env")
+		if env == "" {
+			env = DefaultPassphraseEnv
+		}
+		opts.passphrase = os.Getenv(env)
+		if opts.passphrase == "" {
+			return nil, fmt.Errorf("no KEK passphrase: %s is not set", env)
+		}
+	}
+	if opts.passphrase == "" {
+		return nil, errors.New("empty KEK passphrase")
+	}
+	return opts, nil
+}
+
+// masterKey returns the AEAD for the master key of f.
+func (o *fileOptions) masterKey(f *fileKEK) (tink.AEAD, error) {
+	var key []byte
+	switch f.KDF {
+	case "none":
+		if o.masterKeyFile == "" {
+			return nil, errors.New("KEK file requires a master-key-file")
+		}
+		bs, err := os.ReadFile(o.masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading KEK master key: %w", err)
+		}
+		if len(bs) != masterKeySize {
+			return nil, fmt.Errorf("KEK master key is %d bytes, want %d", len(bs), masterKeySize)
+		}
+		key = bs
+	case "scrypt":
+		if o.passphrase == "" {
+			return nil, errors.New("KEK file requires a passphrase")
+		}
+		var err error
+		key, err = scrypt.Key([]byte(o.passphrase), f.Salt, f.N, f.R, f.P, masterKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("deriving KEK master key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown KEK file KDF %q", f.KDF)
+	}
+	return subtle.NewXChaCha20Poly1305(key)
+}
+
+func openFile(ctx context.Context, uri string) (tink.AEAD, error) {
+	opts, err := parseFileURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := os.ReadFile(opts.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading KEK file: %w", err)
+	}
+	var f fileKEK
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("parsing KEK file: %w", err)
+	}
+	if f.Version != 1 {
+		return nil, fmt.Errorf("unsupported KEK file version %d", f.Version)
+	}
+	master, err := opts.masterKey(&f)
+	if err != nil {
+		return nil, err
+	}
+	h, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(f.Keyset)), master, keysetAD)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting KEK keyset (wrong passphrase or master key?): %w", err)
+	}
+	return aead.New(h)
+}
+
+// CreateFile creates a new file KEK with a fresh keyset, at the path and
+// protected by the master key or passphrase given by uri, which must have
+// the file scheme. It reports an error if the file already exists.
+func CreateFile(uri string) error {
+	if !strings.HasPrefix(uri, "file://") {
+		return fmt.Errorf("invalid KEK URI %q: only file KEKs can be created", uri)
+	}
+	opts, err := parseFileURI(uri)
+	if err != nil {
+		return err
+	}
+	f := &fileKEK{Version: 1, KDF: "none"}
+	if opts.masterKeyFile == "" {
+		f.KDF, f.Salt, f.N, f.R, f.P = "scrypt", make([]byte, 16), scryptN, scryptR, scryptP
+		rand.Read(f.Salt)
+	}
+	master, err := opts.masterKey(f)
+	if err != nil {
+		return err
+	}
+
+	h, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		return fmt.Errorf("generating KEK keyset: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := h.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), master, keysetAD); err != nil {
+		return fmt.Errorf("encrypting KEK keyset: %w", err)
+	}
+	f.Keyset = buf.Bytes()
+
+	bs, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(opts.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(bs, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package kms provides the key encryption keys (KEKs) that protect setec
+// databases. A KEK is named by a URI, whose scheme selects the provider
+// that supplies it:
+//
+//	aws-kms://arn:aws:kms:<region>:<account>:key/<id>
+//	gcp-kms://projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+//	file:///path/to/kek.json
+//
+// Other providers can be added with Register.
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tink-crypto/tink-go-awskms/v2/integration/awskms"
+	"github.com/tink-crypto/tink-go-gcpkms/v2/integration/gcpkms"
+	"github.com/tink-crypto/tink-go/v2/tink"
+)
+
+// A Provider returns the KEK named by uri, whose scheme is the one for which
+// the provider was registered.
+type Provider func(ctx context.Context, uri string) (tink.AEAD, error)
+
+var (
+	mu        sync.Mutex
+	providers = map[string]Provider{
+		"aws-kms": openAWS,
+		"gcp-kms": openGCP,
+		"file":    openFile,
+	}
+)
+
+// Register registers p as the provider for KEK URIs with the given scheme,
+// replacing any existing provider for it.
+func Register(scheme string, p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[scheme] = p
+}
+
+// Schemes reports the URI schemes that have registered providers, in
+// lexicographic order.
+func Schemes() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Sorted(maps.Keys(providers))
+}
+
+// ErrUnknownScheme is reported, wrapped, by Open for a URI whose scheme has
+// no registered provider.
+var ErrUnknownScheme = errors.New("unknown KEK URI scheme")
+
+// Open returns the KEK named by uri, from the provider registered for its
+// scheme.
+func Open(ctx context.Context, uri string) (tink.AEAD, error) {
+	scheme, _, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid KEK URI %q: no scheme", uri)
+	}
+	mu.Lock()
+	p := providers[scheme]
+	mu.Unlock()
+	if p == nil {
+		return nil, fmt.Errorf("%w %q (known: %s)", ErrUnknownScheme, scheme, strings.Join(Schemes(), ", "))
+	}
+	return p(ctx, uri)
+}
+
+func openAWS(ctx context.Context, uri string) (tink.AEAD, error) {
+	client, err := awskms.NewClientWithOptions(uri)
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS KMS client: %w", err)
+	}
+	aead, err := client.GetAEAD(uri)
+	if err != nil {
+		return nil, fmt.Errorf("getting AWS KMS key handle: %w", err)
+	}
+	return aead, nil
+}
+
+func openGCP(ctx context.Context, uri string) (tink.AEAD, error) {
+	client, err := gcpkms.NewClientWithOptions(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCP KMS client: %w", err)
+	}
+	aead, err := client.GetAEAD(uri)
+	if err != nil {
+		return nil, fmt.Errorf("getting GCP KMS key handle: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kms_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tailscale/setec/internal/tinktestutil"
+	"github.com/tailscale/setec/kms"
+	"github.com/tink-crypto/tink-go/v2/tink"
+)
+
+// checkKEK verifies that kek can decrypt what it encrypts, and returns a
+// ciphertext for later checks.
+func checkKEK(t *testing.T, kek tink.AEAD) []byte {
+	t.Helper()
+	ct, err := kek.Encrypt([]byte("hello"), []byte("ad"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	pt, err := kek.Decrypt(ct, []byte("ad"))
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	} else if string(pt) != "hello" {
+		t.Fatalf("Decrypt: got %q, want %q", pt, "hello")
+	}
+	return ct
+}
+
+func TestFilePassphrase(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "kek.json")
+	uri := "file://" + path
+	t.Setenv(kms.DefaultPassphraseEnv, "open sesame")
+
+	if err := kms.CreateFile(uri); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if err := kms.CreateFile(uri); !errors.Is(err, os.ErrExist) {
+		t.Errorf("CreateFile again: got %v, want %v", err, os.ErrExist)
+	}
+	kek, err := kms.Open(ctx, uri)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ct := checkKEK(t, kek)
+
+	// The same key is loaded again, with the passphrase from another source.
+	ppath := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(ppath, []byte("open sesame\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kek2, err := kms.Open(ctx, uri+"?passphrase-file="+ppath)
+	if err != nil {
+		t.Fatalf("Open with passphrase-file: %v", err)
+	}
+	if pt, err := kek2.Decrypt(ct, []byte("ad")); err != nil || string(pt) != "hello" {
+		t.Errorf("Decrypt with reopened KEK: got %q, %v; want %q", pt, err, "hello")
+	}
+
+	// A wrong passphrase is rejected.
+	t.Setenv("OTHER_PASSPHRASE", "open barley")
+	if _, err := kms.Open(ctx, uri+"?passphrase-env=OTHER_PASSPHRASE"); err == nil {
+		t.Error("Open with wrong passphrase: unexpectedly succeeded")
+	}
+	t.Setenv(kms.DefaultPassphraseEnv, "")
+	if _, err := kms.Open(ctx, uri); err == nil {
+		t.Error("Open without passphrase: unexpectedly succeeded")
+	}
+}
+
+func TestFileMasterKey(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "master.key")
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.Join(dir, "kek.json") + "?master-key-file=" + keyPath
+
+	if err := kms.CreateFile(uri); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	kek, err := kms.Open(ctx, uri)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	checkKEK(t, kek)
+
+	// The wrong master key is rejected.
+	if err := os.WriteFile(keyPath, bytes.Repeat([]byte{'x'}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.Open(ctx, uri); err == nil {
+		t.Error("Open with wrong master key: unexpectedly succeeded")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := t.Context()
+	if _, err := kms.Open(ctx, "nonesuch://key"); !errors.Is(err, kms.ErrUnknownScheme) {
+		t.Errorf("Open nonesuch: got %v, want %v", err, kms.ErrUnknownScheme)
+	}
+	if _, err := kms.Open(ctx, "no-scheme"); err == nil {
+		t.Error("Open without scheme: unexpectedly succeeded")
+	}
+
+	var gotURI string
+	kms.Register("test-kms", func(_ context.Context, uri string) (tink.AEAD, error) {
+		gotURI = uri
+		return &tinktestutil.DummyAEAD{Name: uri}, nil
+	})
+	if !slices.Contains(kms.Schemes(), "test-kms") {
+		t.Errorf("Schemes: got %q, want test-kms included", kms.Schemes())
+	}
+	kek, err := kms.Open(ctx, "test-kms://my-key")
+	if err != nil {
+		t.Fatalf("Open test-kms: %v", err)
+	}
+	if gotURI != "test-kms://my-key" {
+		t.Errorf("Provider: got URI %q, want %q", gotURI, "test-kms://my-key")
+	}
+	checkKEK(t, kek)
+}
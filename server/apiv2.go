@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/types/api"
+	"github.com/tailscale/setec/types/apiv2"
+)
+
+// registerV2 registers the handlers for version 2 of the API on mux.
+func (s *Server) registerV2(mux *http.ServeMux) {
+	mux.HandleFunc(apiv2.PathPrefix+"list", s.listV2)
+	mux.HandleFunc(apiv2.PathPrefix+"get", s.getV2)
+	mux.HandleFunc(apiv2.PathPrefix+"info", s.infoV2)
+	mux.HandleFunc(apiv2.PathPrefix+"put", s.putV2)
+	mux.HandleFunc(apiv2.PathPrefix+"create-version", s.createVersionV2)
+	mux.HandleFunc(apiv2.PathPrefix+"activate", s.activateV2)
+	mux.HandleFunc(apiv2.PathPrefix+"delete", s.deleteV2)
+}
+
+func (s *Server) versions(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.VersionsRequest, id db.Caller) (*api.VersionsResponse, error) {
+		return &api.VersionsResponse{
+			Versions: []int{1, apiv2.Version},
+			Capabilities: []string{
+				api.CapGetMany, api.CapWatch, api.CapListSelect, api.CapUsage, api.CapAuditExport,
+			},
+		}, nil
+	})
+}
+
+func secretInfoV2(info *api.SecretInfo) *apiv2.SecretInfo {
+	return &apiv2.SecretInfo{Name: info.Name, Versions: info.Versions, ActiveVersion: info.ActiveVersion}
+}
+
+func (s *Server) listV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.ListRequest, id db.Caller) (*apiv2.ListResponse, error) {
+		// The page token is the name of the last secret of the previous page.
+		after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid page token", db.ErrInvalidRequest)
+		}
+		lreq := api.ListRequest{Prefix: req.Prefix, Glob: req.Glob, After: string(after)}
+		if req.PageSize > 0 {
+			lreq.Limit = req.PageSize + 1 // to tell whether there is another page
+		}
+		infos, err := s.db.List(id, lreq)
+		if err != nil {
+			return nil, err
+		}
+		rsp := &apiv2.ListResponse{Secrets: make([]*apiv2.SecretInfo, 0, len(infos))}
+		if req.PageSize > 0 && len(infos) > req.PageSize {
+			infos = infos[:req.PageSize]
+			rsp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(infos[len(infos)-1].Name))
+		}
+		for _, info := range infos {
+			rsp.Secrets = append(rsp.Secrets, secretInfoV2(info))
+		}
+		return rsp, nil
+	})
+}
+
+func (s *Server) getV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.GetRequest, id db.Caller) (*apiv2.GetResponse, error) {
+		var sv *api.SecretValue
+		var err error
+		switch {
+		case req.Version == 0:
+			sv, err = s.db.Get(id, req.Name)
+		case req.IfChanged:
+			sv, err = s.db.GetConditional(id, req.Name, req.Version)
+			if errors.Is(err, api.ErrValueNotChanged) {
+				return &apiv2.GetResponse{NotChanged: true}, nil
+			}
+		default:
+			sv, err = s.db.GetVersion(id, req.Name, req.Version)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &apiv2.GetResponse{Value: &apiv2.SecretValue{Value: sv.Value, Version: sv.Version}}, nil
+	})
+}
+
+func (s *Server) infoV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.InfoRequest, id db.Caller) (*apiv2.InfoResponse, error) {
+		info, err := s.db.Info(id, req.Name)
+		if err != nil {
+			return nil, err
+		}
+		return &apiv2.InfoResponse{Secret: secretInfoV2(info)}, nil
+	})
+}
+
+func (s *Server) putV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.PutRequest, id db.Caller) (*apiv2.PutResponse, error) {
+		v, err := s.db.Put(id, req.Name, req.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &apiv2.PutResponse{Version: v}, nil
+	})
+}
+
+func (s *Server) createVersionV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.CreateVersionRequest, id db.Caller) (*apiv2.CreateVersionResponse, error) {
+		if err := s.db.CreateVersion(id, req.Name, req.Version, req.Value); err != nil {
+			return nil, err
+		}
+		return &apiv2.CreateVersionResponse{}, nil
+	})
+}
+
+func (s *Server) activateV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.ActivateRequest, id db.Caller) (*apiv2.ActivateResponse, error) {
+		if err := s.db.Activate(id, req.Name, req.Version); err != nil {
+			return nil, err
+		}
+		return &apiv2.ActivateResponse{}, nil
+	})
+}
+
+func (s *Server) deleteV2(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req apiv2.DeleteRequest, id db.Caller) (*apiv2.DeleteResponse, error) {
+		var err error
+		switch {
+		case req.All && req.Version != 0:
+			return nil, fmt.Errorf("%w: all and version are exclusive", db.ErrInvalidRequest)
+		case req.All:
+			err = s.db.Delete(id, req.Name)
+		case req.Version == 0:
+			// Require deletion of the whole secret to be explicit, so that
+			// an omitted version does not delete every version.
+			return nil, fmt.Errorf("%w: version or all must be set", db.ErrInvalidRequest)
+		default:
+			err = s.db.DeleteVersion(id, req.Name, req.Version)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &apiv2.DeleteResponse{}, nil
+	})
+}
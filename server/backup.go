@@ -20,11 +20,13 @@ func (s *Server) periodicBackup(ctx context.Context) {
 	for {
 		gen := s.db.WriteGen()
 		if gen != lastWriteGen {
-			if err := s.doBackup(ctx); err != nil {
+			err := s.doBackup(ctx)
+			if err != nil {
 				log.Printf("Failed to take backup: %v", err)
 			} else {
 				lastWriteGen = gen
 			}
+			s.recordBackup(gen, err)
 		}
 		select {
 		case <-time.After(time.Minute):
@@ -34,6 +36,17 @@ func (s *Server) periodicBackup(ctx context.Context) {
 	}
 }
 
+// recordBackup records the outcome of a backup of write generation gen, for
+// health checks.
+func (s *Server) recordBackup(gen uint64, err error) {
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+	s.backupErr = err
+	if err == nil {
+		s.backupOK, s.backupGen = time.Now(), gen
+	}
+}
+
 func (s *Server) doBackup(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
@@ -0,0 +1,377 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/types/api"
+)
+
+// The dashboard is served to browsers, so it cannot rely on the
+// Sec-X-Tailscale-No-Browsers header that keeps browsers away from the API.
+// Instead, each form that changes state or reveals a value is protected
+// against cross-site request forgery twice over: the request must not be
+// cross-origin (per Sec-Fetch-Site or Origin), and it must carry a token,
+// bound to the caller's identity, that only a page served to that caller by
+// this server contains.
+
+// csrfWindow is the period for which a CSRF token is issued. A token is
+// accepted during the window in which it was issued and the next one.
+const csrfWindow = 12 * time.Hour
+
+// maxFormSize is the maximum size in bytes of a dashboard form submission.
+const maxFormSize = 1 << 20
+
+// csrfToken returns the CSRF token for caller during the window containing
+// now.
+func (s *Server) csrfToken(caller db.Caller, now time.Time) string {
+	return s.csrfTokenForWindow(caller, now.Unix()/int64(csrfWindow/time.Second))
+}
+
+func (s *Server) csrfTokenForWindow(caller db.Caller, window int64) string {
+	mac := hmac.New(sha256.New, s.csrfKey)
+	fmt.Fprintf(mac, "%d\x00%s", window, callerKey(caller))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF reports whether r is a same-origin request carrying a valid CSRF
+// token for caller.
+func (s *Server) checkCSRF(r *http.Request, caller db.Caller, now time.Time) bool {
+	if err := http.NewCrossOriginProtection().Check(r); err != nil {
+		return false
+	}
+	got := r.PostForm.Get("csrf")
+	if got == "" {
+		return false
+	}
+	window := now.Unix() / int64(csrfWindow/time.Second)
+	for _, w := range []int64{window, window - 1} {
+		if hmac.Equal([]byte(got), []byte(s.csrfTokenForWindow(caller, w))) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCSRFKey returns a new random key for CSRF tokens. Tokens do not survive
+// a restart of the server.
+func newCSRFKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// pageIndex is the data for the index.html template.
+type pageIndex struct {
+	Secrets []*api.SecretInfo
+	Prefix  string // the prefix by which the list is filtered
+	CSRF    string // the CSRF token for the forms on the page
+}
+
+// pageResult is the data for the result.html template.
+type pageResult struct {
+	Title   string
+	Message string
+	Error   bool
+	Secret  string // if set, the secret whose page to link back to
+}
+
+// pageSecret is the data for the secret.html template.
+type pageSecret struct {
+	*db.SecretHistory
+	CSRF string // the CSRF token for the forms on the page
+}
+
+// historyEntries is the number of recent audit log entries shown on the page
+// for a secret.
+const historyEntries = 50
+
+// historyPeriod is how far back in the audit log to look for the history of
+// a secret shown on its page.
+const historyPeriod = 90 * 24 * time.Hour
+
+// principalString returns a short description of p for display.
+func principalString(p audit.Principal) string {
+	who := p.User
+	if who == "" {
+		who = strings.Join(p.Tags, ",")
+	}
+	if p.Hostname != "" {
+		who += " (" + p.Hostname + ")"
+	}
+	return who
+}
+
+// htmlSecret serves the page for the secret named by the path after
+// /secret/, reporting its versions and recent audit log entries.
+func (s *Server) htmlSecret(w http.ResponseWriter, r *http.Request) {
+	const path = "/secret/"
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != "GET" {
+		s.countCallBadRequest.Add(path, 1)
+		s.renderResult(w, http.StatusBadRequest, "invalid method")
+		return
+	}
+	caller, err := s.getIdentity(r)
+	if err != nil {
+		status, msg := identityError(err)
+		s.countIdentityError(path, status)
+		s.renderResult(w, status, msg)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, path)
+	hist, err := s.db.History(caller, name, time.Now().Add(-historyPeriod), historyEntries)
+	if err != nil {
+		status, _ := errorStatus(err)
+		msg := err.Error()
+		switch status {
+		case http.StatusForbidden:
+			s.countCallForbidden.Add(path, 1)
+			msg = "access denied"
+		case http.StatusNotFound:
+			s.countCallNotFound.Add(path, 1)
+		case http.StatusBadRequest:
+			s.countCallBadRequest.Add(path, 1)
+		default:
+			s.countCallInternalError.Add(path, 1)
+			log.Printf("history of %q: %v", name, err)
+			msg = "internal error"
+		}
+		s.renderResult(w, status, msg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.tmpl.ExecuteTemplate(w, "secret.html", pageSecret{
+		SecretHistory: hist,
+		CSRF:          s.csrfToken(caller, time.Now()),
+	}); err != nil {
+		s.countCallInternalError.Add(path, 1)
+		log.Print(err)
+	}
+}
+
+// pageReveal is the data for the reveal.html template.
+type pageReveal struct {
+	Name    string
+	Version api.SecretVersion
+	Value   string
+	Binary  bool // Value is base64-encoded
+}
+
+// serveForm calls fn to handle a form submitted from the dashboard, and
+// renders the template and data it returns. The caller's identity and the
+// request are checked as for serveJSON, except that a CSRF token takes the
+// place of the Sec-X-Tailscale-No-Browsers header.
+func (s *Server) serveForm(w http.ResponseWriter, r *http.Request, fn func(r *http.Request, id db.Caller) (string, any, error)) {
+	path := r.URL.Path
+	s.countCalls.Add(path, 1)
+	start := time.Now()
+	defer func() { s.callLatency.Observe(path, time.Since(start)) }()
+	reqID := rand.Text()
+	w.Header().Set(api.RequestIDHeader, reqID)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != "POST" {
+		s.countCallBadRequest.Add(path, 1)
+		s.renderResult(w, http.StatusBadRequest, "invalid method")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		s.countCallBadRequest.Add(path, 1)
+		s.renderResult(w, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	id, err := s.getIdentity(r)
+	if err != nil {
+		status, msg := identityError(err)
+		s.countIdentityError(path, status)
+		s.renderResult(w, status, msg)
+		return
+	}
+	if !s.checkCSRF(r, id, start) {
+		s.countCallForbidden.Add(path, 1)
+		s.renderResult(w, http.StatusForbidden, "invalid or expired form; reload the page and try again")
+		return
+	}
+	id.Justification = strings.TrimSpace(r.PostForm.Get("justification"))
+	if len(id.Justification) > api.MaxJustificationLen {
+		s.countCallBadRequest.Add(path, 1)
+		s.renderResult(w, http.StatusBadRequest, "justification too long")
+		return
+	}
+	id.Request = &audit.Request{ID: reqID, Path: path, UserAgent: r.UserAgent()}
+
+	if ok, _ := s.limiter.allow(id, path, start); !ok {
+		s.countCallRateLimited.Add(path, 1)
+		s.renderResult(w, http.StatusTooManyRequests, "rate limit exceeded; try again later")
+		return
+	}
+
+	tmpl, data, err := fn(r, id)
+	var areq *api.ApprovalRequiredError
+	if errors.As(err, &areq) {
+		tmpl, data = "result.html", pageResult{
+			Title: "Approval Required",
+			Message: fmt.Sprintf("The %s of %s requires approval by a second person. The pending request ID is %s.",
+				areq.Request.Action, areq.Request.Name, areq.Request.ID),
+			Secret: areq.Request.Name,
+		}
+	} else if err != nil {
+		status, code := errorStatus(err)
+		switch status {
+		case http.StatusBadRequest, http.StatusConflict:
+			s.countCallBadRequest.Add(path, 1)
+		case http.StatusForbidden:
+			s.countCallForbidden.Add(path, 1)
+		case http.StatusNotFound:
+			s.countCallNotFound.Add(path, 1)
+		case http.StatusPreconditionFailed:
+			s.countCallAlreadySet.Add(path, 1)
+		default:
+			s.countCallInternalError.Add(path, 1)
+		}
+		msg := err.Error()
+		switch code {
+		case api.CodeAccessDenied:
+			msg = "access denied" // don't report the cause of the denial
+		case api.CodeInternal:
+			msg = "internal error" // don't leak details of the failure
+		}
+		s.renderResult(w, status, msg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.tmpl.ExecuteTemplate(w, tmpl, data); err != nil {
+		s.countCallInternalError.Add(path, 1)
+		log.Print(err)
+	}
+}
+
+// renderResult renders an error message for a failed form submission.
+func (s *Server) renderResult(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := s.tmpl.ExecuteTemplate(w, "result.html", pageResult{
+		Title:   http.StatusText(status),
+		Message: msg,
+		Error:   true,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// formVersion parses the version field of a dashboard form.
+func formVersion(r *http.Request) (api.SecretVersion, error) {
+	v, err := strconv.ParseUint(r.PostForm.Get("version"), 10, 64)
+	if err != nil || v == 0 {
+		return 0, db.ErrInvalidVersion
+	}
+	return api.SecretVersion(v), nil
+}
+
+func (s *Server) uiPut(w http.ResponseWriter, r *http.Request) {
+	s.serveForm(w, r, func(r *http.Request, id db.Caller) (string, any, error) {
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		version, err := s.db.Put(id, name, []byte(r.PostForm.Get("value")))
+		if err != nil {
+			return "", nil, err
+		}
+		return "result.html", pageResult{
+			Title:   "Value Stored",
+			Message: fmt.Sprintf("Stored version %d of %s.", version, name),
+			Secret:  name,
+		}, nil
+	})
+}
+
+func (s *Server) uiActivate(w http.ResponseWriter, r *http.Request) {
+	s.serveForm(w, r, func(r *http.Request, id db.Caller) (string, any, error) {
+		name := r.PostForm.Get("name")
+		version, err := formVersion(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := s.db.Activate(id, name, version); err != nil {
+			return "", nil, err
+		}
+		return "result.html", pageResult{
+			Title:   "Version Activated",
+			Message: fmt.Sprintf("Version %d of %s is now active.", version, name),
+			Secret:  name,
+		}, nil
+	})
+}
+
+func (s *Server) uiDeleteVersion(w http.ResponseWriter, r *http.Request) {
+	s.serveForm(w, r, func(r *http.Request, id db.Caller) (string, any, error) {
+		name := r.PostForm.Get("name")
+		version, err := formVersion(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := s.db.DeleteVersion(id, name, version); err != nil {
+			return "", nil, err
+		}
+		return "result.html", pageResult{
+			Title:   "Version Deleted",
+			Message: fmt.Sprintf("Deleted version %d of %s.", version, name),
+			Secret:  name,
+		}, nil
+	})
+}
+
+func (s *Server) uiDelete(w http.ResponseWriter, r *http.Request) {
+	s.serveForm(w, r, func(r *http.Request, id db.Caller) (string, any, error) {
+		name := r.PostForm.Get("name")
+		if err := s.db.Delete(id, name); err != nil {
+			return "", nil, err
+		}
+		return "result.html", pageResult{
+			Title:   "Secret Deleted",
+			Message: fmt.Sprintf("Deleted %s and all its versions.", name),
+		}, nil
+	})
+}
+
+// uiReveal shows a secret value. Values are shown only in response to an
+// explicit request, and each is recorded in the audit log like any other
+// get.
+func (s *Server) uiReveal(w http.ResponseWriter, r *http.Request) {
+	s.serveForm(w, r, func(r *http.Request, id db.Caller) (string, any, error) {
+		name := r.PostForm.Get("name")
+		version, err := formVersion(r)
+		if err != nil {
+			return "", nil, err
+		}
+		sv, err := s.db.GetVersion(id, name, version)
+		if err != nil {
+			return "", nil, err
+		}
+		page := pageReveal{Name: name, Version: sv.Version, Value: string(sv.Value)}
+		if !utf8.Valid(sv.Value) {
+			page.Value, page.Binary = base64.StdEncoding.EncodeToString(sv.Value), true
+		}
+		return "reveal.html", page, nil
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+// tailscaleStateTimeout is how long a readiness check waits for the state of
+// the tailnet connection.
+const tailscaleStateTimeout = 5 * time.Second
+
+// healthz reports whether the server is alive: whether its database and
+// audit log are working. It does not require authentication, so the
+// messages it reports must not reveal secret names or values.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.serveHealth(w, r, false)
+}
+
+// readyz reports whether the server is ready to serve: whether, in addition
+// to the checks of healthz, its backups are recent and it is connected to
+// the tailnet. Like healthz, it does not require authentication.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.serveHealth(w, r, true)
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request, ready bool) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid method")
+		return
+	}
+	rsp := s.checkHealth(r.Context(), ready)
+	bs, err := json.Marshal(rsp)
+	if err != nil {
+		panic(err) // cannot happen
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rsp.Status == api.HealthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(bs)
+}
+
+// checkHealth checks the components of the server. If ready is true, it
+// checks the components needed to serve as well as those needed to stay
+// alive.
+func (s *Server) checkHealth(ctx context.Context, ready bool) *api.HealthResponse {
+	rsp := &api.HealthResponse{
+		Status: api.HealthOK,
+		Components: map[string]api.ComponentHealth{
+			api.ComponentDB:    s.dbHealth(),
+			api.ComponentAudit: s.auditHealth(),
+		},
+	}
+	if ready {
+		if s.backupClient != nil {
+			rsp.Components[api.ComponentBackup] = s.backupHealth(time.Now())
+		}
+		if s.tsState != nil {
+			rsp.Components[api.ComponentTailscale] = s.tailscaleHealth(ctx)
+		}
+	}
+	for _, c := range rsp.Components {
+		if healthRank(c.Status) > healthRank(rsp.Status) {
+			rsp.Status = c.Status
+		}
+	}
+	return rsp
+}
+
+// healthRank orders health statuses from best to worst.
+func healthRank(status string) int {
+	switch status {
+	case api.HealthOK:
+		return 0
+	case api.HealthDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (s *Server) dbHealth() api.ComponentHealth {
+	if err := s.db.CheckFile(); err != nil {
+		log.Printf("health: database file unavailable: %v", err)
+		return api.ComponentHealth{Status: api.HealthFailed, Message: "database file unavailable"}
+	}
+	return api.ComponentHealth{Status: api.HealthOK}
+}
+
+func (s *Server) auditHealth() api.ComponentHealth {
+	lastOK, err := s.db.AuditStatus()
+	if err != nil {
+		// The error is logged by the request that failed to write it.
+		return api.ComponentHealth{Status: api.HealthFailed, Message: "last audit log write failed", Updated: lastOK}
+	}
+	return api.ComponentHealth{Status: api.HealthOK, Updated: lastOK}
+}
+
+func (s *Server) backupHealth(now time.Time) api.ComponentHealth {
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	h := api.ComponentHealth{Status: api.HealthOK, Updated: s.backupOK}
+	if s.backupErr != nil {
+		h.Status, h.Message = api.HealthDegraded, "last backup failed"
+	}
+	if s.db.WriteGen() == s.backupGen {
+		return h // every change has been backed up
+	}
+	since := s.backupOK
+	if since.IsZero() {
+		since = s.started
+	}
+	if age := now.Sub(since); age > s.backupMaxAge {
+		h.Status = api.HealthDegraded
+		h.Message = fmt.Sprintf("no backup of recent changes for %v", age.Round(time.Minute))
+	}
+	return h
+}
+
+func (s *Server) tailscaleHealth(ctx context.Context) api.ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, tailscaleStateTimeout)
+	defer cancel()
+	state, err := s.tsState(ctx)
+	if err != nil {
+		log.Printf("health: getting tailscale state: %v", err)
+		return api.ComponentHealth{Status: api.HealthFailed, Message: "tailscale state unavailable"}
+	} else if state != "Running" {
+		return api.ComponentHealth{Status: api.HealthFailed, Message: "tailscale is " + state}
+	}
+	return api.ComponentHealth{Status: api.HealthOK}
+}
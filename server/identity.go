@@ -0,0 +1,320 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/db"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// An IdentityProvider identifies the callers of the server, and reports
+// their permissions.
+type IdentityProvider interface {
+	// Identify reports the identity and permissions of the caller who made
+	// r. It reports an error wrapping ErrNoIdentity if r carries no
+	// credentials the provider recognizes, and an error wrapping
+	// db.ErrAccessDenied if r carries credentials that are not valid.
+	Identify(r *http.Request) (db.Caller, error)
+}
+
+// ErrNoIdentity is reported, wrapped, by an IdentityProvider for a request
+// that carries no credentials it recognizes.
+var ErrNoIdentity = errors.New("no identity")
+
+// ChainIdentity returns an IdentityProvider that tries each of providers in
+// turn, and reports the first identity found. It stops at the first error
+// that does not wrap ErrNoIdentity.
+func ChainIdentity(providers ...IdentityProvider) IdentityProvider {
+	return chainIdentity(slices.Clone(providers))
+}
+
+type chainIdentity []IdentityProvider
+
+func (c chainIdentity) Identify(r *http.Request) (db.Caller, error) {
+	for _, p := range c {
+		id, err := p.Identify(r)
+		if !errors.Is(err, ErrNoIdentity) {
+			return id, err
+		}
+	}
+	return db.Caller{}, ErrNoIdentity
+}
+
+// remoteAddr returns the address of the client who made r.
+func remoteAddr(r *http.Request) (netip.Addr, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("parsing RemoteAddr %q: %w", r.RemoteAddr, err)
+	}
+	return addrPort.Addr(), nil
+}
+
+// TailscaleIdentity is an IdentityProvider that identifies tailnet peers,
+// granting them the permissions in their ACLCap peer capabilities. It is the
+// default provider.
+type TailscaleIdentity struct {
+	// WhoIs reports an identity for a client IP address. Outside of tests,
+	// it is the WhoIs of a Tailscale LocalClient.
+	WhoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// Identify implements IdentityProvider.
+func (t TailscaleIdentity) Identify(r *http.Request) (id db.Caller, err error) {
+	addr, err := remoteAddr(r)
+	if err != nil {
+		return db.Caller{}, err
+	}
+
+	who, err := t.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		if !tsaddr.IsTailscaleIP(addr) {
+			// The caller is not a tailnet peer, so this is not a failure of
+			// the provider.
+			return db.Caller{}, fmt.Errorf("%w: %v is not a tailnet address", ErrNoIdentity, addr)
+		}
+		return db.Caller{}, fmt.Errorf("calling WhoIs: %w", err)
+	}
+
+	if who.Node.IsTagged() {
+		id.Principal.Tags = who.Node.Tags
+	} else if who.UserProfile.LoginName != "" {
+		id.Principal.User = who.UserProfile.LoginName
+	} else {
+		return db.Caller{}, errors.New("failed to find caller identity")
+	}
+	id.Principal.IP = addr
+	id.Principal.Hostname = who.Node.Name
+
+	id.Permissions, err = tailcfg.UnmarshalCapJSON[acl.Rule](who.CapMap, ACLCap)
+
+	// TODO(creachadair): As a temporary measure to allow us to migrate
+	// capability names away from the https:// prefix, if we don't get a result
+	// without the prefix, try again with it. Remove this once the policy has
+	// been updated on the server side.
+	if err == nil && len(id.Permissions) == 0 {
+		id.Permissions, err = tailcfg.UnmarshalCapJSON[acl.Rule](who.CapMap, aclCapHTTP)
+	}
+	if err != nil {
+		return db.Caller{}, fmt.Errorf("unmarshaling peer capabilities: %w", err)
+	}
+	return id, nil
+}
+
+// CertACL is the access control list for callers identified by TLS client
+// certificates. It is usually loaded from a JSON file by LoadCertACL:
+//
+//	{"grants": [
+//	  {"principals": ["spiffe://ci.example.com/deploy"],
+//	   "rules": [{"action": ["get"], "secret": ["ci/deploy/*"]}]}
+//	]}
+type CertACL struct {
+	Grants []CertGrant `json:"grants"`
+}
+
+// CertGrant grants permissions to the holders of certificates with any of
+// the given subject alternative names.
+type CertGrant struct {
+	// Principals are DNS names, email addresses or URIs, matched exactly
+	// against the subject alternative names of a certificate.
+	Principals []string `json:"principals"`
+
+	// Rules are the permissions granted.
+	Rules acl.Rules `json:"rules"`
+}
+
+// LoadCertACL reads a CertACL from the JSON file at path.
+func LoadCertACL(path string) (*CertACL, error) {
+	var a CertACL
+	if err := loadJSONFile(path, &a); err != nil {
+		return nil, err
+	}
+	for i, g := range a.Grants {
+		if len(g.Principals) == 0 {
+			return nil, fmt.Errorf("grant %d: no principals", i)
+		}
+		for j, r := range g.Rules {
+			if err := r.Validate(); err != nil {
+				return nil, fmt.Errorf("grant %d rule %d: %w", i, j, err)
+			}
+		}
+	}
+	return &a, nil
+}
+
+// CertPrincipalPrefix is the prefix of the user names recorded in the audit
+// log for callers identified by CertIdentity.
+const CertPrincipalPrefix = "cert:"
+
+// CertIdentity is an IdentityProvider that identifies callers by the TLS
+// client certificates they present. The certificate must have been verified
+// by the TLS server, typically by setting its ClientCAs, and ClientAuth to
+// tls.VerifyClientCertIfGiven.
+//
+// A caller's principal is the user CertPrincipalPrefix+name, where name is
+// the first subject alternative name of their certificate to which ACL grants
+// permissions, or if there is none, its first subject alternative name. The
+// prefix keeps certificate holders distinct from tailnet users of the same
+// name. Their permissions are the rules of every grant to any of the names of
+// the certificate.
+type CertIdentity struct {
+	ACL *CertACL
+}
+
+// Identify implements IdentityProvider.
+func (c CertIdentity) Identify(r *http.Request) (db.Caller, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return db.Caller{}, ErrNoIdentity
+	}
+	addr, err := remoteAddr(r)
+	if err != nil {
+		return db.Caller{}, err
+	}
+	names := certNames(r.TLS.VerifiedChains[0][0])
+	if len(names) == 0 {
+		return db.Caller{}, fmt.Errorf("%w: client certificate has no subject alternative names", db.ErrAccessDenied)
+	}
+
+	id := db.Caller{}
+	id.Principal.IP = addr
+	for _, g := range c.ACL.Grants {
+		for _, name := range names {
+			if slices.Contains(g.Principals, name) {
+				if id.Principal.User == "" {
+					id.Principal.User = CertPrincipalPrefix + name
+				}
+				id.Permissions = append(id.Permissions, g.Rules...)
+				break
+			}
+		}
+	}
+	if id.Principal.User == "" {
+		id.Principal.User = CertPrincipalPrefix + names[0]
+	}
+	return id, nil
+}
+
+// certNames returns the subject alternative names of cert.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
+
+// TokenPrincipalPrefix is the prefix of the user names recorded in the audit
+// log for callers identified by TokenIdentity.
+const TokenPrincipalPrefix = "token:"
+
+// StaticToken is a bearer token accepted by TokenIdentity.
+type StaticToken struct {
+	// Name identifies the holder of the token. It is recorded in the audit
+	// log as the user TokenPrincipalPrefix+Name.
+	Name string `json:"name"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the token. The token itself
+	// is not stored by the server.
+	SHA256 string `json:"sha256"`
+
+	// Rules are the permissions granted to the holder of the token.
+	Rules acl.Rules `json:"rules"`
+}
+
+// LoadTokens reads a list of static tokens from the JSON file at path:
+//
+//	{"tokens": [
+//	  {"name": "ci-deploy", "sha256": "<hex>",
+//	   "rules": [{"action": ["get"], "secret": ["ci/deploy/*"]}]}
+//	]}
+func LoadTokens(path string) ([]StaticToken, error) {
+	var f struct {
+		Tokens []StaticToken `json:"tokens"`
+	}
+	if err := loadJSONFile(path, &f); err != nil {
+		return nil, err
+	}
+	for i, t := range f.Tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d: no name", i)
+		}
+		if h, err := hex.DecodeString(t.SHA256); err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("token %q: invalid sha256", t.Name)
+		}
+		for j, r := range t.Rules {
+			if err := r.Validate(); err != nil {
+				return nil, fmt.Errorf("token %q rule %d: %w", t.Name, j, err)
+			}
+		}
+	}
+	return f.Tokens, nil
+}
+
+// TokenIdentity is an IdentityProvider that identifies callers by a static
+// bearer token, given as "Authorization: Bearer <token>".
+type TokenIdentity struct {
+	Tokens []StaticToken
+}
+
+// Identify implements IdentityProvider.
+func (t TokenIdentity) Identify(r *http.Request) (db.Caller, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return db.Caller{}, ErrNoIdentity
+	}
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return db.Caller{}, ErrNoIdentity
+	}
+	addr, err := remoteAddr(r)
+	if err != nil {
+		return db.Caller{}, err
+	}
+
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	got := hex.EncodeToString(sum[:])
+	for _, st := range t.Tokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(strings.ToLower(st.SHA256))) == 1 {
+			id := db.Caller{Permissions: st.Rules}
+			id.Principal.User = TokenPrincipalPrefix + st.Name
+			id.Principal.IP = addr
+			return id, nil
+		}
+	}
+	return db.Caller{}, fmt.Errorf("%w: invalid bearer token", db.ErrAccessDenied)
+}
+
+// loadJSONFile decodes the JSON file at path into v, rejecting unknown
+// fields so that mistakes in access control files are not ignored.
+func loadJSONFile(path string, v any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the bucket boundaries, in seconds, of the histograms of
+// API call latency. Watch calls may take minutes.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// methodHistogram is a histogram of durations for each API method. It is an
+// expvar.Var, and writes itself in Prometheus format with a "method" label.
+type methodHistogram struct {
+	buckets []float64
+
+	mu sync.Mutex
+	m  map[string]*histogramData // :: method name → observations
+}
+
+type histogramData struct {
+	Counts []int64 // :: bucket index → observations ≤ bucket bound
+	Count  int64   // all observations
+	Sum    float64 // sum of all observations
+}
+
+func newMethodHistogram(buckets []float64) *methodHistogram {
+	return &methodHistogram{buckets: buckets, m: make(map[string]*histogramData)}
+}
+
+// Observe records that a call to method took d.
+func (h *methodHistogram) Observe(method string, d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hd, ok := h.m[method]
+	if !ok {
+		hd = &histogramData{Counts: make([]int64, len(h.buckets))}
+		h.m[method] = hd
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hd.Counts[i]++
+		}
+	}
+	hd.Count++
+	hd.Sum += v
+}
+
+// String implements expvar.Var, encoding the histogram as JSON.
+func (h *methodHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bs, err := json.Marshal(h.m)
+	if err != nil {
+		return "{}"
+	}
+	return string(bs)
+}
+
+// WritePrometheus writes the histogram to w in Prometheus exposition format.
+// It implements the interface that the tsweb debug handler uses to export
+// metrics with labels.
+func (h *methodHistogram) WritePrometheus(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, method := range slices.Sorted(maps.Keys(h.m)) {
+		hd := h.m[method]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{method=%q,le=%q} %d\n",
+				name, method, strconv.FormatFloat(b, 'g', -1, 64), hd.Counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{method=%q,le=\"+Inf\"} %d\n", name, method, hd.Count)
+		fmt.Fprintf(w, "%s_sum{method=%q} %v\n", name, method, hd.Sum)
+		fmt.Fprintf(w, "%s_count{method=%q} %d\n", name, method, hd.Count)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/setec/db"
+)
+
+// A RateLimit is a token-bucket limit on the rate of API calls.
+type RateLimit struct {
+	// Rate is the sustained rate of calls permitted, per second.
+	Rate float64
+
+	// Burst is the number of calls permitted in a burst. If it is less than
+	// 1, 1 is used.
+	Burst int
+}
+
+// DefaultRateLimit is the key in Config.RateLimits for the limit on methods
+// that are not otherwise listed.
+const DefaultRateLimit = "*"
+
+// maxRateBuckets is the number of token buckets at which the rate limiter
+// discards buckets that are full, to bound its memory use.
+const maxRateBuckets = 10000
+
+// rateLimiter enforces rate limits on API calls for each caller and method.
+type rateLimiter struct {
+	limits map[string]RateLimit // :: method name → limit
+
+	mu      sync.Mutex
+	buckets map[rateKey]*tokenBucket
+}
+
+type rateKey struct {
+	caller, method string
+}
+
+type tokenBucket struct {
+	tokens float64   // available at last
+	last   time.Time // when tokens was last updated
+}
+
+func newRateLimiter(limits map[string]RateLimit) *rateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &rateLimiter{limits: limits, buckets: make(map[rateKey]*tokenBucket)}
+}
+
+// limit reports the rate limit for method, if any.
+func (rl *rateLimiter) limit(method string) (RateLimit, bool) {
+	lim, ok := rl.limits[method]
+	if !ok {
+		lim, ok = rl.limits[DefaultRateLimit]
+	}
+	if !ok || lim.Rate <= 0 {
+		return RateLimit{}, false
+	}
+	lim.Burst = max(lim.Burst, 1)
+	return lim, true
+}
+
+// allow reports whether the caller may call method at time now. If not, it
+// also reports how long the caller must wait before the call is allowed.
+// A nil *rateLimiter allows all calls.
+func (rl *rateLimiter) allow(caller db.Caller, method string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	lim, ok := rl.limit(method)
+	if !ok {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	key := rateKey{caller: callerKey(caller), method: method}
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= maxRateBuckets {
+			rl.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: float64(lim.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = min(float64(lim.Burst), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / lim.Rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// pruneLocked discards the buckets that would be full at time now, which
+// behave the same as new buckets. rl.mu must be held.
+func (rl *rateLimiter) pruneLocked(now time.Time) {
+	for key, b := range rl.buckets {
+		lim, _ := rl.limit(key.method)
+		if b.tokens+now.Sub(b.last).Seconds()*lim.Rate >= float64(lim.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// callerKey returns the identity by which calls by caller are limited: its
+// user, or if it has no user, its tags.
+func callerKey(caller db.Caller) string {
+	if caller.Principal.User != "" {
+		return caller.Principal.User
+	}
+	tags := slices.Clone(caller.Principal.Tags)
+	slices.Sort(tags)
+	return strings.Join(tags, ",")
+}
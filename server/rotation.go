@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/types/api"
+)
+
+func (s *Server) periodicRotate(ctx context.Context, policies []db.RotationPolicy, every time.Duration) {
+	for {
+		if err := s.db.Rotate(policies, time.Now()); err != nil {
+			log.Printf("Failed to rotate secrets: %v", err)
+			s.countRotationErrors.Add(1)
+		}
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LoadRotationPolicies reads rotation policies from the JSON file at path.
+// Durations are strings in the form accepted by time.ParseDuration:
+//
+//	{"policies": [
+//	  {"prefix": "prod/hmac/", "interval": "720h",
+//	   "generate": {"type": "bytes", "length": 32},
+//	   "activationDelay": "24h", "keep": 2}
+//	]}
+func LoadRotationPolicies(path string) ([]db.RotationPolicy, error) {
+	var f struct {
+		Policies []struct {
+			Prefix          string           `json:"prefix"`
+			Interval        string           `json:"interval"`
+			Generate        api.GenerateSpec `json:"generate"`
+			ActivationDelay string           `json:"activationDelay"`
+			Keep            int              `json:"keep"`
+		} `json:"policies"`
+	}
+	if err := loadJSONFile(path, &f); err != nil {
+		return nil, err
+	}
+	var out []db.RotationPolicy
+	for i, jp := range f.Policies {
+		p := db.RotationPolicy{Prefix: jp.Prefix, Generate: jp.Generate, Keep: jp.Keep}
+		var err error
+		if p.Interval, err = time.ParseDuration(jp.Interval); err != nil {
+			return nil, fmt.Errorf("policy %d: interval: %w", i, err)
+		}
+		if jp.ActivationDelay != "" {
+			if p.ActivationDelay, err = time.ParseDuration(jp.ActivationDelay); err != nil {
+				return nil, fmt.Errorf("policy %d: activation delay: %w", i, err)
+			}
+		}
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("policy %d (%q): %w", i, p.Prefix, err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
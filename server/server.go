@@ -5,7 +5,9 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -14,14 +16,17 @@ import (
 	"html/template"
 	"log"
 	"net/http"
-	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/types/api"
@@ -29,6 +34,7 @@ import (
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 )
 
 // Config is the configuration for a Server.
@@ -52,9 +58,45 @@ type Config struct {
 
 	// WhoIs is a function that reports an identity for a client IP
 	// address. Outside of tests, it will be the WhoIs of a Tailscale
-	// LocalClient.
+	// LocalClient. It is used to identify callers if Identity is nil.
 	WhoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
 
+	// Identity, if non-nil, identifies the callers of the server. If nil,
+	// callers are identified as tailnet peers by TailscaleIdentity, using
+	// WhoIs. To accept other credentials as well as tailnet identities,
+	// combine providers with ChainIdentity.
+	Identity IdentityProvider
+
+	// Approval, if non-nil, is the two-person approval policy for the
+	// database. If nil, no operations require approval.
+	Approval *db.ApprovalPolicy
+
+	// UsageHistory is how far back in the audit log to look for reads of
+	// secrets when the server starts, to initialize usage statistics. If
+	// zero, 30 days is used; if negative, usage is recorded only from when
+	// the server starts.
+	UsageHistory time.Duration
+
+	// RateLimits, if non-empty, limit the rate at which each caller may call
+	// each API method. The keys are API method paths, such as "/api/get", or
+	// DefaultRateLimit for the limit on methods not listed. Calls beyond the
+	// limit are rejected with 429 Too Many Requests. Methods with no limit
+	// are not limited.
+	RateLimits map[string]RateLimit
+
+	// RotationPolicies, if non-empty, are the policies for automatic
+	// rotation of secrets. The server applies them every RotationCheck.
+	RotationPolicies []db.RotationPolicy
+
+	// RotationCheck is how often the server applies RotationPolicies. If
+	// zero, 1 minute is used.
+	RotationCheck time.Duration
+
+	// TailscaleState, if non-nil, reports the state of the server's
+	// tailnet connection, such as "Running", for health checks. Outside of
+	// tests, it reports the BackendState of a Tailscale LocalClient.
+	TailscaleState func(context.Context) (string, error)
+
 	// Mux is the http.ServeMux on which the server registers its HTTP
 	// handlers. It must be non-nil.
 	Mux *http.ServeMux
@@ -79,15 +121,40 @@ type Config struct {
 	// SDK. If BackupAssumeRole is empty, backups are written without
 	// assuming a role.
 	BackupAssumeRole string
+
+	// BackupMaxAge is how long changes to the database may go without a
+	// successful backup before health checks report backups as degraded.
+	// If zero, 1 hour is used.
+	BackupMaxAge time.Duration
 }
 
+// defaultUsageHistory is the default value of Config.UsageHistory.
+const defaultUsageHistory = 30 * 24 * time.Hour
+
+// defaultBackupMaxAge is the default value of Config.BackupMaxAge.
+const defaultBackupMaxAge = time.Hour
+
+// defaultRotationCheck is the default value of Config.RotationCheck.
+const defaultRotationCheck = time.Minute
+
 // Server is a secrets HTTP server.
 type Server struct {
 	db           *db.DB
-	whois        func(context.Context, string) (*apitype.WhoIsResponse, error)
+	identity     IdentityProvider
 	tmpl         *template.Template
 	backupClient *s3.Client
 	backupBucket string
+	backupMaxAge time.Duration
+	tsState      func(context.Context) (string, error) // nil if unknown
+	logInvalid   logger.Logf                           // rate-limited log for invalid grants
+	limiter      *rateLimiter                          // nil if calls are not rate limited
+	started      time.Time
+	csrfKey      []byte // key for dashboard CSRF tokens
+
+	backupMu  sync.Mutex
+	backupOK  time.Time // when the last successful backup finished
+	backupGen uint64    // the write generation of the last successful backup
+	backupErr error     // the error from the last backup attempt, or nil
 
 	// Metrics
 	countCalls             *metrics.LabelMap // :: method name → count
@@ -96,6 +163,10 @@ type Server struct {
 	countCallNotFound      *metrics.LabelMap // :: method name → count
 	countCallInternalError *metrics.LabelMap // :: method name → count
 	countCallAlreadySet    *metrics.LabelMap // :: method name → count
+	countCallRateLimited   *metrics.LabelMap // :: method name → count
+	callLatency            *methodHistogram  // :: method name → durations
+	countInvalidGrants     expvar.Int        // callers presenting invalid rules
+	countRotationErrors    expvar.Int        // failed rotations of secrets
 }
 
 //go:embed templates
@@ -115,19 +186,38 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 		}
 	}
 
+	if cfg.Approval != nil {
+		kdb.SetApprovalPolicy(*cfg.Approval)
+		log.Printf("Two-person approval is enabled; pending requests are held in memory and discarded on restart")
+	}
+	if cfg.UsageHistory >= 0 {
+		hist := cmp.Or(cfg.UsageHistory, defaultUsageHistory)
+		if err := kdb.LoadUsage(time.Now().Add(-hist)); errors.Is(err, audit.ErrNotSearchable) {
+			// Usage is recorded from now on.
+		} else if err != nil {
+			return nil, fmt.Errorf("loading usage from audit log: %w", err)
+		}
+	}
+
 	tmpl := template.New("").Funcs(template.FuncMap{
 		"lastSecretVersion": func(i int, l []api.SecretVersion) bool {
 			return i == len(l)-1
 		},
+		"principal": principalString,
 	})
 	if _, err := tmpl.ParseFS(dashboardTemplates, "templates/*.html"); err != nil {
 		return nil, fmt.Errorf("parsing dashboard templates: %w", err)
 	}
 
 	ret := &Server{
-		db:    kdb,
-		whois: cfg.WhoIs,
-		tmpl:  tmpl,
+		db:         kdb,
+		identity:   cfg.Identity,
+		tmpl:       tmpl,
+		tsState:    cfg.TailscaleState,
+		logInvalid: logger.RateLimitedFn(log.Printf, time.Minute, 10, 100),
+		limiter:    newRateLimiter(cfg.RateLimits),
+		started:    time.Now(),
+		csrfKey:    newCSRFKey(),
 
 		countCalls:             &metrics.LabelMap{Label: "method"},
 		countCallBadRequest:    &metrics.LabelMap{Label: "method"},
@@ -135,6 +225,12 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 		countCallNotFound:      &metrics.LabelMap{Label: "method"},
 		countCallInternalError: &metrics.LabelMap{Label: "method"},
 		countCallAlreadySet:    &metrics.LabelMap{Label: "method"},
+		countCallRateLimited:   &metrics.LabelMap{Label: "method"},
+		callLatency:            newMethodHistogram(latencyBuckets),
+	}
+
+	if ret.identity == nil {
+		ret.identity = TailscaleIdentity{WhoIs: cfg.WhoIs}
 	}
 
 	if cfg.BackupBucket != "" {
@@ -144,19 +240,52 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 		}
 		ret.backupClient = s3Client
 		ret.backupBucket = cfg.BackupBucket
+		ret.backupMaxAge = cmp.Or(cfg.BackupMaxAge, defaultBackupMaxAge)
 		go ret.periodicBackup(ctx)
 	}
 
+	if len(cfg.RotationPolicies) != 0 {
+		for i, p := range cfg.RotationPolicies {
+			if err := p.Validate(); err != nil {
+				return nil, fmt.Errorf("rotation policy %d (%q): %w", i, p.Prefix, err)
+			}
+		}
+		go ret.periodicRotate(ctx, slices.Clone(cfg.RotationPolicies), cmp.Or(cfg.RotationCheck, defaultRotationCheck))
+	}
+
 	cfg.Mux.HandleFunc("/", ret.htmlList)
+	cfg.Mux.HandleFunc("/secret/", ret.htmlSecret)
+	cfg.Mux.HandleFunc("/ui/put", ret.uiPut)
+	cfg.Mux.HandleFunc("/ui/activate", ret.uiActivate)
+	cfg.Mux.HandleFunc("/ui/delete-version", ret.uiDeleteVersion)
+	cfg.Mux.HandleFunc("/ui/delete", ret.uiDelete)
+	cfg.Mux.HandleFunc("/ui/reveal", ret.uiReveal)
+	cfg.Mux.HandleFunc("/healthz", ret.healthz)
+	cfg.Mux.HandleFunc("/readyz", ret.readyz)
 	cfg.Mux.Handle("/static/", http.FileServer(http.FS(staticFiles)))
 	cfg.Mux.HandleFunc("/api/list", ret.list)
 	cfg.Mux.HandleFunc("/api/get", ret.get)
+	cfg.Mux.HandleFunc("/api/get-many", ret.getMany)
 	cfg.Mux.HandleFunc("/api/info", ret.info)
+	cfg.Mux.HandleFunc("/api/watch", ret.watch)
 	cfg.Mux.HandleFunc("/api/put", ret.put)
+	cfg.Mux.HandleFunc("/api/generate", ret.generate)
 	cfg.Mux.HandleFunc("/api/create-version", ret.createVersion)
 	cfg.Mux.HandleFunc("/api/activate", ret.activate)
 	cfg.Mux.HandleFunc("/api/delete", ret.deleteSecret)
 	cfg.Mux.HandleFunc("/api/delete-version", ret.deleteVersion)
+	cfg.Mux.HandleFunc("/api/pending", ret.listPending)
+	cfg.Mux.HandleFunc("/api/approve", ret.approve)
+	cfg.Mux.HandleFunc("/api/reject", ret.reject)
+	cfg.Mux.HandleFunc("/api/audit", ret.searchAudit)
+	cfg.Mux.HandleFunc("/api/audit/export", ret.exportAudit)
+	cfg.Mux.HandleFunc("/api/audit/export-key", ret.auditExportKey)
+	cfg.Mux.HandleFunc("/api/usage", ret.usage)
+	cfg.Mux.HandleFunc("/api/whoami", ret.whoami)
+	cfg.Mux.HandleFunc("/api/check", ret.check)
+	cfg.Mux.HandleFunc("/api/versions", ret.versions)
+	ret.registerV2(cfg.Mux)
+	cfg.Mux.HandleFunc("/api/", unknownMethod)
 
 	return ret, nil
 }
@@ -183,6 +312,14 @@ func (s *Server) Metrics() expvar.Var {
 	m.Set("counter_api_bad_request", s.countCallBadRequest)
 	m.Set("counter_api_forbidden", s.countCallForbidden)
 	m.Set("counter_api_internal_error", s.countCallInternalError)
+	m.Set("counter_api_not_found", s.countCallNotFound)
+	m.Set("counter_api_already_set", s.countCallAlreadySet)
+	m.Set("counter_api_rate_limited", s.countCallRateLimited)
+	m.Set("histogram_api_latency_seconds", s.callLatency)
+	m.Set("counter_invalid_grants", &s.countInvalidGrants)
+	m.Set("counter_rotation_errors", &s.countRotationErrors)
+	m.Set("counter_break_glass", s.db.BreakGlassCount())
+	m.Set("db", s.db.Metrics())
 	return m
 }
 
@@ -197,12 +334,14 @@ func (s *Server) htmlList(w http.ResponseWriter, r *http.Request) {
 
 	caller, err := s.getIdentity(r)
 	if err != nil {
-		s.countCallInternalError.Add(path, 1)
-		http.Error(w, "unable to identify caller", http.StatusInternalServerError)
+		status, msg := identityError(err)
+		s.countIdentityError(path, status)
+		http.Error(w, msg, status)
 		return
 	}
 
-	infos, err := s.db.List(caller)
+	prefix := r.URL.Query().Get("prefix")
+	infos, err := s.db.List(caller, api.ListRequest{Prefix: prefix})
 	if errors.Is(err, db.ErrAccessDenied) {
 		s.countCallForbidden.Add(path, 1)
 		http.Error(w, "access denied", http.StatusForbidden)
@@ -213,7 +352,13 @@ func (s *Server) htmlList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.tmpl.ExecuteTemplate(w, "index.html", infos); err != nil {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.tmpl.ExecuteTemplate(w, "index.html", pageIndex{
+		Secrets: infos,
+		Prefix:  prefix,
+		CSRF:    s.csrfToken(caller, time.Now()),
+	}); err != nil {
 		s.countCallInternalError.Add(path, 1)
 		log.Print(err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
@@ -223,7 +368,7 @@ func (s *Server) htmlList(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) list(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.ListRequest, id db.Caller) ([]*api.SecretInfo, error) {
-		return s.db.List(id)
+		return s.db.List(id, req)
 	})
 }
 
@@ -242,6 +387,42 @@ func (s *Server) get(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// maxGetMany is the maximum number of secrets in a get-many request.
+const maxGetMany = 1000
+
+func (s *Server) getMany(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.GetManyRequest, id db.Caller) (*api.GetManyResponse, error) {
+		if len(req.Secrets) > maxGetMany {
+			return nil, fmt.Errorf("%w: too many secrets (%d > %d)", db.ErrInvalidRequest, len(req.Secrets), maxGetMany)
+		}
+		rsp := &api.GetManyResponse{Results: make([]api.GetManyResult, len(req.Secrets))}
+		for i, item := range req.Secrets {
+			var sv *api.SecretValue
+			var err error
+			if item.Version != 0 {
+				sv, err = s.db.GetConditional(id, item.Name, item.Version)
+			} else {
+				sv, err = s.db.Get(id, item.Name)
+			}
+			res := &rsp.Results[i]
+			res.Name = item.Name
+			switch {
+			case err == nil:
+				res.Value = sv
+			case errors.Is(err, api.ErrValueNotChanged):
+				res.NotChanged = true
+			case errors.Is(err, db.ErrAccessDenied):
+				res.Error = api.ErrorAccessDenied
+			case errors.Is(err, db.ErrNotFound):
+				res.Error = api.ErrorNotFound
+			default:
+				res.Error = "internal error"
+			}
+		}
+		return rsp, nil
+	})
+}
+
 func (s *Server) info(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.InfoRequest, id db.Caller) (*api.SecretInfo, error) {
 		return s.db.Info(id, req.Name)
@@ -254,6 +435,12 @@ func (s *Server) put(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.GenerateRequest, id db.Caller) (api.SecretVersion, error) {
+		return s.db.Generate(id, req.Name, req.Spec)
+	})
+}
+
 func (s *Server) createVersion(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.CreateVersionRequest, id db.Caller) (struct{}, error) {
 		if err := s.db.CreateVersion(id, req.Name, req.Version, req.Value); err != nil {
@@ -286,48 +473,171 @@ func (s *Server) deleteSecret(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) listPending(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.ListPendingRequest, id db.Caller) ([]*api.PendingRequest, error) {
+		return s.db.ListPending(id)
+	})
+}
+
+func (s *Server) approve(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.ApproveRequest, id db.Caller) (struct{}, error) {
+		err := s.db.Approve(id, req.ID)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) reject(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.RejectRequest, id db.Caller) (struct{}, error) {
+		err := s.db.Reject(id, req.ID)
+		return struct{}{}, err
+	})
+}
+
+// maxAuditResults is the maximum number of entries reported by a search of
+// the audit log.
+const maxAuditResults = 10000
+
+func (s *Server) searchAudit(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.AuditRequest, id db.Caller) ([]*audit.Entry, error) {
+		return s.db.SearchAudit(id, auditQuery(req))
+	})
+}
+
+// defaultWatchTimeout and maxWatchTimeout are the default and maximum times
+// a watch request waits for a change.
+const (
+	defaultWatchTimeout = time.Minute
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.WatchRequest, id db.Caller) (*api.WatchResponse, error) {
+		timeout := min(time.Duration(req.TimeoutSeconds)*time.Second, maxWatchTimeout)
+		if timeout <= 0 {
+			timeout = defaultWatchTimeout
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		changed, err := s.db.Watch(ctx, id, req.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		return &api.WatchResponse{Changed: changed}, nil
+	})
+}
+
+func (s *Server) usage(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.UsageRequest, id db.Caller) (*api.UsageResponse, error) {
+		return s.db.Usage(id, req.Name, req.Days)
+	})
+}
+
+func (s *Server) exportAudit(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.AuditRequest, id db.Caller) (*audit.Export, error) {
+		return s.db.ExportAudit(id, auditQuery(req))
+	})
+}
+
+func (s *Server) auditExportKey(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.AuditExportKeyRequest, id db.Caller) (*api.AuditExportKeyResponse, error) {
+		key, err := s.db.AuditExportKey()
+		if err != nil {
+			return nil, err
+		}
+		return &api.AuditExportKeyResponse{PublicKey: key}, nil
+	})
+}
+
+// auditQuery returns the audit log query for req, limited to at most
+// maxAuditResults entries.
+func auditQuery(req api.AuditRequest) audit.Query {
+	if req.Limit <= 0 || req.Limit > maxAuditResults {
+		req.Limit = maxAuditResults
+	}
+	return audit.Query{
+		Principal:  req.Principal,
+		Tag:        req.Tag,
+		Secret:     req.Secret,
+		Action:     req.Action,
+		Authorized: req.Authorized,
+		Since:      req.Since,
+		Until:      req.Until,
+		Limit:      req.Limit,
+	}
+}
+
+func (s *Server) whoami(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.WhoAmIRequest, id db.Caller) (*api.WhoAmIResponse, error) {
+		return &api.WhoAmIResponse{
+			Hostname:    id.Principal.Hostname,
+			IP:          id.Principal.IP,
+			User:        id.Principal.User,
+			Tags:        id.Principal.Tags,
+			Permissions: id.Permissions,
+		}, nil
+	})
+}
+
+func (s *Server) check(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.CheckRequest, id db.Caller) (*api.CheckResponse, error) {
+		d := id.Permissions.Check(req.Action, req.Name)
+		return &api.CheckResponse{
+			Allowed:    d.Allowed,
+			Rule:       d.Rule,
+			BreakGlass: d.BreakGlass,
+			Reason:     d.Reason,
+		}, nil
+	})
+}
+
 // ACLCap is the capability name used for setec ACL permissions.
 const ACLCap tailcfg.PeerCapability = "tailscale.com/cap/secrets"
 
 const aclCapHTTP = "https://" + ACLCap
 
 // getIdentity extracts identity and permissions from an HTTP request.
-func (s *Server) getIdentity(r *http.Request) (id db.Caller, err error) {
-	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+func (s *Server) getIdentity(r *http.Request) (db.Caller, error) {
+	id, err := s.identity.Identify(r)
 	if err != nil {
-		return db.Caller{}, fmt.Errorf("parsing RemoteAddr %q: %w", r.RemoteAddr, err)
+		return db.Caller{}, err
 	}
+	id.Justification = strings.TrimSpace(r.Header.Get(api.JustificationHeader))
+	s.checkGrants(id)
+	return id, nil
+}
 
-	who, err := s.whois(r.Context(), r.RemoteAddr)
-	if err != nil {
-		return db.Caller{}, fmt.Errorf("calling WhoIs: %w", err)
+// identityError returns the HTTP status, and the message to report, for an
+// error identifying the caller of a request.
+func identityError(err error) (int, string) {
+	if errors.Is(err, db.ErrAccessDenied) || errors.Is(err, ErrNoIdentity) {
+		return http.StatusForbidden, "access denied"
 	}
+	log.Printf("identifying caller: %v", err)
+	return http.StatusInternalServerError, "unable to identify caller"
+}
 
-	if who.Node.IsTagged() {
-		// TODO: when we have audit logs, put together a better identity struct with more info
-		id.Principal.Tags = who.Node.Tags
-	} else if who.UserProfile.LoginName != "" {
-		id.Principal.User = who.UserProfile.LoginName
+// countIdentityError counts a failure to identify the caller of method,
+// reported with the given HTTP status.
+func (s *Server) countIdentityError(method string, status int) {
+	if status == http.StatusForbidden {
+		s.countCallForbidden.Add(method, 1)
 	} else {
-		return db.Caller{}, errors.New("failed to find caller identity")
+		s.countCallInternalError.Add(method, 1)
 	}
-	id.Principal.IP = addrPort.Addr()
-	id.Principal.Hostname = who.Node.Name
-
-	id.Permissions, err = tailcfg.UnmarshalCapJSON[acl.Rule](who.CapMap, ACLCap)
+}
 
-	// TODO(creachadair): As a temporary measure to allow us to migrate
-	// capability names away from the https:// prefix, if we don't get a result
-	// without the prefix, try again with it. Remove this once the policy has
-	// been updated on the server side.
-	if err == nil && len(id.Permissions) == 0 {
-		id.Permissions, err = tailcfg.UnmarshalCapJSON[acl.Rule](who.CapMap, aclCapHTTP)
-	}
-	if err != nil {
-		return db.Caller{}, fmt.Errorf("unmarshaling peer capabilities: %w", err)
+// checkGrants reports any malformed rules granted to id. Malformed rules are
+// retained, since they cannot grant more than their well-formed parts permit,
+// but they usually indicate a mistake in the tailnet policy that would
+// otherwise go unnoticed.
+func (s *Server) checkGrants(id db.Caller) {
+	for i, r := range id.Permissions {
+		if err := r.Validate(); err != nil {
+			s.countInvalidGrants.Add(1)
+			s.logInvalid("WARNING: invalid setec grant for %s (%s) rule %d: %v",
+				id.Principal.Hostname, id.Principal.IP, i, err)
+		}
 	}
-
-	return id, nil
 }
 
 // serveJSON calls fn to handle a JSON API request. fn is invoked with
@@ -337,15 +647,19 @@ func (s *Server) getIdentity(r *http.Request) (id db.Caller, err error) {
 func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Request, fn func(r REQ, id db.Caller) (RESP, error)) {
 	apiMethod := r.URL.Path
 	s.countCalls.Add(apiMethod, 1)
+	start := time.Now()
+	defer func() { s.callLatency.Observe(apiMethod, time.Since(start)) }()
+	reqID := rand.Text()
+	w.Header().Set(api.RequestIDHeader, reqID)
 
 	if r.Method != "POST" {
 		s.countCallBadRequest.Add(apiMethod, 1)
-		http.Error(w, "only POST requests allowed", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "only POST requests allowed")
 		return
 	}
 	if c := r.Header.Get("Content-Type"); c != "application/json" {
 		s.countCallBadRequest.Add(apiMethod, 1)
-		http.Error(w, "request body must be json", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "request body must be json")
 		return
 	}
 	// Block any attempt to access the API from browsers. Longer term
@@ -357,56 +671,91 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	// satisfy this condition.
 	if h := r.Header.Get("Sec-X-Tailscale-No-Browsers"); h != "setec" {
 		s.countCallForbidden.Add(apiMethod, 1)
-		http.Error(w, "access denied", http.StatusForbidden)
+		writeError(w, http.StatusForbidden, api.CodeAccessDenied, "access denied")
+		return
+	}
+
+	if len(r.Header.Get(api.JustificationHeader)) > api.MaxJustificationLen {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "justification too long")
 		return
 	}
 
 	id, err := s.getIdentity(r)
 	if err != nil {
-		s.countCallInternalError.Add(apiMethod, 1)
-		http.Error(w, "unable to identify caller", http.StatusInternalServerError)
+		status, msg := identityError(err)
+		s.countIdentityError(apiMethod, status)
+		code := api.CodeInternal
+		if status == http.StatusForbidden {
+			code = api.CodeAccessDenied
+		}
+		writeError(w, status, code, msg)
+		return
+	}
+	id.Request = &audit.Request{ID: reqID, Path: apiMethod, UserAgent: r.UserAgent()}
+
+	if ok, wait := s.limiter.allow(id, apiMethod, time.Now()); !ok {
+		s.countCallRateLimited.Add(apiMethod, 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		writeError(w, http.StatusTooManyRequests, api.CodeRateLimited, "rate limit exceeded")
 		return
 	}
 
 	var req REQ
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.countCallBadRequest.Add(apiMethod, 1)
-		http.Error(w, "bad request", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, api.CodeBadRequest, "bad request")
 		return
 	}
 
 	resp, err := fn(req, id)
-	if errors.Is(err, db.ErrAccessDenied) {
-		s.countCallForbidden.Add(apiMethod, 1)
-		http.Error(w, "access denied", http.StatusForbidden)
-		return
-	} else if errors.Is(err, db.ErrNotFound) {
-		s.countCallNotFound.Add(apiMethod, 1)
-		http.Error(w, "not found", http.StatusNotFound)
+	var areq *api.ApprovalRequiredError
+	if errors.As(err, &areq) {
+		// The operation was not performed, but a request for it was recorded.
+		// Report the pending request so the caller can get it approved.
+		bs, err := json.Marshal(areq.Request)
+		if err != nil {
+			s.countCallInternalError.Add(apiMethod, 1)
+			writeError(w, http.StatusInternalServerError, api.CodeInternal, "failed to encode response")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(bs)
 		return
 	} else if errors.Is(err, api.ErrValueNotChanged) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotModified)
 		return
-	} else if errors.Is(err, db.ErrInvalidVersion) {
-		s.countCallBadRequest.Add(apiMethod, 1)
-		s.countCallAlreadySet.Add(apiMethod, 1)
-		http.Error(w, "invalid version, please specify a version > 0", http.StatusBadRequest)
-		return
-	} else if errors.Is(err, db.ErrVersionClaimed) {
-		s.countCallAlreadySet.Add(apiMethod, 1)
-		http.Error(w, "version already set", http.StatusPreconditionFailed)
-		return
 	} else if err != nil {
-		s.countCallInternalError.Add(apiMethod, 1)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		status, code := errorStatus(err)
+		switch status {
+		case http.StatusBadRequest, http.StatusConflict:
+			s.countCallBadRequest.Add(apiMethod, 1)
+		case http.StatusForbidden:
+			s.countCallForbidden.Add(apiMethod, 1)
+		case http.StatusNotFound:
+			s.countCallNotFound.Add(apiMethod, 1)
+		case http.StatusPreconditionFailed:
+			s.countCallAlreadySet.Add(apiMethod, 1)
+		default:
+			s.countCallInternalError.Add(apiMethod, 1)
+		}
+		msg := err.Error()
+		switch code {
+		case api.CodeAccessDenied:
+			msg = "access denied" // don't report the cause of the denial
+		case api.CodeInternal:
+			msg = "internal error" // don't leak details of the failure
+		}
+		writeError(w, status, code, msg)
 		return
 	}
 
 	bs, err := json.Marshal(resp)
 	if err != nil {
 		s.countCallInternalError.Add(apiMethod, 1)
-		http.Error(w, "failed to encode respnse", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, api.CodeInternal, "failed to encode response")
 		return
 	}
 
@@ -414,3 +763,47 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusOK)
 	w.Write(bs)
 }
+
+// errorStatus returns the HTTP status and API error code corresponding to an
+// error reported by the database.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, db.ErrAccessDenied):
+		return http.StatusForbidden, api.CodeAccessDenied
+	case errors.Is(err, db.ErrSelfApproval):
+		return http.StatusForbidden, api.CodeSelfApproval
+	case errors.Is(err, db.ErrTooManyPending):
+		return http.StatusTooManyRequests, api.CodeRateLimited
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, api.CodeNotFound
+	case errors.Is(err, db.ErrInvalidVersion):
+		return http.StatusBadRequest, api.CodeInvalidVersion
+	case errors.Is(err, db.ErrInvalidRequest):
+		return http.StatusBadRequest, api.CodeBadRequest
+	case errors.Is(err, db.ErrActiveVersion):
+		return http.StatusConflict, api.CodeActiveVersion
+	case errors.Is(err, db.ErrVersionClaimed):
+		return http.StatusPreconditionFailed, api.CodeVersionClaimed
+	case errors.Is(err, audit.ErrNotSearchable):
+		return http.StatusNotImplemented, api.CodeNotSearchable
+	}
+	return http.StatusInternalServerError, api.CodeInternal
+}
+
+// writeError writes an error response with the given HTTP status, whose body
+// is an api.Error with the given code and message.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	bs, err := json.Marshal(&api.Error{Code: code, Message: msg})
+	if err != nil {
+		panic(err) // cannot happen
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
+
+// unknownMethod reports an error for a request to an unknown API method.
+func unknownMethod(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, api.CodeUnknownMethod, "unknown API method")
+}
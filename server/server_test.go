@@ -4,15 +4,34 @@
 package server_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/client/setec"
@@ -23,6 +42,7 @@ import (
 	"github.com/tailscale/setec/types/api"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb/varz"
 )
 
 func TestNew(t *testing.T) {
@@ -60,6 +80,33 @@ func TestNew(t *testing.T) {
 	})
 }
 
+// newGrantServer starts a test server for d, at which every caller is the
+// tailnet user login on node example.com, holding an access grant for each
+// of rules. The HTTP server is closed when the test ends.
+func newGrantServer(t *testing.T, d *setectest.DB, login string, rules ...acl.Rule) (*setectest.Server, *httptest.Server) {
+	t.Helper()
+	var caps []tailcfg.RawMessage
+	for _, r := range rules {
+		bs, err := json.Marshal(r)
+		if err != nil {
+			t.Fatalf("Create access grant: %v", err)
+		}
+		caps = append(caps, tailcfg.RawMessage(bs))
+	}
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "example.com"},
+				UserProfile: &tailcfg.UserProfile{LoginName: login},
+				CapMap:      tailcfg.PeerCapMap{server.ACLCap: caps},
+			}, nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	t.Cleanup(hs.Close)
+	return ss, hs
+}
+
 func TestServerGetChanged(t *testing.T) {
 	d := setectest.NewDB(t, nil)
 	v1 := d.MustPut(d.Superuser, "test", "v1") // active
@@ -108,28 +155,10 @@ func TestServerStatus(t *testing.T) {
 
 	// Synthesize a selective access capability that permits read of secrets
 	// beginning with "ok/".
-	rule, err := json.Marshal(acl.Rule{
+	_, hs := newGrantServer(t, d, "elite@example.com", acl.Rule{
 		Action: []acl.Action{acl.ActionGet, acl.ActionInfo, acl.ActionDelete},
 		Secret: []acl.Secret{"ok/*"},
 	})
-	if err != nil {
-		t.Fatalf("Create access grant: %v", err)
-	}
-	whois := &apitype.WhoIsResponse{
-		Node: &tailcfg.Node{Name: "example.com"},
-		UserProfile: &tailcfg.UserProfile{
-			ID: 31337, LoginName: "elite@example.com", DisplayName: "Leet Q. Haxor",
-		},
-		CapMap: tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
-	}
-
-	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
-		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
-			return whois, nil
-		},
-	})
-	hs := httptest.NewServer(ss.Mux)
-	defer hs.Close()
 
 	ctx := t.Context()
 	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
@@ -151,15 +180,1128 @@ func TestServerStatus(t *testing.T) {
 		t.Errorf("Put ok/test: got (%v, %v), want error %v", sv, err, api.ErrAccessDenied)
 	}
 
-	// Case 4: Internal error for delete of ok/test active version.
-	if err := cli.DeleteVersion(ctx, "ok/test", ov1); err == nil {
-		t.Errorf("DeleteVersion %v: unexpected success", ov1)
-	} else {
-		t.Logf("DeleteVersion %v: got expected error: %v", ov1, err)
+	// Case 4: Conflict for delete of ok/test active version.
+	var aerr *api.Error
+	if err := cli.DeleteVersion(ctx, "ok/test", ov1); !errors.As(err, &aerr) {
+		t.Errorf("DeleteVersion %v: got %v, want *api.Error", ov1, err)
+	} else if aerr.Status != http.StatusConflict || aerr.Code != api.CodeActiveVersion {
+		t.Errorf("DeleteVersion %v: got status %d code %q, want %d %q",
+			ov1, aerr.Status, aerr.Code, http.StatusConflict, api.CodeActiveVersion)
 	}
 
 	// Case 5: Success for delete of ok/test inactive version.
 	if err := cli.DeleteVersion(ctx, "ok/test", ov2); err != nil {
 		t.Errorf("DeleteVersion %v: unexpected error %v", ov2, err)
 	}
+
+	// Case 6: Bad request for an invalid version.
+	if err := cli.DeleteVersion(ctx, "ok/test", 0); !errors.As(err, &aerr) {
+		t.Errorf("DeleteVersion 0: got %v, want *api.Error", err)
+	} else if aerr.Status != http.StatusBadRequest || aerr.Code != api.CodeInvalidVersion {
+		t.Errorf("DeleteVersion 0: got status %d code %q, want %d %q",
+			aerr.Status, aerr.Code, http.StatusBadRequest, api.CodeInvalidVersion)
+	}
+
+	// Case 7: Denials report a code and satisfy errors.Is.
+	if _, err := cli.Put(ctx, "ok/test", []byte("ohai")); !errors.As(err, &aerr) {
+		t.Errorf("Put: got %v, want *api.Error", err)
+	} else if aerr.Status != http.StatusForbidden || aerr.Code != api.CodeAccessDenied {
+		t.Errorf("Put: got status %d code %q, want %d %q",
+			aerr.Status, aerr.Code, http.StatusForbidden, api.CodeAccessDenied)
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	rule := acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo},
+		Secret: []acl.Secret{"ok/*"},
+	}
+	_, hs := newGrantServer(t, d, "elite@example.com", rule)
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	who, err := cli.WhoAmI(ctx)
+	if err != nil {
+		t.Fatalf("WhoAmI: unexpected error: %v", err)
+	}
+	if who.User != "elite@example.com" || who.Hostname != "example.com" {
+		t.Errorf("WhoAmI: got user %q host %q, want elite@example.com, example.com", who.User, who.Hostname)
+	}
+	if len(who.Permissions) != 1 || !who.Permissions.Allow(acl.ActionGet, "ok/x") {
+		t.Errorf("WhoAmI: got permissions %+v, want %+v", who.Permissions, rule)
+	}
+
+	if rsp, err := cli.Check(ctx, acl.ActionGet, "ok/test"); err != nil {
+		t.Errorf("Check get ok/test: unexpected error: %v", err)
+	} else if !rsp.Allowed || rsp.Rule != 0 {
+		t.Errorf("Check get ok/test: got %+v, want allowed by rule 0", rsp)
+	}
+	if rsp, err := cli.Check(ctx, acl.ActionPut, "ok/test"); err != nil {
+		t.Errorf("Check put ok/test: unexpected error: %v", err)
+	} else if rsp.Allowed || rsp.Rule != -1 {
+		t.Errorf("Check put ok/test: got %+v, want denied", rsp)
+	}
+}
+
+func TestInvalidGrants(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "ok/test", "v1")
+
+	// A grant with a misspelled action is reported, but does not prevent the
+	// well-formed parts of the rule from taking effect.
+	ss, hs := newGrantServer(t, d, "elite@example.com", acl.Rule{
+		Action: []acl.Action{acl.ActionGet, "activte"},
+		Secret: []acl.Secret{"ok/*"},
+	})
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	if _, err := cli.Get(t.Context(), "ok/test"); err != nil {
+		t.Errorf("Get ok/test: unexpected error: %v", err)
+	}
+	if m := ss.Actual.Metrics().String(); !strings.Contains(m, `"counter_invalid_grants": 1`) {
+		t.Errorf("Metrics: invalid grant not counted: %s", m)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "prod/key", "v1")
+	v2 := d.MustPut(d.Superuser, "prod/key", "v2")
+
+	// Switch the caller identity between requests.
+	user := "alice@example.com"
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			who, err := setectest.AllAccess(ctx, addr)
+			if err == nil {
+				who.UserProfile.LoginName = user
+			}
+			return who, err
+		},
+	})
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{
+		Rules: acl.Rules{{Action: []acl.Action{acl.ActionActivate}, Secret: []acl.Secret{"prod/*"}}},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	err := cli.Activate(ctx, "prod/key", v2)
+	var areq *api.ApprovalRequiredError
+	if !errors.As(err, &areq) {
+		t.Fatalf("Activate: got %v, want approval required", err)
+	}
+	if areq.Request.Requester != "user:alice@example.com" || areq.Request.Version != v2 {
+		t.Errorf("Activate: got request %+v", areq.Request)
+	}
+
+	if err := cli.Approve(ctx, areq.Request.ID); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Approve own request: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	user = "bob@example.com"
+	if reqs, err := cli.ListPending(ctx); err != nil {
+		t.Fatalf("ListPending: unexpected error: %v", err)
+	} else if len(reqs) != 1 || reqs[0].ID != areq.Request.ID {
+		t.Errorf("ListPending: got %+v, want request %q", reqs, areq.Request.ID)
+	}
+	if err := cli.Approve(ctx, areq.Request.ID); err != nil {
+		t.Fatalf("Approve: unexpected error: %v", err)
+	}
+	if sv, err := cli.Get(ctx, "prod/key"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	} else if sv.Version != v2 {
+		t.Errorf("Get: got version %v, want %v", sv.Version, v2)
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "prod/key", "hunter2")
+
+	ss, hs := newGrantServer(t, d, "oncall@example.com", acl.Rule{
+		Action: []acl.Action{acl.ActionGet.BreakGlass()},
+		Secret: []acl.Secret{"prod/*"},
+	})
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if rsp, err := cli.Check(ctx, acl.ActionGet, "prod/key"); err != nil {
+		t.Errorf("Check: unexpected error: %v", err)
+	} else if rsp.Allowed || !rsp.BreakGlass || rsp.Rule != 0 {
+		t.Errorf("Check: got %+v, want break-glass rule 0", rsp)
+	}
+	if _, err := cli.Get(ctx, "prod/key"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get without justification: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	cli.Justification = strings.Repeat("x", api.MaxJustificationLen+1)
+	if _, err := cli.Get(ctx, "prod/key"); err == nil {
+		t.Error("Get with long justification: got nil, want error")
+	}
+
+	cli.Justification = "incident 1234"
+	if v, err := cli.Get(ctx, "prod/key"); err != nil {
+		t.Errorf("Get with justification: unexpected error: %v", err)
+	} else if got := string(v.Value); got != "hunter2" {
+		t.Errorf("Get with justification: got %q, want %q", got, "hunter2")
+	}
+	if m := ss.Actual.Metrics().String(); !strings.Contains(m, `"counter_break_glass": 1`) {
+		t.Errorf("Metrics: got %s, want counter_break_glass 1", m)
+	}
+}
+
+func TestSearchAudit(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+	d.MustPut(d.Superuser, "prod/a", "x")
+	d.MustPut(d.Superuser, "dev/b", "y")
+
+	_, hs := newGrantServer(t, d, "auditor@example.com", acl.Rule{
+		Action: []acl.Action{acl.ActionAudit},
+		Secret: []acl.Secret{"dev/*"},
+	})
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// The auditor sees only entries for secrets they may audit.
+	got, err := cli.SearchAudit(ctx, api.AuditRequest{})
+	if err != nil {
+		t.Fatalf("SearchAudit: unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Secret != "dev/b" || got[0].Action != acl.ActionPut {
+		t.Errorf("SearchAudit: got %+v, want one put of dev/b", got)
+	}
+	if got, err := cli.SearchAudit(ctx, api.AuditRequest{Secret: "prod/*"}); err != nil {
+		t.Errorf("SearchAudit prod/*: unexpected error: %v", err)
+	} else if len(got) != 0 {
+		t.Errorf("SearchAudit prod/*: got %+v, want no entries", got)
+	}
+
+	// An export includes the same entries, signed by the server.
+	x, err := cli.ExportAudit(ctx, api.AuditRequest{})
+	if err != nil {
+		t.Fatalf("ExportAudit: unexpected error: %v", err)
+	}
+	key, err := cli.AuditExportKey(ctx)
+	if err != nil {
+		t.Fatalf("AuditExportKey: unexpected error: %v", err)
+	}
+	if want, err := d.Actual.AuditExportKey(); err != nil {
+		t.Fatalf("DB AuditExportKey: %v", err)
+	} else if !key.Equal(want) {
+		t.Errorf("AuditExportKey: got %x, want %x", key, want)
+	}
+	if got, err := x.Verify(key); err != nil {
+		t.Errorf("Verify export: unexpected error: %v", err)
+	} else if len(got) != 1 || got[0].Secret != "dev/b" {
+		t.Errorf("Verify export: got %+v, want one entry for dev/b", got)
+	}
+
+	// A caller who may audit no secrets is denied, and the denial recorded.
+	_, ns := newGrantServer(t, d, "reader@example.com", acl.Rule{
+		Action: []acl.Action{acl.ActionGet},
+		Secret: []acl.Secret{"*"},
+	})
+	ncli := setec.Client{Server: ns.URL, DoHTTP: ns.Client().Do}
+	if _, err := ncli.SearchAudit(ctx, api.AuditRequest{}); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("SearchAudit without audit: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	denied, err := d.Actual.SearchAudit(d.Superuser, audit.Query{Action: acl.ActionAudit, Principal: "reader@example.com"})
+	if err != nil {
+		t.Fatalf("SearchAudit: unexpected error: %v", err)
+	} else if len(denied) != 1 || denied[0].Authorized {
+		t.Errorf("SearchAudit for denied searches: got %+v, want one unauthorized entry", denied)
+	}
+
+	// The search itself is recorded.
+	all, err := d.Actual.SearchAudit(d.Superuser, audit.Query{Action: acl.ActionAudit, Principal: "auditor@example.com"})
+	if err != nil {
+		t.Fatalf("SearchAudit: unexpected error: %v", err)
+	} else if len(all) != 3 {
+		t.Errorf("SearchAudit for audit actions: got %d entries, want 3", len(all))
+	} else if r := all[0].Request; r == nil || r.ID == "" || r.Path != "/api/audit" || r.UserAgent == "" {
+		t.Errorf("SearchAudit: got request %+v, want ID, path and user agent", r)
+	} else if all[0].Outcome != audit.OutcomeOK {
+		t.Errorf("SearchAudit: got outcome %q, want %q", all[0].Outcome, audit.OutcomeOK)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if _, err := cli.Get(ctx, "test"); err != nil {
+		t.Fatalf("Get test: %v", err)
+	}
+	rsp, err := cli.Usage(ctx, "test", 7)
+	if err != nil {
+		t.Fatalf("Usage: unexpected error: %v", err)
+	}
+	if len(rsp.Secrets) != 1 {
+		t.Fatalf("Usage: got %d secrets, want 1", len(rsp.Secrets))
+	}
+	su := rsp.Secrets[0]
+	if su.Name != "test" || su.LastGet.IsZero() || len(su.Consumers) != 1 || su.Consumers[0].Version != 1 {
+		t.Errorf("Usage: got %+v, want one consumer of version 1", su)
+	}
+	if _, err := cli.Usage(ctx, "nonesuch", 0); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Usage nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "ok/one", "one")
+	d.MustPut(d.Superuser, "ok/two", "two")
+	d.MustPut(d.Superuser, "no/test", "no")
+
+	_, hs := newGrantServer(t, d, "user@example.com", acl.Rule{
+		Action: []acl.Action{acl.ActionGet},
+		Secret: []acl.Secret{"ok/*"},
+	})
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	rs, err := cli.GetMany(t.Context(), []api.GetManyItem{
+		{Name: "ok/one", Version: v1},
+		{Name: "ok/two"},
+		{Name: "ok/missing"},
+		{Name: "no/test"},
+	})
+	if err != nil {
+		t.Fatalf("GetMany: unexpected error: %v", err)
+	}
+	if len(rs) != 4 {
+		t.Fatalf("GetMany: got %d results, want 4", len(rs))
+	}
+	if !errors.Is(rs[0].Err, api.ErrValueNotChanged) {
+		t.Errorf("GetMany ok/one: got (%v, %v), want %v", rs[0].Value, rs[0].Err, api.ErrValueNotChanged)
+	}
+	if rs[1].Err != nil || string(rs[1].Value.Value) != "two" {
+		t.Errorf("GetMany ok/two: got (%v, %v), want two", rs[1].Value, rs[1].Err)
+	}
+	if !errors.Is(rs[2].Err, api.ErrNotFound) {
+		t.Errorf("GetMany ok/missing: got (%v, %v), want %v", rs[2].Value, rs[2].Err, api.ErrNotFound)
+	}
+	if !errors.Is(rs[3].Err, api.ErrAccessDenied) {
+		t.Errorf("GetMany no/test: got (%v, %v), want %v", rs[3].Value, rs[3].Err, api.ErrAccessDenied)
+	}
+}
+
+func TestListMatching(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	var want []string
+	for i := range 7 {
+		name := fmt.Sprintf("app/secret-%d", i)
+		d.MustPut(d.Superuser, name, "x")
+		want = append(want, name)
+	}
+	d.MustPut(d.Superuser, "other/secret", "x")
+
+	ss := setectest.NewServer(t, d, nil)
+	var calls int
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		ss.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	infos, err := cli.ListMatching(t.Context(), api.ListRequest{Prefix: "app/", Limit: 3})
+	if err != nil {
+		t.Fatalf("ListMatching: unexpected error: %v", err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Name)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ListMatching (-got, +want):\n%s", diff)
+	}
+	if calls != 3 {
+		t.Errorf("ListMatching: got %d requests, want 3", calls)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+
+	var old atomic.Bool // whether to simulate a server that predates version 2
+	var paths []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if old.Load() && (r.URL.Path == "/api/versions" || strings.HasPrefix(r.URL.Path, "/api/v2/")) {
+			http.Error(w, "invalid method", http.StatusBadRequest)
+			return
+		}
+		ss.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	ctx := t.Context()
+
+	for _, isOld := range []bool{false, true} {
+		old.Store(isOld)
+		paths = nil
+
+		cli, err := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}.Negotiate(ctx)
+		if err != nil {
+			t.Fatalf("Negotiate (old=%v): unexpected error: %v", isOld, err)
+		}
+		wantVersion := 2
+		if isOld {
+			wantVersion = 1
+		}
+		if cli.APIVersion != wantVersion {
+			t.Errorf("Negotiate (old=%v): got version %d, want %d", isOld, cli.APIVersion, wantVersion)
+		}
+
+		name := fmt.Sprintf("test-%v", isOld)
+		v1, err := cli.Put(ctx, name, []byte("one"))
+		if err != nil {
+			t.Fatalf("Put (old=%v): unexpected error: %v", isOld, err)
+		}
+		v2, err := cli.Put(ctx, name, []byte("two"))
+		if err != nil {
+			t.Fatalf("Put (old=%v): unexpected error: %v", isOld, err)
+		}
+		if err := cli.Activate(ctx, name, v2); err != nil {
+			t.Fatalf("Activate (old=%v): unexpected error: %v", isOld, err)
+		}
+		if sv, err := cli.GetIfChanged(ctx, name, v1); err != nil || string(sv.Value) != "two" {
+			t.Errorf("GetIfChanged (old=%v): got (%v, %v), want two", isOld, sv, err)
+		}
+		if _, err := cli.GetIfChanged(ctx, name, v2); !errors.Is(err, api.ErrValueNotChanged) {
+			t.Errorf("GetIfChanged (old=%v): got %v, want %v", isOld, err, api.ErrValueNotChanged)
+		}
+		if err := cli.DeleteVersion(ctx, name, v1); err != nil {
+			t.Errorf("DeleteVersion (old=%v): unexpected error: %v", isOld, err)
+		}
+		if info, err := cli.Info(ctx, name); err != nil {
+			t.Errorf("Info (old=%v): unexpected error: %v", isOld, err)
+		} else if diff := cmp.Diff(info.Versions, []api.SecretVersion{v2}); diff != "" {
+			t.Errorf("Info versions (old=%v) (-got, +want):\n%s", isOld, diff)
+		}
+
+		// The client discovers the version once, and then uses the
+		// corresponding paths.
+		want := []string{"/api/versions", "/api/v2/put", "/api/v2/put", "/api/v2/activate",
+			"/api/v2/get", "/api/v2/get", "/api/v2/delete", "/api/v2/info"}
+		if isOld {
+			want = []string{"/api/versions", "/api/put", "/api/put", "/api/activate",
+				"/api/get", "/api/get", "/api/delete-version", "/api/info"}
+		}
+		if diff := cmp.Diff(paths, want); diff != "" {
+			t.Errorf("Request paths (old=%v) (-got, +want):\n%s", isOld, diff)
+		}
+	}
+
+	// A client that uses version 2 falls back to version 1 if the server no
+	// longer supports it, but a missing secret is not mistaken for that.
+	old.Store(false)
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, APIVersion: 2}
+	paths = nil
+	if _, err := cli.Get(ctx, "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Get nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+	old.Store(true)
+	if _, err := cli.Get(ctx, "test-true"); err != nil {
+		t.Errorf("Get after rollback: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(paths, []string{"/api/v2/get", "/api/v2/get", "/api/get"}); diff != "" {
+		t.Errorf("Request paths (-got, +want):\n%s", diff)
+	}
+	old.Store(false)
+
+	// Deleting a whole secret with version 2 must be explicit.
+	d.MustPut(d.Superuser, "keep", "v1")
+	for _, body := range []string{`{"name":"keep"}`, `{"name":"keep","version":1,"all":true}`} {
+		req, err := http.NewRequest("POST", hs.URL+"/api/v2/delete", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
+		rsp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Delete %s: %v", body, err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Delete %s: got status %d, want %d", body, rsp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	d.MustGet(d.Superuser, "keep")
+	if err := cli.Delete(ctx, "keep"); err != nil {
+		t.Errorf("Delete keep: unexpected error: %v", err)
+	}
+	if _, err := d.Actual.Get(d.Superuser, "keep"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get after Delete: got %v, want %v", err, db.ErrNotFound)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+	d.MustPut(d.Superuser, "test", "v2")
+	d.MustPut(d.Superuser, "other", "v1")
+
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	if _, err := cli.Get(t.Context(), "test"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if _, err := cli.Get(t.Context(), "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+		t.Fatalf("Get nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+
+	var buf strings.Builder
+	varz.WritePrometheusExpvar(&buf, expvar.KeyValue{Key: "setec_server", Value: ss.Actual.Metrics()})
+	got := buf.String()
+	for _, want := range []string{
+		`setec_server_api_calls{method="/api/get"} 2`,
+		`setec_server_api_not_found{method="/api/get"} 1`,
+		`# TYPE setec_server_api_latency_seconds histogram`,
+		`setec_server_api_latency_seconds_count{method="/api/get"} 2`,
+		`setec_server_api_latency_seconds_bucket{method="/api/get",le="+Inf"} 2`,
+		`setec_server_db_secrets 2`,
+		`setec_server_db_versions 3`,
+		`# TYPE setec_server_db_file_size_bytes gauge`,
+		`# TYPE setec_server_db_last_save_time_seconds gauge`,
+		`setec_server_db_save_seconds_count 3`,
+		`# TYPE setec_server_db_audit_write_seconds histogram`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("Metrics: missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("Metrics:\n%s", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	v1, err := cli.Generate(ctx, "test", api.GenerateSpec{Type: api.GeneratePassword, Length: 20})
+	if err != nil {
+		t.Fatalf("Generate: unexpected error: %v", err)
+	}
+	v2, err := cli.Generate(ctx, "test", api.GenerateSpec{Type: api.GeneratePassword, Length: 20})
+	if err != nil {
+		t.Fatalf("Generate: unexpected error: %v", err)
+	}
+
+	// The first version is active, as for put.
+	sv, err := cli.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if sv.Version != v1 || len(sv.Value) != 20 {
+		t.Errorf("Get: got version %d, %d bytes; want version %d, 20 bytes", sv.Version, len(sv.Value), v1)
+	}
+	if other := d.MustGetVersion(d.Superuser, "test", v2); bytes.Equal(other.Value, sv.Value) {
+		t.Errorf("Generate: versions %d and %d have the same value", v1, v2)
+	}
+
+	_, err = cli.Generate(ctx, "test", api.GenerateSpec{Type: "bogus"})
+	var aerr *api.Error
+	if !errors.As(err, &aerr) || aerr.Status != http.StatusBadRequest {
+		t.Errorf("Generate bogus: got %v, want status %d", err, http.StatusBadRequest)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotation.json")
+	if err := os.WriteFile(path, []byte(`{"policies": [
+  {"prefix": "hmac/", "interval": "50ms",
+   "generate": {"type": "bytes", "length": 16}, "keep": 1}
+]}`), 0600); err != nil {
+		t.Fatalf("Write policies: %v", err)
+	}
+	policies, err := server.LoadRotationPolicies(path)
+	if err != nil {
+		t.Fatalf("LoadRotationPolicies: %v", err)
+	}
+	want := []db.RotationPolicy{{
+		Prefix:   "hmac/",
+		Interval: 50 * time.Millisecond,
+		Generate: api.GenerateSpec{Type: api.GenerateBytes, Length: 16},
+		Keep:     1,
+	}}
+	if diff := cmp.Diff(policies, want); diff != "" {
+		t.Errorf("LoadRotationPolicies (-got, +want):\n%s", diff)
+	}
+
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "hmac/key", "v1")
+	if _, err := server.New(t.Context(), server.Config{
+		DB:               d.Actual,
+		WhoIs:            setectest.AllAccess,
+		RotationPolicies: policies,
+		RotationCheck:    10 * time.Millisecond,
+		Mux:              http.NewServeMux(),
+	}); err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+
+	// The server rotates the secret in the background.
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		sv := d.MustGet(d.Superuser, "hmac/key")
+		if sv.Version >= 3 && len(sv.Value) == 16 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Get hmac/key: got version %d, want rotated at least twice", sv.Version)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invalid policies are rejected.
+	bad := []db.RotationPolicy{{Prefix: "x/", Interval: time.Hour}}
+	if _, err := server.New(t.Context(), server.Config{
+		DB:               d.Actual,
+		RotationPolicies: bad,
+		Mux:              http.NewServeMux(),
+	}); err == nil {
+		t.Errorf("server.New with invalid policy: got nil, want error")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		RateLimits: map[string]server.RateLimit{
+			"/api/get": {Rate: 0.001, Burst: 2},
+			"/api/put": {Rate: 50, Burst: 1},
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, MaxRetries: -1}
+	for i := range 2 {
+		if _, err := cli.Get(ctx, "test"); err != nil {
+			t.Fatalf("Get %d: unexpected error: %v", i+1, err)
+		}
+	}
+
+	// The burst is exhausted, and the next token is a long way off.
+	_, err := cli.Get(ctx, "test")
+	var aerr *api.Error
+	if !errors.Is(err, api.ErrRateLimited) || !errors.As(err, &aerr) {
+		t.Fatalf("Get: got %v, want %v", err, api.ErrRateLimited)
+	} else if aerr.Status != http.StatusTooManyRequests {
+		t.Errorf("Get: got status %d, want %d", aerr.Status, http.StatusTooManyRequests)
+	}
+
+	// Other methods are limited separately.
+	if _, err := cli.Info(ctx, "test"); err != nil {
+		t.Errorf("Info: unexpected error: %v", err)
+	}
+
+	// With retries, the client waits for the limit to allow the call.
+	cli.MaxRetries = 0
+	for i := range 3 {
+		if _, err := cli.Put(ctx, "test", []byte("v2")); err != nil {
+			t.Errorf("Put %d: unexpected error: %v", i+1, err)
+		}
+	}
+
+	if m := ss.Actual.Metrics().String(); !strings.Contains(m, `"counter_api_rate_limited": {"/api/get": 1, "/api/put": 2}`) {
+		t.Errorf("Metrics: rate limited calls not counted: %s", m)
+	}
+}
+
+// failWriter is an io.Writer that fails while fail is set.
+type failWriter struct{ fail bool }
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	if f.fail {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestHealth(t *testing.T) {
+	fw := new(failWriter)
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(fw)})
+	d.MustPut(d.Superuser, "very/secret/name", "v1")
+
+	tsState := "Running"
+	mux := http.NewServeMux()
+	if _, err := server.New(t.Context(), server.Config{
+		DB:             d.Actual,
+		WhoIs:          setectest.AllAccess,
+		TailscaleState: func(context.Context) (string, error) { return tsState, nil },
+		Mux:            mux,
+	}); err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	check := func(path string, wantCode int, want map[string]string) {
+		t.Helper()
+		// Health checks need no identity or API header.
+		rsp, err := http.Get(hs.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("Get %s: reading body: %v", path, err)
+		}
+		if rsp.StatusCode != wantCode {
+			t.Errorf("Get %s: got status %d, want %d", path, rsp.StatusCode, wantCode)
+		}
+		if strings.Contains(string(body), "very/secret") {
+			t.Errorf("Get %s: response reveals a secret name: %s", path, body)
+		}
+		var hr api.HealthResponse
+		if err := json.Unmarshal(body, &hr); err != nil {
+			t.Fatalf("Get %s: decoding response: %v", path, err)
+		}
+		got := map[string]string{"": hr.Status}
+		for name, c := range hr.Components {
+			got[name] = c.Status
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("Get %s: statuses (-got, +want):\n%s", path, diff)
+		}
+	}
+
+	check("/healthz", http.StatusOK, map[string]string{
+		"": api.HealthOK, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthOK,
+	})
+	check("/readyz", http.StatusOK, map[string]string{
+		"": api.HealthOK, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthOK,
+		api.ComponentTailscale: api.HealthOK,
+	})
+
+	// Losing the tailnet makes the server unready, but not unhealthy.
+	tsState = "NeedsLogin"
+	check("/healthz", http.StatusOK, map[string]string{
+		"": api.HealthOK, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthOK,
+	})
+	check("/readyz", http.StatusServiceUnavailable, map[string]string{
+		"": api.HealthFailed, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthOK,
+		api.ComponentTailscale: api.HealthFailed,
+	})
+	tsState = "Running"
+
+	// A failed audit log write makes the server unhealthy until a write
+	// succeeds.
+	fw.fail = true
+	if _, err := d.Actual.Get(d.Superuser, "very/secret/name"); err == nil {
+		t.Fatal("Get: unexpectedly succeeded with a failing audit log")
+	}
+	check("/healthz", http.StatusServiceUnavailable, map[string]string{
+		"": api.HealthFailed, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthFailed,
+	})
+	fw.fail = false
+	d.MustGet(d.Superuser, "very/secret/name")
+	check("/healthz", http.StatusOK, map[string]string{
+		"": api.HealthOK, api.ComponentDB: api.HealthOK, api.ComponentAudit: api.HealthOK,
+	})
+}
+
+func TestDashboard(t *testing.T) {
+	var auditLog strings.Builder
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&auditLog)})
+	d.MustPut(d.Superuser, "test", "hunter2")
+
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	get := func(path string) string {
+		t.Helper()
+		rsp, err := hs.Client().Get(hs.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Get %s: got status %d, want %d", path, rsp.StatusCode, http.StatusOK)
+		}
+		return string(body)
+	}
+	post := func(path string, form url.Values, hdr http.Header) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", hs.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		rsp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Post %s: %v", path, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+
+	// The list does not include secret values, but does include a token for
+	// the forms on the page.
+	page := get("/")
+	if strings.Contains(page, "hunter2") {
+		t.Errorf("List page reveals a secret value:\n%s", page)
+	}
+	m := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("List page has no CSRF token:\n%s", page)
+	}
+	token := m[1]
+
+	// Forms without a valid token, or from another origin, are rejected.
+	if code, _ := post("/ui/put", url.Values{"name": {"test"}, "value": {"v2"}}, nil); code != http.StatusForbidden {
+		t.Errorf("Put without token: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := post("/ui/put", url.Values{"csrf": {"bogus"}, "name": {"test"}, "value": {"v2"}}, nil); code != http.StatusForbidden {
+		t.Errorf("Put with bad token: got status %d, want %d", code, http.StatusForbidden)
+	}
+	crossSite := http.Header{"Sec-Fetch-Site": {"cross-site"}}
+	if code, _ := post("/ui/put", url.Values{"csrf": {token}, "name": {"test"}, "value": {"v2"}}, crossSite); code != http.StatusForbidden {
+		t.Errorf("Put cross-site: got status %d, want %d", code, http.StatusForbidden)
+	}
+
+	// With a token, the forms work.
+	sameOrigin := http.Header{"Sec-Fetch-Site": {"same-origin"}}
+	if code, body := post("/ui/put", url.Values{"csrf": {token}, "name": {"test"}, "value": {"swordfish"}}, sameOrigin); code != http.StatusOK {
+		t.Errorf("Put: got status %d, want %d:\n%s", code, http.StatusOK, body)
+	}
+	if code, body := post("/ui/activate", url.Values{"csrf": {token}, "name": {"test"}, "version": {"2"}}, nil); code != http.StatusOK {
+		t.Errorf("Activate: got status %d, want %d:\n%s", code, http.StatusOK, body)
+	}
+	if code, _ := post("/ui/delete-version", url.Values{"csrf": {token}, "name": {"test"}, "version": {"2"}}, nil); code != http.StatusConflict {
+		t.Errorf("Delete active version: got status %d, want %d", code, http.StatusConflict)
+	}
+	if code, body := post("/ui/delete-version", url.Values{"csrf": {token}, "name": {"test"}, "version": {"1"}}, nil); code != http.StatusOK {
+		t.Errorf("Delete version: got status %d, want %d:\n%s", code, http.StatusOK, body)
+	}
+	if got := d.MustGet(d.Superuser, "test"); string(got.Value) != "swordfish" || got.Version != 2 {
+		t.Errorf("Active value: got %q (version %d), want %q (version 2)", got.Value, got.Version, "swordfish")
+	}
+
+	// Values are shown only when revealed, and revealing is audited.
+	auditLog.Reset()
+	code, body := post("/ui/reveal", url.Values{"csrf": {token}, "name": {"test"}, "version": {"2"}, "justification": {"checking"}}, nil)
+	if code != http.StatusOK || !strings.Contains(body, "swordfish") {
+		t.Errorf("Reveal: got status %d, body:\n%s", code, body)
+	}
+	var e audit.Entry
+	if err := json.Unmarshal([]byte(auditLog.String()), &e); err != nil {
+		t.Fatalf("Reveal: decoding audit entry: %v", err)
+	}
+	if e.Action != acl.ActionGet || e.Secret != "test" || e.Justification != "checking" || e.Request == nil || e.Request.Path != "/ui/reveal" {
+		t.Errorf("Reveal: audit entry %+v does not record the reveal", e)
+	}
+
+	if code, body := post("/ui/delete", url.Values{"csrf": {token}, "name": {"test"}}, nil); code != http.StatusOK {
+		t.Errorf("Delete: got status %d, want %d:\n%s", code, http.StatusOK, body)
+	}
+	if got := d.MustList(d.Superuser); len(got) != 0 {
+		t.Errorf("List after delete: got %d secrets, want 0", len(got))
+	}
+}
+
+func TestSecretPage(t *testing.T) {
+	log, err := audit.NewFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	defer log.Close()
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: log})
+	d.MustPut(d.Superuser, "prod/test", "hunter2")
+	v2 := d.MustPut(d.Superuser, "prod/test", "swordfish")
+	d.MustActivate(d.Superuser, "prod/test", v2)
+	if err := d.Actual.DeleteVersion(d.Superuser, "prod/test", 1); err != nil {
+		t.Fatalf("DeleteVersion: %v", err)
+	}
+
+	_, hs := newGrantServer(t, d, "viewer@example.com",
+		acl.Rule{Action: []acl.Action{acl.ActionInfo}, Secret: []acl.Secret{"prod/*"}})
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		rsp, err := hs.Client().Get(hs.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+
+	code, page := get("/secret/prod/test")
+	if code != http.StatusOK {
+		t.Fatalf("Get page: got status %d, want %d:\n%s", code, http.StatusOK, page)
+	}
+	for _, want := range []string{
+		"<td>1</td>", "deleted",
+		"<td>2</td>", "<b>active</b>",
+		"<td>activate</td>",
+		"viewer@example.com (example.com)", // the view itself is recorded
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Page: missing %q", want)
+		}
+	}
+	for _, secret := range []string{"hunter2", "swordfish"} {
+		if strings.Contains(page, secret) {
+			t.Errorf("Page reveals a secret value %q", secret)
+		}
+	}
+
+	// The list links to the page.
+	if _, list := get("/"); !strings.Contains(list, `href="/secret/prod/test"`) {
+		t.Errorf("List page does not link to the secret page:\n%s", list)
+	}
+
+	// The page requires info permission on the secret.
+	d.MustPut(d.Superuser, "dev/test", "x")
+	if code, _ := get("/secret/dev/test"); code != http.StatusForbidden {
+		t.Errorf("Get page without permission: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := get("/secret/prod/nonesuch"); code != http.StatusNotFound {
+		t.Errorf("Get page nonesuch: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestTokenIdentity(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "ci/deploy-key", "k1")
+	d.MustPut(d.Superuser, "prod/db-password", "p1")
+
+	const token = "correct-horse-battery-staple"
+	sum := sha256.Sum256([]byte(token))
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, fmt.Appendf(nil, `{"tokens": [
+  {"name": "ci", "sha256": %q, "rules": [{"action": ["get"], "secret": ["ci/*"]}]}
+]}`, hex.EncodeToString(sum[:])), 0600); err != nil {
+		t.Fatalf("Write tokens: %v", err)
+	}
+	tokens, err := server.LoadTokens(path)
+	if err != nil {
+		t.Fatalf("LoadTokens: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	if _, err := server.New(t.Context(), server.Config{
+		DB: d.Actual,
+		Identity: server.ChainIdentity(
+			server.TokenIdentity{Tokens: tokens},
+			server.TailscaleIdentity{WhoIs: setectest.AllAccess},
+		),
+		Mux: mux,
+	}); err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, Token: token}
+	if who, err := cli.WhoAmI(ctx); err != nil {
+		t.Errorf("WhoAmI: unexpected error: %v", err)
+	} else if who.User != "token:ci" {
+		t.Errorf("WhoAmI: got user %q, want %q", who.User, "token:ci")
+	}
+	if got, err := cli.Get(ctx, "ci/deploy-key"); err != nil {
+		t.Errorf("Get ci/deploy-key: unexpected error: %v", err)
+	} else if string(got.Value) != "k1" {
+		t.Errorf("Get ci/deploy-key: got %q, want %q", got.Value, "k1")
+	}
+	if _, err := cli.Get(ctx, "prod/db-password"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get prod/db-password: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	// An invalid token is rejected, rather than falling back to another
+	// identity.
+	cli.Token = "wrong"
+	if _, err := cli.Get(ctx, "ci/deploy-key"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get with bad token: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	// Without a token, the caller is identified as a tailnet peer.
+	cli.Token = ""
+	if _, err := cli.Get(ctx, "prod/db-password"); err != nil {
+		t.Errorf("Get without token: unexpected error: %v", err)
+	}
+}
+
+func TestCertApprovalKey(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "prod/key", "v1")
+	v2 := d.MustPut(d.Superuser, "prod/key", "v2")
+	d.Actual.SetApprovalPolicy(db.ApprovalPolicy{
+		Rules: acl.Rules{{Action: []acl.Action{acl.ActionActivate}, Secret: []acl.Secret{"prod/*"}}},
+	})
+
+	// A certificate holder and a tailnet user with the same name are
+	// different principals.
+	const name = "alice@example.com"
+	all := acl.Rules{{Action: []acl.Action{acl.ActionActivate, acl.ActionApprove}, Secret: []acl.Secret{"*"}}}
+	r := httptest.NewRequest("POST", "/api/activate", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{EmailAddresses: []string{name}}}}}
+	certCaller, err := server.CertIdentity{ACL: &server.CertACL{
+		Grants: []server.CertGrant{{Principals: []string{name}, Rules: all}},
+	}}.Identify(r)
+	if err != nil {
+		t.Fatalf("Identify: unexpected error: %v", err)
+	}
+	tailnetCaller := d.Superuser
+	tailnetCaller.Principal = audit.Principal{User: name}
+	if certCaller.Principal.User == tailnetCaller.Principal.User {
+		t.Errorf("Identify: got user %q, the same as the tailnet user", certCaller.Principal.User)
+	}
+
+	err = d.Actual.Activate(certCaller, "prod/key", v2)
+	var areq *api.ApprovalRequiredError
+	if !errors.As(err, &areq) {
+		t.Fatalf("Activate: got %v, want approval required", err)
+	}
+	if err := d.Actual.Approve(certCaller, areq.Request.ID); !errors.Is(err, db.ErrSelfApproval) {
+		t.Errorf("Approve by requester: got %v, want %v", err, db.ErrSelfApproval)
+	}
+	if err := d.Actual.Approve(tailnetCaller, areq.Request.ID); err != nil {
+		t.Errorf("Approve by tailnet user: unexpected error: %v", err)
+	}
+	if got := d.MustGet(d.Superuser, "prod/key").Version; got != v2 {
+		t.Errorf("Active version: got %v, want %v (was %v)", got, v2, v1)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "ci/deploy-key", "k1")
+	d.MustPut(d.Superuser, "prod/db-password", "p1")
+
+	// Make a CA, and a client certificate it issues.
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		return key
+	}
+	caKey := newKey()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	clientKey := newKey()
+	spiffe, _ := url.Parse("spiffe://ci.example.com/deploy")
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{spiffe},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, clientKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate client: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cert-acl.json")
+	if err := os.WriteFile(path, []byte(`{"grants": [
+  {"principals": ["spiffe://ci.example.com/deploy"],
+   "rules": [{"action": ["get"], "secret": ["ci/*"]}]}
+]}`), 0600); err != nil {
+		t.Fatalf("Write ACL: %v", err)
+	}
+	certACL, err := server.LoadCertACL(path)
+	if err != nil {
+		t.Fatalf("LoadCertACL: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	if _, err := server.New(t.Context(), server.Config{
+		DB:       d.Actual,
+		Identity: server.CertIdentity{ACL: certACL},
+		Mux:      mux,
+	}); err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	hs := httptest.NewUnstartedServer(mux)
+	hs.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	hs.StartTLS()
+	defer hs.Close()
+
+	ctx := t.Context()
+	hc := hs.Client()
+	hc.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}}
+	cli := setec.Client{Server: hs.URL, DoHTTP: hc.Do}
+	if who, err := cli.WhoAmI(ctx); err != nil {
+		t.Errorf("WhoAmI: unexpected error: %v", err)
+	} else if want := "cert:" + spiffe.String(); who.User != want {
+		t.Errorf("WhoAmI: got user %q, want %q", who.User, want)
+	}
+	if _, err := cli.Get(ctx, "ci/deploy-key"); err != nil {
+		t.Errorf("Get ci/deploy-key: unexpected error: %v", err)
+	}
+	if _, err := cli.Get(ctx, "prod/db-password"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get prod/db-password: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	// Without a certificate, the caller is not identified.
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	anonHTTP := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	anon := setec.Client{Server: hs.URL, DoHTTP: anonHTTP.Do}
+	if _, err := anon.Get(ctx, "ci/deploy-key"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get without certificate: got %v, want %v", err, api.ErrAccessDenied)
+	}
 }
@@ -31,6 +31,7 @@ func superuser() db.Caller {
 			acl.Rule{
 				Action: []acl.Action{
 					acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionCreateVersion, acl.ActionActivate, acl.ActionDelete,
+					acl.ActionApprove, acl.ActionAudit,
 				},
 				Secret: []acl.Secret{"*"},
 			},
@@ -131,7 +132,7 @@ func (db *DB) MustActivate(caller db.Caller, name string, version api.SecretVers
 func (db *DB) MustList(caller db.Caller) []*api.SecretInfo {
 	db.t.Helper()
 
-	vs, err := db.Actual.List(caller)
+	vs, err := db.Actual.List(caller, api.ListRequest{})
 	if err != nil {
 		db.t.Fatalf("List failed: %v", err)
 	}
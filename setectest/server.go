@@ -49,6 +49,10 @@ type ServerOptions struct {
 	// AuditLog is where audit logs are written; if nil, audit logs are
 	// discarded without error.
 	AuditLog *audit.Writer
+
+	// RateLimits are the rate limits on API calls; if nil, calls are not
+	// rate limited.
+	RateLimits map[string]server.RateLimit
 }
 
 func (o *ServerOptions) whoIs() func(context.Context, string) (*apitype.WhoIsResponse, error) {
@@ -74,12 +78,16 @@ func NewServer(t *testing.T, db *DB, opts *ServerOptions) *Server {
 	mux := http.NewServeMux()
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(cancel)
-	s, err := server.New(ctx, server.Config{
+	cfg := server.Config{
 		DB:       db.Actual,
 		AuditLog: opts.auditLog(),
 		WhoIs:    opts.whoIs(),
 		Mux:      mux,
-	})
+	}
+	if opts != nil {
+		cfg.RateLimits = opts.RateLimits
+	}
+	s, err := server.New(ctx, cfg)
 	if err != nil {
 		t.Fatalf("Creating new server: %v", err)
 	}
@@ -93,6 +101,7 @@ func init() {
 	rule, err := json.Marshal(acl.Rule{
 		Action: []acl.Action{
 			acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionCreateVersion, acl.ActionActivate, acl.ActionDelete,
+			acl.ActionApprove, acl.ActionAudit,
 		},
 		Secret: []acl.Secret{"*"},
 	})
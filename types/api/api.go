@@ -7,7 +7,12 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"net/netip"
 	"strconv"
+	"time"
+
+	"github.com/tailscale/setec/acl"
 )
 
 var (
@@ -27,8 +32,86 @@ var (
 	// ErrAccessDenied is a sentinel error reported by requests when access to
 	// perform the requested operation is denied.
 	ErrAccessDenied = errors.New("access denied")
+
+	// ErrApprovalRequired is a sentinel error reported by requests for
+	// operations that require two-person approval. The operation has not been
+	// performed, but a pending request for it has been recorded.
+	ErrApprovalRequired = errors.New("approval required")
+
+	// ErrRateLimited is a sentinel error reported by requests that the
+	// server rejected because the caller exceeded its rate limit.
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// ApprovalRequiredError is the concrete type of error reported when an
+// operation requires approval. It reports true for errors.Is with
+// ErrApprovalRequired.
+type ApprovalRequiredError struct {
+	// Request is the pending request recorded for the operation.
+	Request *PendingRequest
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("approval required (request %s)", e.Request.ID)
+}
+
+// Is reports whether target is ErrApprovalRequired.
+func (e *ApprovalRequiredError) Is(target error) bool { return target == ErrApprovalRequired }
+
+// Error is the body of an error response from the API. The client reports
+// the errors returned by the server as *Error values, which report true for
+// errors.Is with the sentinel errors corresponding to their codes, for
+// example ErrNotFound for CodeNotFound.
+type Error struct {
+	// Status is the HTTP status of the response. It is not part of the body.
+	Status int `json:"-"`
+
+	// Code is a stable, machine-readable code for the error, one of the
+	// Code* constants.
+	Code string
+
+	// Message is a human-readable description of the error.
+	Message string
+}
+
+// Codes reported by the server in an Error.
+const (
+	CodeBadRequest     = "bad-request"     // the request was malformed
+	CodeInvalidVersion = "invalid-version" // the version given is not valid
+	CodeActiveVersion  = "active-version"  // the active version cannot be deleted
+	CodeAccessDenied   = "access-denied"   // the caller lacks permission
+	CodeSelfApproval   = "self-approval"   // the caller requested the operation
+	CodeNotFound       = "not-found"       // the secret or version does not exist
+	CodeUnknownMethod  = "unknown-method"  // the server does not implement the API method
+	CodeVersionClaimed = "version-claimed" // the version has already been set
+	CodeNotSearchable  = "not-searchable"  // the audit log cannot be searched
+	CodeRateLimited    = "rate-limited"    // the caller exceeded its rate limit
+	CodeInternal       = "internal-error"  // the server failed
 )
 
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request failed with status %d (%s)", e.Status, e.Code)
+	}
+	return e.Message
+}
+
+// Is reports whether target is the sentinel error corresponding to the code
+// of e, if there is one.
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case CodeNotFound:
+		return target == ErrNotFound
+	case CodeAccessDenied, CodeSelfApproval:
+		return target == ErrAccessDenied
+	case CodeVersionClaimed:
+		return target == ErrVersionClaimed
+	case CodeRateLimited:
+		return target == ErrRateLimited
+	}
+	return false
+}
+
 // SecretVersion is the version of a secret.
 //
 // Secrets can have multiple values over time, for example when API
@@ -47,6 +130,19 @@ func (v SecretVersion) String() string {
 // translates this to the version marked active.
 const SecretVersionDefault SecretVersion = 0
 
+// JustificationHeader is the HTTP request header in which a client gives its
+// reason for a request. A justification is recorded in the audit log, and is
+// required for access granted by break-glass rules.
+const JustificationHeader = "Setec-Justification"
+
+// MaxJustificationLen is the maximum length in bytes of a justification.
+const MaxJustificationLen = 1024
+
+// RequestIDHeader is the HTTP response header in which the server reports
+// the identifier it assigned to a request. The same identifier is recorded
+// in the audit log entries for the request.
+const RequestIDHeader = "Setec-Request-Id"
+
 // SecretValue is a secret value and its associated version.
 type SecretValue struct {
 	Value   []byte
@@ -65,8 +161,24 @@ type SecretInfo struct {
 	ActiveVersion SecretVersion
 }
 
-// ListRequest is a request to list secrets.
-type ListRequest struct{}
+// ListRequest is a request to list secrets. The zero value lists all the
+// secrets visible to the caller.
+type ListRequest struct {
+	// Prefix, if non-empty, selects only secrets whose names begin with it.
+	Prefix string `json:",omitempty"`
+
+	// Glob, if non-empty, selects only secrets whose names match it, using
+	// the same syntax as the secret names in an access rule.
+	Glob string `json:",omitempty"`
+
+	// Limit, if positive, is the maximum number of secrets to report.
+	Limit int `json:",omitempty"`
+
+	// After, if non-empty, selects only secrets whose names sort after it.
+	// To continue a list reported in pages of Limit secrets, set After to
+	// the name of the last secret of the previous page.
+	After string `json:",omitempty"`
+}
 
 // GetRequest is a request to get a secret value.
 type GetRequest struct {
@@ -87,6 +199,51 @@ type GetRequest struct {
 	UpdateIfChanged bool
 }
 
+// GetManyRequest is a request to fetch the active values of several secrets
+// at once.
+type GetManyRequest struct {
+	// Secrets are the secrets to fetch.
+	Secrets []GetManyItem
+}
+
+// GetManyItem identifies a secret to fetch in a GetManyRequest.
+type GetManyItem struct {
+	// Name is the name of the secret to fetch.
+	Name string
+	// Version, if not SecretVersionDefault, is the active version of the
+	// secret known to the caller. The value is reported only if the active
+	// version differs from it, as for GetRequest.UpdateIfChanged.
+	Version SecretVersion `json:",omitempty"`
+}
+
+// GetManyResponse is the response to a GetManyRequest.
+type GetManyResponse struct {
+	// Results are the results for each requested secret, in the order of
+	// the request.
+	Results []GetManyResult
+}
+
+// GetManyResult is the result of fetching one secret in a GetManyRequest.
+// Exactly one of Value, NotChanged and Error is set.
+type GetManyResult struct {
+	// Name is the name of the secret.
+	Name string
+	// Value is the active value of the secret, if it was fetched.
+	Value *SecretValue `json:",omitempty"`
+	// NotChanged reports that the active version of the secret is the
+	// version given in the request.
+	NotChanged bool `json:",omitempty"`
+	// Error, if non-empty, reports why the secret could not be fetched:
+	// ErrorNotFound, ErrorAccessDenied, or a description of another error.
+	Error string `json:",omitempty"`
+}
+
+// Errors reported in GetManyResult.Error.
+const (
+	ErrorNotFound     = "not found"
+	ErrorAccessDenied = "access denied"
+)
+
 // InfoRequest is a request for secret metadata.
 type InfoRequest struct {
 	// Name is the name of the secret whose metadata to return.
@@ -101,6 +258,56 @@ type PutRequest struct {
 	Value []byte
 }
 
+// GenerateRequest is a request to write a secret value generated by the
+// server, so that the value is never handled by the caller.
+type GenerateRequest struct {
+	// Name is the name of the secret to write.
+	Name string
+	// Spec describes the value to generate.
+	Spec GenerateSpec
+}
+
+// GenerateSpec describes a secret value to be generated by the server.
+type GenerateSpec struct {
+	// Type is the kind of value to generate, one of the Generate constants.
+	Type string
+
+	// Length is the length of the value for GenerateBytes (in bytes) and
+	// GeneratePassword (in characters). If zero, DefaultGenerateLength is
+	// used. It is ignored for other types.
+	Length int `json:",omitempty"`
+
+	// Algorithm selects the curve for GenerateECDSA ("P256", "P384" or
+	// "P521"; default "P256"), or the key template for GenerateKeyset
+	// ("AES256_GCM", "AES128_GCM", "XCHACHA20_POLY1305" or "HMAC_SHA256";
+	// default "AES256_GCM"). It is ignored for other types.
+	Algorithm string `json:",omitempty"`
+}
+
+// String returns a compact description of s, such as "password:32".
+func (s GenerateSpec) String() string {
+	switch {
+	case s.Length != 0:
+		return s.Type + ":" + strconv.Itoa(s.Length)
+	case s.Algorithm != "":
+		return s.Type + ":" + s.Algorithm
+	}
+	return s.Type
+}
+
+// Types of generated values, for GenerateSpec.Type.
+const (
+	GenerateBytes    = "bytes"       // random bytes
+	GeneratePassword = "password"    // random letters and digits
+	GenerateEd25519  = "ed25519"     // PEM-encoded Ed25519 private and public keys
+	GenerateECDSA    = "ecdsa"       // PEM-encoded ECDSA private and public keys
+	GenerateKeyset   = "tink-keyset" // a tink keyset in cleartext JSON
+)
+
+// DefaultGenerateLength is the length of generated bytes and passwords if
+// GenerateSpec.Length is zero.
+const DefaultGenerateLength = 32
+
 // CreateVersionRequest is a request to create a specific version of a secret
 // with a given value.
 type CreateVersionRequest struct {
@@ -135,3 +342,278 @@ type DeleteVersionRequest struct {
 	// active version cannot be deleted.
 	Version SecretVersion
 }
+
+// AuditRequest is a request to search the audit log. Each non-zero field
+// must match for an entry to be reported. The response is a JSON array of
+// audit log entries (see package audit), in chronological order, restricted
+// to secrets for which the caller has acl.ActionAudit permission.
+type AuditRequest struct {
+	// Principal, if set, matches entries whose principal has this user
+	// (login name) or hostname.
+	Principal string `json:",omitempty"`
+	// Tag, if set, matches entries whose principal has this tag.
+	Tag string `json:",omitempty"`
+	// Secret, if set, is a pattern matching secret names.
+	Secret acl.Secret `json:",omitempty"`
+	// Action, if set, matches entries for this action.
+	Action acl.Action `json:",omitempty"`
+	// Authorized, if non-nil, matches entries with this authorization
+	// result.
+	Authorized *bool `json:",omitempty"`
+	// Since and Until, if non-zero, match entries in the half-open interval
+	// [Since, Until).
+	Since time.Time `json:",omitzero"`
+	Until time.Time `json:",omitzero"`
+	// Limit, if positive, is the maximum number of entries to report; the
+	// most recent matching entries are reported. The server may impose a
+	// lower limit.
+	Limit int `json:",omitempty"`
+}
+
+// AuditExportKeyRequest is a request for the public key with which the
+// server signs audit log exports.
+type AuditExportKeyRequest struct{}
+
+// AuditExportKeyResponse is the public key with which the server signs audit
+// log exports.
+type AuditExportKeyResponse struct {
+	// PublicKey is the ed25519 public key.
+	PublicKey []byte
+}
+
+// WhoAmIRequest is a request for the identity and permissions of the caller.
+type WhoAmIRequest struct{}
+
+// WhoAmIResponse is the identity and permissions of the caller, as derived by
+// the server from the caller's peer capabilities.
+type WhoAmIResponse struct {
+	// Hostname is the caller's Tailscale FQDN.
+	Hostname string
+	// IP is the IP address from which the request was received.
+	IP netip.Addr
+	// User is the login name of the caller, or empty for a tagged device.
+	User string `json:",omitempty"`
+	// Tags are the tags of the caller, or nil if the caller is not tagged.
+	Tags []string `json:",omitempty"`
+	// Permissions are the access rules granted to the caller.
+	Permissions acl.Rules
+}
+
+// CheckRequest is a request to explain whether the caller is permitted to
+// perform an action on a secret.
+type CheckRequest struct {
+	// Action is the action to check.
+	Action acl.Action
+	// Name is the name of the secret to check. The secret need not exist.
+	Name string
+}
+
+// CheckResponse is the result of a CheckRequest.
+type CheckResponse struct {
+	// Allowed reports whether the caller may perform the action.
+	Allowed bool
+	// Rule is the index in the caller's permissions of the rule that grants
+	// the action, or -1 if the action is denied. If the action is permitted
+	// only by a break-glass rule, Rule is the index of that rule.
+	Rule int
+	// BreakGlass reports whether the action is permitted only by a
+	// break-glass rule, for requests that carry a justification.
+	BreakGlass bool `json:",omitempty"`
+	// Reason is a human-readable explanation of the decision.
+	Reason string
+}
+
+// PendingRequest is a request for an operation that requires approval by a
+// different principal before it takes effect. The server holds pending
+// requests in memory, so they are discarded if it restarts.
+type PendingRequest struct {
+	// ID is the unique identifier of the request.
+	ID string
+	// Action is the operation requested: "activate" or "delete".
+	Action acl.Action
+	// Name is the name of the secret affected.
+	Name string
+	// Version is the secret version affected, or 0 if the operation applies
+	// to all versions of the secret.
+	Version SecretVersion `json:",omitempty"`
+	// Requester identifies the principal who made the request.
+	Requester string
+	// Created is when the request was made.
+	Created time.Time
+	// Expires is when the request lapses if not approved.
+	Expires time.Time
+}
+
+// ListPendingRequest is a request to list pending approval requests.
+type ListPendingRequest struct{}
+
+// ApproveRequest is a request to approve a pending request, causing the
+// requested operation to take effect.
+type ApproveRequest struct {
+	// ID is the ID of the pending request to approve.
+	ID string
+}
+
+// RejectRequest is a request to reject a pending request, discarding it
+// without performing the requested operation.
+type RejectRequest struct {
+	// ID is the ID of the pending request to reject.
+	ID string
+}
+
+// UsageRequest is a request for usage statistics of secrets.
+type UsageRequest struct {
+	// Name, if set, is the name of the secret to report. Otherwise, all
+	// secrets for which the caller has acl.ActionInfo permission are
+	// reported.
+	Name string `json:",omitempty"`
+	// Days is the period in days for which to report consumers. If zero,
+	// the server uses 30 days.
+	Days int `json:",omitempty"`
+}
+
+// UsageResponse reports usage statistics of secrets.
+type UsageResponse struct {
+	// Since is the time from which usage has been recorded. Secrets may have
+	// been read before this time without being reported.
+	Since time.Time
+	// Secrets are the usage statistics of the requested secrets, ordered by
+	// name.
+	Secrets []*SecretUsage
+}
+
+// SecretUsage reports how a secret has been read.
+type SecretUsage struct {
+	// Name is the name of the secret.
+	Name string
+	// ActiveVersion is the active version of the secret.
+	ActiveVersion SecretVersion
+	// LastGet is the time the secret was last read, or zero if it has not
+	// been read since usage was first recorded.
+	LastGet time.Time `json:",omitzero"`
+	// Consumers are the principals that read the secret in the requested
+	// period, ordered by the time of their last read, most recent first.
+	Consumers []*SecretConsumer `json:",omitempty"`
+	// Versions report the reads of each version of the secret, in order of
+	// version.
+	Versions []*VersionUsage `json:",omitempty"`
+}
+
+// SecretConsumer reports the reads of a secret by one principal.
+type SecretConsumer struct {
+	// Principal identifies the consumer, as "user:<login>" for a user or
+	// "node:<hostname>" for a tagged device.
+	Principal string
+	// LastGet is the time of the consumer's last read of the secret.
+	LastGet time.Time
+	// Version is the version of the secret the consumer last read. A
+	// conditional get that found no change counts as a read of the version
+	// the consumer already had.
+	Version SecretVersion
+}
+
+// VersionUsage reports the reads of one version of a secret.
+type VersionUsage struct {
+	// Version is the version of the secret.
+	Version SecretVersion
+	// Gets is the number of times the version was read.
+	Gets int64
+	// LastGet is the time the version was last read.
+	LastGet time.Time
+}
+
+// WatchSecret identifies a version of a secret, in a WatchRequest or
+// WatchResponse.
+type WatchSecret struct {
+	// Name is the name of the secret.
+	Name string
+	// Version is the active version of the secret known to the caller (in a
+	// request) or on the server (in a response). In a response, version 0
+	// means the secret no longer exists.
+	Version SecretVersion
+}
+
+// WatchRequest is a request to wait until the active version of any of a set
+// of secrets differs from the version known to the caller.
+type WatchRequest struct {
+	// Secrets are the secrets to watch, with the active versions known to
+	// the caller. The caller must have acl.ActionGet permission for each of
+	// them.
+	Secrets []WatchSecret
+	// TimeoutSeconds is the maximum time in seconds to wait for a change. If
+	// zero, the server uses a default. The server may impose a lower limit.
+	TimeoutSeconds int `json:",omitempty"`
+}
+
+// WatchResponse reports the secrets whose active versions have changed.
+type WatchResponse struct {
+	// Changed are the watched secrets whose active versions differ from
+	// those in the request, with their current active versions. It is empty
+	// if the request timed out without a change.
+	Changed []WatchSecret
+}
+
+// VersionsRequest is a request for the versions of the API, and the optional
+// capabilities, that the server supports. The request is served at the same
+// path, /api/versions, by all versions of the API.
+type VersionsRequest struct{}
+
+// VersionsResponse is the response to a VersionsRequest.
+type VersionsResponse struct {
+	// Versions are the versions of the API the server supports, in
+	// increasing order. Version 1 is always supported.
+	Versions []int
+
+	// Capabilities are the optional features the server supports, from the
+	// Cap* constants.
+	Capabilities []string
+}
+
+// Capabilities reported in a VersionsResponse.
+const (
+	CapGetMany     = "get-many"     // /api/get-many
+	CapWatch       = "watch"        // /api/watch
+	CapListSelect  = "list-select"  // prefix, glob and paging options for list
+	CapUsage       = "usage"        // /api/usage
+	CapAuditExport = "audit-export" // /api/audit/export
+)
+
+// HealthResponse reports the health of a server and its components. It is
+// the response to an unauthenticated GET of /healthz or /readyz.
+type HealthResponse struct {
+	// Status is the overall status of the server, the worst of the statuses
+	// of its components.
+	Status string
+
+	// Components are the statuses of the components checked, keyed by the
+	// Component* constants.
+	Components map[string]ComponentHealth
+}
+
+// ComponentHealth is the health of one component of a server.
+type ComponentHealth struct {
+	// Status is one of the Health* constants.
+	Status string
+
+	// Message, if non-empty, describes the status. It never names secrets.
+	Message string `json:",omitempty"`
+
+	// Updated, if non-zero, is when the component was last known to be
+	// working, for example the time of the last successful backup.
+	Updated time.Time `json:",omitzero"`
+}
+
+// Statuses reported in a HealthResponse, from best to worst.
+const (
+	HealthOK       = "ok"       // the component is working
+	HealthDegraded = "degraded" // the component needs attention, but the server can serve
+	HealthFailed   = "failed"   // the component is not working, and the server cannot serve
+)
+
+// Components reported in a HealthResponse.
+const (
+	ComponentDB        = "db"        // the secrets database
+	ComponentAudit     = "audit"     // the audit log
+	ComponentBackup    = "backup"    // database backups, if configured
+	ComponentTailscale = "tailscale" // the server's tailnet connection, if known
+)
@@ -0,0 +1,135 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package apiv2 defines the request and response types for version 2 of the
+// setec API, whose methods are served under /api/v2/.
+//
+// Every method of version 2 takes a request object and returns a response
+// object, so that fields can be added to either without breaking existing
+// clients. Errors are reported as for version 1, with an api.Error body.
+// Methods not defined here are unchanged from version 1, and are served only
+// at their version 1 paths.
+package apiv2
+
+import "github.com/tailscale/setec/types/api"
+
+// Version is the version of the API defined by this package.
+const Version = 2
+
+// PathPrefix is the prefix of the paths of the API methods of this version.
+const PathPrefix = "/api/v2/"
+
+// SecretValue is a secret value and its associated version.
+type SecretValue struct {
+	Value   []byte            `json:"value"`
+	Version api.SecretVersion `json:"version"`
+}
+
+// SecretInfo is information about a named secret.
+type SecretInfo struct {
+	Name          string              `json:"name"`
+	Versions      []api.SecretVersion `json:"versions"`
+	ActiveVersion api.SecretVersion   `json:"activeVersion"`
+}
+
+// ListRequest is a request to list secrets, served at /api/v2/list.
+type ListRequest struct {
+	// Prefix, if non-empty, selects only secrets whose names begin with it.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Glob, if non-empty, selects only secrets whose names match it, using
+	// the same syntax as the secret names in an access rule.
+	Glob string `json:"glob,omitempty"`
+
+	// PageSize, if positive, is the maximum number of secrets to report.
+	PageSize int `json:"pageSize,omitempty"`
+
+	// PageToken, if non-empty, is the NextPageToken of the previous page.
+	PageToken string `json:"pageToken,omitempty"`
+}
+
+// ListResponse is the response to a ListRequest.
+type ListResponse struct {
+	// Secrets are the secrets listed, in order by name.
+	Secrets []*SecretInfo `json:"secrets"`
+
+	// NextPageToken, if non-empty, is the token to request the next page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// GetRequest is a request to get a secret value, served at /api/v2/get.
+type GetRequest struct {
+	// Name is the name of the secret to fetch.
+	Name string `json:"name"`
+
+	// Version is the version to fetch, or zero for the active version.
+	Version api.SecretVersion `json:"version,omitempty"`
+
+	// IfChanged, if true, requests the active version only if it differs
+	// from Version. Otherwise, the response reports NotChanged.
+	IfChanged bool `json:"ifChanged,omitempty"`
+}
+
+// GetResponse is the response to a GetRequest. Exactly one of Value and
+// NotChanged is set.
+type GetResponse struct {
+	Value      *SecretValue `json:"value,omitempty"`
+	NotChanged bool         `json:"notChanged,omitempty"`
+}
+
+// InfoRequest is a request for secret metadata, served at /api/v2/info.
+type InfoRequest struct {
+	Name string `json:"name"`
+}
+
+// InfoResponse is the response to an InfoRequest.
+type InfoResponse struct {
+	Secret *SecretInfo `json:"secret"`
+}
+
+// PutRequest is a request to add a value for a secret, served at
+// /api/v2/put.
+type PutRequest struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+// PutResponse is the response to a PutRequest.
+type PutResponse struct {
+	// Version is the version of the value added.
+	Version api.SecretVersion `json:"version"`
+}
+
+// CreateVersionRequest is a request to create a specific version of a
+// secret and make it active, served at /api/v2/create-version.
+type CreateVersionRequest struct {
+	Name    string            `json:"name"`
+	Version api.SecretVersion `json:"version"`
+	Value   []byte            `json:"value"`
+}
+
+// CreateVersionResponse is the response to a CreateVersionRequest.
+type CreateVersionResponse struct{}
+
+// ActivateRequest is a request to change the active version of a secret,
+// served at /api/v2/activate.
+type ActivateRequest struct {
+	Name    string            `json:"name"`
+	Version api.SecretVersion `json:"version"`
+}
+
+// ActivateResponse is the response to an ActivateRequest.
+type ActivateResponse struct{}
+
+// DeleteRequest is a request to delete a secret, served at /api/v2/delete.
+// Exactly one of Version and All must be set: If Version is non-zero, only
+// that version is deleted; if All is true, the secret and all its versions
+// are deleted.
+type DeleteRequest struct {
+	Name    string            `json:"name"`
+	Version api.SecretVersion `json:"version,omitempty"`
+	All     bool              `json:"all,omitempty"`
+}
+
+// DeleteResponse is the response to a DeleteRequest.
+type DeleteResponse struct{}